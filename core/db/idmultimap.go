@@ -67,6 +67,7 @@ func (db *idMultiMap) Delete(key types.Id, value types.Id) (deleted bool, err ty
 			mapping[i] = mapping[l-1]
 			mapping[l-1] = types.Id{}
 			mapping = mapping[:l-1]
+			db.mapping[key] = mapping
 			break
 		}
 	}
@@ -0,0 +1,86 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	matrixInterfaces "github.com/matrix-org/bullettime/matrix/interfaces"
+	matrixTypes "github.com/matrix-org/bullettime/matrix/types"
+)
+
+type registrationTokenDb struct {
+	sync.RWMutex
+	tokens map[string]*matrixTypes.RegistrationToken
+}
+
+func NewRegistrationTokenDb() (matrixInterfaces.RegistrationTokenStore, error) {
+	return &registrationTokenDb{
+		tokens: map[string]*matrixTypes.RegistrationToken{},
+	}, nil
+}
+
+func (db *registrationTokenDb) AddToken(token matrixTypes.RegistrationToken) (bool, matrixTypes.Error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.tokens[token.Token] != nil {
+		return true, nil
+	}
+	db.tokens[token.Token] = &token
+	return false, nil
+}
+
+func (db *registrationTokenDb) Token(token string) (*matrixTypes.RegistrationToken, matrixTypes.Error) {
+	db.RLock()
+	defer db.RUnlock()
+	existing := db.tokens[token]
+	if existing == nil {
+		return nil, nil
+	}
+	result := *existing
+	return &result, nil
+}
+
+func (db *registrationTokenDb) Tokens() ([]matrixTypes.RegistrationToken, matrixTypes.Error) {
+	db.RLock()
+	defer db.RUnlock()
+	tokens := make([]matrixTypes.RegistrationToken, 0, len(db.tokens))
+	for _, token := range db.tokens {
+		tokens = append(tokens, *token)
+	}
+	return tokens, nil
+}
+
+func (db *registrationTokenDb) UseToken(token string, now time.Time) (bool, matrixTypes.Error) {
+	db.Lock()
+	defer db.Unlock()
+	existing := db.tokens[token]
+	if existing == nil || !existing.Valid(now) {
+		return false, nil
+	}
+	existing.Completed += 1
+	return true, nil
+}
+
+func (db *registrationTokenDb) RemoveToken(token string) (bool, matrixTypes.Error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.tokens[token] == nil {
+		return false, nil
+	}
+	delete(db.tokens, token)
+	return true, nil
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/matrix-org/bullettime/core/types"
 	matrixInterfaces "github.com/matrix-org/bullettime/matrix/interfaces"
 	matrixTypes "github.com/matrix-org/bullettime/matrix/types"
-	"github.com/matrix-org/bullettime/utils"
 )
 
 type roomDb struct { // always lock in the same order as below
@@ -68,14 +67,33 @@ func (db *roomDb) RoomExists(id types.RoomId) (bool, matrixTypes.Error) {
 	return true, nil
 }
 
-func (db *roomDb) SetRoomState(roomId types.RoomId, userId types.UserId, content matrixTypes.TypedContent, stateKey string) (*matrixTypes.State, matrixTypes.Error) {
+func (db *roomDb) RemoveRoom(id types.RoomId) (existed bool, err matrixTypes.Error) {
+	db.roomsLock.Lock()
+	defer db.roomsLock.Unlock()
+	if db.rooms[id] == nil {
+		return false, nil
+	}
+	delete(db.rooms, id)
+	return true, nil
+}
+
+func (db *roomDb) Rooms() ([]types.RoomId, matrixTypes.Error) {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	rooms := make([]types.RoomId, 0, len(db.rooms))
+	for id := range db.rooms {
+		rooms = append(rooms, id)
+	}
+	return rooms, nil
+}
+
+func (db *roomDb) SetRoomState(roomId types.RoomId, eventId types.EventId, userId types.UserId, content matrixTypes.TypedContent, stateKey string) (*matrixTypes.State, matrixTypes.Error) {
 	db.roomsLock.RLock()
 	defer db.roomsLock.RUnlock()
 	room := db.rooms[roomId]
 	if room == nil {
 		return nil, matrixTypes.NotFoundError("room '" + roomId.String() + "' doesn't exist")
 	}
-	var eventId = types.DeriveEventId(utils.RandomString(16), types.Id(userId))
 	stateId := stateId{content.GetEventType(), stateKey}
 
 	state := new(matrixTypes.State)
@@ -95,6 +113,23 @@ func (db *roomDb) SetRoomState(roomId types.RoomId, userId types.UserId, content
 	return state, nil
 }
 
+func (db *roomDb) RedactRoomState(redacted *matrixTypes.State) matrixTypes.Error {
+	db.roomsLock.RLock()
+	defer db.roomsLock.RUnlock()
+	room := db.rooms[redacted.RoomId]
+	if room == nil {
+		return matrixTypes.NotFoundError("room '" + redacted.RoomId.String() + "' doesn't exist")
+	}
+	stateId := stateId{redacted.EventType, redacted.StateKey}
+
+	room.stateLock.Lock()
+	defer room.stateLock.Unlock()
+	if current := room.states[stateId]; current != nil && current.EventId == redacted.EventId {
+		room.states[stateId] = redacted
+	}
+	return nil
+}
+
 func (db *roomDb) RoomState(roomId types.RoomId, eventType, stateKey string) (*matrixTypes.State, matrixTypes.Error) {
 	db.roomsLock.RLock()
 	defer db.roomsLock.RUnlock()
@@ -70,6 +70,16 @@ func (db *stateStore) BucketExists(id types.Id) (bool, types.Error) {
 	return true, nil
 }
 
+func (db *stateStore) Buckets() ([]types.Id, types.Error) {
+	db.RLock()
+	defer db.RUnlock()
+	ids := make([]types.Id, 0, len(db.buckets))
+	for id := range db.buckets {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 func (db *stateStore) SetState(id types.Id, key string, value []byte) ([]byte, types.Error) {
 	db.RLock()
 	defer db.RUnlock()
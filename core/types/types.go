@@ -47,3 +47,12 @@ func (ts Timestamp) MarshalJSON() ([]byte, error) {
 	ms := ts.UnixNano() / int64(time.Millisecond)
 	return []byte(strconv.FormatInt(ms, 10)), nil
 }
+
+func (ts *Timestamp) UnmarshalJSON(bytes []byte) error {
+	ms, err := strconv.ParseInt(string(bytes), 10, 64)
+	if err != nil {
+		return err
+	}
+	ts.Time = time.Unix(0, ms*int64(time.Millisecond))
+	return nil
+}
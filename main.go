@@ -15,9 +15,10 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/matrix-org/bullettime/core/db"
 	ce "github.com/matrix-org/bullettime/core/events"
@@ -30,7 +31,19 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func setupApiEndpoint() http.Handler {
+var registrationMode = flag.String("registration", "open", "registration mode: open, closed, token or shared_secret")
+var registrationSharedSecret = flag.String("registration-shared-secret", "", "secret used for shared secret registration")
+var allowGuests = flag.Bool("allow-guests", false, "allow registration of guest accounts")
+var retentionMaxAge = flag.Duration("retention-max-age", 0, "default maximum age of room history, 0 means no limit")
+var retentionMaxCount = flag.Uint("retention-max-count", 0, "default maximum number of events in room history, 0 means no limit")
+
+const retentionInterval = time.Minute
+
+// Returns the handlers for the client and admin APIs
+func setupApiEndpoints(
+	registrationConfig types.RegistrationConfig,
+	retentionPolicy types.RetentionPolicy,
+) (http.Handler, http.Handler) {
 	stateStore, err := db.NewStateStore()
 	if err != nil {
 		panic(err)
@@ -43,6 +56,10 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
+	registrationTokenStore, err := db.NewRegistrationTokenDb()
+	if err != nil {
+		panic(err)
+	}
 	aliasCache, err := db.NewIdMap()
 	if err != nil {
 		panic(err)
@@ -84,6 +101,10 @@ func setupApiEndpoint() http.Handler {
 		presenceStream,
 		typingStream,
 		typingStream,
+		userStore,
+		userStore,
+		messageStream,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
@@ -106,7 +127,19 @@ func setupApiEndpoint() http.Handler {
 	if err != nil {
 		panic(err)
 	}
-	tokenService, err := service.CreateTokenService()
+	tokenService, err := service.CreateTokenService(userStore)
+	if err != nil {
+		panic(err)
+	}
+	registrationService, err := service.NewRegistrationService(registrationConfig, registrationTokenStore)
+	if err != nil {
+		panic(err)
+	}
+	authService, err := service.NewInteractiveAuthService(
+		service.NewPasswordAuthStage(userService),
+		service.NewDummyAuthStage(),
+		service.NewTokenAuthStage(types.LoginTypeRegistrationToken, registrationService),
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -117,6 +150,9 @@ func setupApiEndpoint() http.Handler {
 		streamMux,
 		messageStream,
 		memberStore,
+		messageStream,
+		messageStream,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
@@ -127,18 +163,55 @@ func setupApiEndpoint() http.Handler {
 		typingStream,
 		roomStore,
 		memberStore,
+		messageStream,
+		presenceStream,
+		messageStream,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	retentionService, err := service.NewRetentionService(
+		retentionPolicy,
+		roomStore,
+		messageStream,
+		messageStream,
+		messageStream,
+		userStore,
 	)
 	if err != nil {
 		panic(err)
 	}
+	go func() {
+		for now := range time.Tick(retentionInterval) {
+			if err := retentionService.EnforceRetention(now); err != nil {
+				log.Println("failed to enforce retention policies: " + err.Error())
+			}
+		}
+	}()
 
 	mux := httprouter.New()
-	api.NewAuthEndpoint(userService, tokenService).Register(mux)
+	api.NewAuthEndpoint(userService, tokenService, authService, registrationService).Register(mux)
+	api.NewAccountEndpoint(userService, tokenService, authService, roomService, profileService).Register(mux)
 	api.NewProfileEndpoint(userService, tokenService, profileService).Register(mux)
 	api.NewPresenceEndpoint(userService, tokenService, presenceService).Register(mux)
 	api.NewRoomsEndpoint(userService, tokenService, roomService, syncService, eventService).Register(mux)
 	api.NewEventsEndpoint(userService, tokenService, eventService, syncService).Register(mux)
 
+	adminMux := httprouter.New()
+	api.NewAdminEndpoint(
+		userService,
+		tokenService,
+		roomService,
+		profileService,
+		registrationService,
+		retentionService,
+	).Register(adminMux)
+
+	return withCors(mux), withCors(adminMux)
+}
+
+func withCors(mux *httprouter.Router) http.Handler {
 	mux.NotFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		api.WriteJsonResponseWithStatus(rw, types.DefaultUnrecognizedError)
 	})
@@ -158,12 +231,30 @@ func setupApiEndpoint() http.Handler {
 }
 
 func main() {
+	flag.Parse()
+
+	registrationConfig := types.DefaultRegistrationConfig()
+	mode, err := types.ParseRegistrationMode(*registrationMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registrationConfig.Mode = mode
+	registrationConfig.SharedSecret = *registrationSharedSecret
+	registrationConfig.AllowGuests = *allowGuests
+
+	retentionPolicy := types.RetentionPolicy{
+		MaxAge:   *retentionMaxAge,
+		MaxCount: *retentionMaxCount,
+	}
+
+	clientApi, adminApi := setupApiEndpoints(registrationConfig, retentionPolicy)
 	mux := http.NewServeMux()
-	mux.Handle("/_matrix/client/api/v1/", http.StripPrefix("/_matrix/client/api/v1", setupApiEndpoint()))
+	mux.Handle("/_matrix/client/api/v1/", http.StripPrefix("/_matrix/client/api/v1", clientApi))
+	mux.Handle("/_matrix/admin/", http.StripPrefix("/_matrix/admin", adminApi))
 
 	port := "4080"
-	if len(os.Args) > 1 {
-		port = os.Args[1]
+	if flag.NArg() > 0 {
+		port = flag.Arg(0)
 	}
 
 	server := &http.Server{
@@ -0,0 +1,176 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type passwordRequest struct {
+	NewPassword string          `json:"new_password"`
+	Auth        *types.AuthDict `json:"auth"`
+}
+
+type deactivateRequest struct {
+	Auth *types.AuthDict `json:"auth"`
+}
+
+const (
+	authOperationPassword   = "password"
+	authOperationDeactivate = "deactivate"
+)
+
+type roomVersionsCapability struct {
+	Default   string            `json:"default"`
+	Available map[string]string `json:"available"`
+}
+
+type capabilities struct {
+	RoomVersions roomVersionsCapability `json:"m.room_versions"`
+}
+
+type capabilitiesResponse struct {
+	Capabilities capabilities `json:"capabilities"`
+}
+
+var defaultAccountFlows = []types.AuthFlow{
+	{Stages: []types.LoginType{types.LoginTypePassword}},
+}
+
+func (e accountEndpoint) postPassword(req *http.Request, body *passwordRequest) interface{} {
+	token, err := readToken(e.userService, e.tokenService, req)
+	if err != nil {
+		return err
+	}
+	if body.NewPassword == "" {
+		return types.BadJsonError("Missing or invalid new_password")
+	}
+	user := token.UserId()
+	err = e.authService.Authenticate(authOperationPassword, defaultAccountFlows, &user, body.Auth)
+	if err != nil {
+		return err
+	}
+	if err := e.userService.SetPassword(user, user, body.NewPassword); err != nil {
+		return err
+	}
+	if err := e.tokenService.RevokeAllAccessTokens(user, token); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e accountEndpoint) postDeactivate(req *http.Request, body *deactivateRequest) interface{} {
+	token, err := readToken(e.userService, e.tokenService, req)
+	if err != nil {
+		return err
+	}
+	user := token.UserId()
+	err = e.authService.Authenticate(authOperationDeactivate, defaultAccountFlows, &user, body.Auth)
+	if err != nil {
+		return err
+	}
+	if err := deactivateUser(e.userService, e.tokenService, e.roomService, e.profileService, user); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+// Leaves all joined rooms, rejects all invites, retracts all knocks, clears the profile and revokes
+// all tokens before deactivating the user. The user is not deactivated if any room can't be left
+func deactivateUser(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	roomService interfaces.RoomService,
+	profileService interfaces.ProfileService,
+	user ct.UserId,
+) types.Error {
+	joined, err := roomService.JoinedRooms(user, user)
+	if err != nil {
+		return err
+	}
+	pending, err := roomService.PendingRooms(user, user)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, room := range append(joined, pending...) {
+		content := types.MembershipEventContent{}
+		content.Membership = types.MembershipLeaving
+		if _, err := roomService.SetState(room, user, &content, user.String()); err != nil {
+			log.Printf("failed to leave room %s when deactivating user %s: %s", room, user, err)
+			failed = append(failed, room.String())
+		}
+	}
+	if len(failed) > 0 {
+		return types.ServerError("failed to leave rooms when deactivating user: " + strings.Join(failed, ", "))
+	}
+	empty := ""
+	if _, err := profileService.UpdateProfile(user, user, &empty, &empty); err != nil {
+		return err
+	}
+	if err := tokenService.RevokeAllAccessTokens(user, nil); err != nil {
+		return err
+	}
+	return userService.Deactivate(user, user)
+}
+
+func (e accountEndpoint) getCapabilities(req *http.Request) interface{} {
+	if _, err := readAccessToken(e.userService, e.tokenService, req); err != nil {
+		return err
+	}
+	available := map[string]string{}
+	for _, version := range types.RoomVersionIds() {
+		available[version] = "stable"
+	}
+	roomVersions := roomVersionsCapability{Default: types.DefaultRoomVersion, Available: available}
+	return capabilitiesResponse{capabilities{roomVersions}}
+}
+
+func (e accountEndpoint) Register(mux *httprouter.Router) {
+	mux.POST("/account/password", jsonHandler(e.postPassword))
+	mux.POST("/account/deactivate", jsonHandler(e.postDeactivate))
+	mux.GET("/capabilities", jsonHandler(e.getCapabilities))
+}
+
+type accountEndpoint struct {
+	userService    interfaces.UserService
+	tokenService   interfaces.TokenService
+	authService    interfaces.InteractiveAuthService
+	roomService    interfaces.RoomService
+	profileService interfaces.ProfileService
+}
+
+func NewAccountEndpoint(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	authService interfaces.InteractiveAuthService,
+	roomService interfaces.RoomService,
+	profileService interfaces.ProfileService,
+) Endpoint {
+	return accountEndpoint{
+		userService,
+		tokenService,
+		authService,
+		roomService,
+		profileService,
+	}
+}
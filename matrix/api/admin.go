@@ -0,0 +1,335 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+type adminUsersResponse struct {
+	Users []types.UserInfo `json:"users"`
+}
+
+type adminUserRoomsResponse struct {
+	JoinedRooms []ct.RoomId `json:"joined_rooms"`
+}
+
+type adminPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Defaults to true
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+type adminSetAdminRequest struct {
+	Admin bool `json:"admin"`
+}
+
+type adminRoomMembersResponse struct {
+	Members []ct.UserId `json:"members"`
+}
+
+type adminPurgeHistoryRequest struct {
+	Before *types.StreamToken `json:"before"`
+}
+
+type adminTokensResponse struct {
+	RegistrationTokens []types.RegistrationToken `json:"registration_tokens"`
+}
+
+// The admin endpoint verifies that the caller is an admin, and then acts on behalf
+// of the target user when calling services that only allow users to act on themselves.
+func (e adminEndpoint) readAdmin(req *http.Request) (ct.UserId, types.Error) {
+	token, err := readToken(e.userService, e.tokenService, req)
+	if err != nil {
+		return ct.UserId{}, err
+	}
+	if !token.IsAdmin() {
+		return ct.UserId{}, types.ForbiddenError("only admins are allowed to do that")
+	}
+	return token.UserId(), nil
+}
+
+func (e adminEndpoint) readAdminAndUser(req *http.Request, params httprouter.Params) (ct.UserId, ct.UserId, types.Error) {
+	caller, err := e.readAdmin(req)
+	if err != nil {
+		return ct.UserId{}, ct.UserId{}, err
+	}
+	user, err := urlParams{params}.user(0, e.userService)
+	if err != nil {
+		return ct.UserId{}, ct.UserId{}, err
+	}
+	return caller, user, nil
+}
+
+func (e adminEndpoint) getUsers(req *http.Request) interface{} {
+	caller, err := e.readAdmin(req)
+	if err != nil {
+		return err
+	}
+	users, err := e.userService.Users(caller)
+	if err != nil {
+		return err
+	}
+	infos := make([]types.UserInfo, 0, len(users))
+	for _, user := range users {
+		info, err := e.userService.UserInfo(user, caller)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, *info)
+	}
+	sort.Sort(userInfosById(infos))
+	return adminUsersResponse{infos}
+}
+
+func (e adminEndpoint) getUser(req *http.Request, params httprouter.Params) interface{} {
+	caller, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	info, err := e.userService.UserInfo(user, caller)
+	if err != nil {
+		return err
+	}
+	return info
+}
+
+func (e adminEndpoint) getUserRooms(req *http.Request, params httprouter.Params) interface{} {
+	_, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	rooms, err := e.roomService.JoinedRooms(user, user)
+	if err != nil {
+		return err
+	}
+	return adminUserRoomsResponse{rooms}
+}
+
+func (e adminEndpoint) postUserPassword(req *http.Request, params httprouter.Params, body *adminPasswordRequest) interface{} {
+	_, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	if body.NewPassword == "" {
+		return types.BadJsonError("Missing or invalid new_password")
+	}
+	if err := e.userService.SetPassword(user, user, body.NewPassword); err != nil {
+		return err
+	}
+	if body.LogoutDevices == nil || *body.LogoutDevices {
+		if err := e.tokenService.RevokeAllAccessTokens(user, nil); err != nil {
+			return err
+		}
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) postUserDeactivate(req *http.Request, params httprouter.Params) interface{} {
+	caller, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	if user == caller {
+		return types.ForbiddenError("admins can't deactivate themselves")
+	}
+	if err := deactivateUser(e.userService, e.tokenService, e.roomService, e.profileService, user); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) putUserAdmin(req *http.Request, params httprouter.Params, body *adminSetAdminRequest) interface{} {
+	caller, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	if err := e.userService.SetAdmin(user, caller, body.Admin); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) postUserLogout(req *http.Request, params httprouter.Params) interface{} {
+	_, user, err := e.readAdminAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	if err := e.tokenService.RevokeAllAccessTokens(user, nil); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) readAdminAndRoom(req *http.Request, params httprouter.Params) (ct.UserId, ct.RoomId, types.Error) {
+	caller, err := e.readAdmin(req)
+	if err != nil {
+		return ct.UserId{}, ct.RoomId{}, err
+	}
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return ct.UserId{}, ct.RoomId{}, err
+	}
+	return caller, room, nil
+}
+
+func (e adminEndpoint) getRoomState(req *http.Request, params httprouter.Params) interface{} {
+	caller, room, err := e.readAdminAndRoom(req, params)
+	if err != nil {
+		return err
+	}
+	state, err := e.roomService.AdminState(room, caller)
+	if err != nil {
+		return err
+	}
+	return state
+}
+
+func (e adminEndpoint) getRoomMembers(req *http.Request, params httprouter.Params) interface{} {
+	caller, room, err := e.readAdminAndRoom(req, params)
+	if err != nil {
+		return err
+	}
+	members, err := e.roomService.AdminMembers(room, caller)
+	if err != nil {
+		return err
+	}
+	return adminRoomMembersResponse{members}
+}
+
+func (e adminEndpoint) deleteRoom(req *http.Request, params httprouter.Params) interface{} {
+	caller, room, err := e.readAdminAndRoom(req, params)
+	if err != nil {
+		return err
+	}
+	if err := e.roomService.PurgeRoom(room, caller); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) postRoomJoin(req *http.Request, params httprouter.Params) interface{} {
+	caller, room, err := e.readAdminAndRoom(req, params)
+	if err != nil {
+		return err
+	}
+	if _, err := e.roomService.AdminJoin(room, caller); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) postPurgeHistory(req *http.Request, params httprouter.Params, body *adminPurgeHistoryRequest) interface{} {
+	caller, room, err := e.readAdminAndRoom(req, params)
+	if err != nil {
+		return err
+	}
+	if body.Before == nil {
+		return types.BadJsonError("Missing or invalid before")
+	}
+	if err := e.retentionService.PurgeHistory(room, caller, *body.Before); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+func (e adminEndpoint) getRegistrationTokens(req *http.Request) interface{} {
+	if _, err := e.readAdmin(req); err != nil {
+		return err
+	}
+	tokens, err := e.registrationService.Tokens()
+	if err != nil {
+		return err
+	}
+	return adminTokensResponse{tokens}
+}
+
+func (e adminEndpoint) postRegistrationToken(req *http.Request, body *types.RegistrationToken) interface{} {
+	if _, err := e.readAdmin(req); err != nil {
+		return err
+	}
+	token, err := e.registrationService.CreateToken(*body)
+	if err != nil {
+		return err
+	}
+	return token
+}
+
+func (e adminEndpoint) deleteRegistrationToken(req *http.Request, params httprouter.Params) interface{} {
+	if _, err := e.readAdmin(req); err != nil {
+		return err
+	}
+	if err := e.registrationService.DeleteToken(params.ByName("token")); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+type userInfosById []types.UserInfo
+
+func (u userInfosById) Len() int           { return len(u) }
+func (u userInfosById) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u userInfosById) Less(i, j int) bool { return u[i].UserId.String() < u[j].UserId.String() }
+
+func (e adminEndpoint) Register(mux *httprouter.Router) {
+	mux.GET("/users", jsonHandler(e.getUsers))
+	mux.GET("/users/:userId", jsonHandler(e.getUser))
+	mux.GET("/users/:userId/rooms", jsonHandler(e.getUserRooms))
+	mux.POST("/users/:userId/password", jsonHandler(e.postUserPassword))
+	mux.POST("/users/:userId/deactivate", jsonHandler(e.postUserDeactivate))
+	mux.PUT("/users/:userId/admin", jsonHandler(e.putUserAdmin))
+	mux.POST("/users/:userId/logout", jsonHandler(e.postUserLogout))
+	mux.GET("/rooms/:roomId/state", jsonHandler(e.getRoomState))
+	mux.GET("/rooms/:roomId/members", jsonHandler(e.getRoomMembers))
+	mux.DELETE("/rooms/:roomId", jsonHandler(e.deleteRoom))
+	mux.POST("/rooms/:roomId/join", jsonHandler(e.postRoomJoin))
+	mux.POST("/rooms/:roomId/purge_history", jsonHandler(e.postPurgeHistory))
+	mux.GET("/registration_tokens", jsonHandler(e.getRegistrationTokens))
+	mux.POST("/registration_tokens/new", jsonHandler(e.postRegistrationToken))
+	mux.DELETE("/registration_tokens/:token", jsonHandler(e.deleteRegistrationToken))
+}
+
+type adminEndpoint struct {
+	userService         interfaces.UserService
+	tokenService        interfaces.TokenService
+	roomService         interfaces.RoomService
+	profileService      interfaces.ProfileService
+	registrationService interfaces.RegistrationService
+	retentionService    interfaces.RetentionService
+}
+
+func NewAdminEndpoint(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	roomService interfaces.RoomService,
+	profileService interfaces.ProfileService,
+	registrationService interfaces.RegistrationService,
+	retentionService interfaces.RetentionService,
+) Endpoint {
+	return adminEndpoint{
+		userService,
+		tokenService,
+		roomService,
+		profileService,
+		registrationService,
+		retentionService,
+	}
+}
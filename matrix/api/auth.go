@@ -27,65 +27,178 @@ import (
 	"net/http"
 )
 
-type LoginType string
+type authRequest struct {
+	Type     types.LoginType `json:"type"`
+	Username string          `json:"user"`
+	Password string          `json:"password"`
+}
 
-const (
-	LoginTypePassword LoginType = "m.login.password"
-	LoginTypeEmail              = "m.login.email.identity"
-)
+type registerRequest struct {
+	Username string          `json:"user"`
+	Password string          `json:"password"`
+	Auth     *types.AuthDict `json:"auth"`
+	// Upgrades the guest that the token belongs to instead of creating a new user
+	GuestAccessToken string `json:"guest_access_token"`
+}
 
-type AuthFlow struct {
-	Stages []LoginType `json:"stages,omitempty"`
-	Type   LoginType   `json:"type"`
+type authResponse struct {
+	UserId      ct.UserId `json:"user_id"`
+	AccessToken string    `json:"access_token"`
 }
 
-type AuthFlows struct {
-	Flows []AuthFlow `json:"flows"`
+type sharedSecretRegisterRequest struct {
+	Nonce    string `json:"nonce"`
+	Username string `json:"user"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+	Mac      string `json:"mac"`
 }
 
-type authRequest struct {
-	Type     LoginType `json:"type"`
-	Username string    `json:"user"`
-	Password string    `json:"password"`
+type nonceResponse struct {
+	Nonce string `json:"nonce"`
 }
 
-type authResponse struct {
-	UserId      ct.UserId `json:"user_id"`
-	AccessToken string    `json:"access_token"`
+type availableResponse struct {
+	Available bool `json:"available"`
 }
 
-var defaultRegisterFlows = AuthFlows{
-	Flows: []AuthFlow{
-		{
-			Stages: []LoginType{ // not implemented
-				LoginTypeEmail,
-				LoginTypePassword,
-			},
-			Type: LoginTypeEmail,
-		},
-		{Type: LoginTypePassword},
+const authOperationRegister = "register"
+const guestLocalpartPrefix = "_guest_"
+
+// Availability checks are limited separately to make enumeration of users slow
+const availabilityCheckRate = 0.5
+const availabilityCheckBurst = 5
+
+var defaultLoginFlows = types.AuthFlows{
+	Flows: []types.AuthFlow{
+		{Type: types.LoginTypePassword},
 	},
 }
 
-var defaultLoginFlows = AuthFlows{
-	Flows: []AuthFlow{
-		{Type: LoginTypePassword},
-	},
+// The auth dict is the one that completed the auth flow, or nil if there was none
+func (e authEndpoint) registerUser(userId ct.UserId, password string, admin bool, auth *types.AuthDict) interface{} {
+	var err types.Error
+	if admin {
+		err = e.userService.CreateAdmin(userId)
+	} else {
+		err = e.userService.CreateUser(userId)
+	}
+	if err != nil {
+		return err
+	}
+	if err := e.useAuthToken(userId, auth); err != nil {
+		return err
+	}
+	if err := e.userService.SetPassword(userId, userId, password); err != nil {
+		return err
+	}
+	accessToken, err := e.tokenService.NewAccessToken(userId)
+	if err != nil {
+		return err
+	}
+	return authResponse{
+		UserId:      userId,
+		AccessToken: accessToken.String(),
+	}
 }
 
-func (e authEndpoint) registerWithPassword(hostname string, body *authRequest) interface{} {
-	if body.Username == "" {
-		body.Username = utils.RandomString(24)
+// Registration tokens are only counted as used once the account exists. If the token
+// was used up by concurrent registrations in the meantime, the account is deactivated.
+func (e authEndpoint) useAuthToken(userId ct.UserId, auth *types.AuthDict) types.Error {
+	if auth == nil || auth.Type != types.LoginTypeRegistrationToken {
+		return nil
+	}
+	tokenErr := e.registrationService.UseAuthToken(auth.Token)
+	if tokenErr == nil {
+		return nil
+	}
+	if err := e.userService.Deactivate(userId, userId); err != nil {
+		return err
+	}
+	return tokenErr
+}
+
+// Validates the requested user id and password before any auth stages are attempted
+func (e authEndpoint) newUserId(hostname, username, password string) (ct.UserId, types.Error) {
+	if err := e.registrationService.ValidateLocalpart(username); err != nil {
+		return ct.UserId{}, err
+	}
+	if password == "" {
+		return ct.UserId{}, types.BadJsonError("Missing or invalid password")
+	}
+	return ct.NewUserId(username, hostname), nil
+}
+
+// Fails if the user id is taken. Only done once the request is authenticated, since it
+// would otherwise allow unlimited enumeration of users
+func (e authEndpoint) testUserIdAvailable(userId ct.UserId) types.Error {
+	exists, err := e.userService.UserExists(userId, userId)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return types.UserInUseError("user '" + userId.String() + "' already exists")
+	}
+	return nil
+}
+
+func (e authEndpoint) getRegister() interface{} {
+	flows, err := e.registrationService.Flows()
+	if err != nil {
+		return err
+	}
+	return &types.AuthFlows{Flows: flows}
+}
+
+func (e authEndpoint) registerGuest(hostname string) interface{} {
+	if !e.registrationService.AllowsGuests() {
+		return types.ForbiddenError("guest access is disabled")
+	}
+	localpart := guestLocalpartPrefix + strings.ToLower(utils.RandomString(16))
+	userId := ct.NewUserId(localpart, hostname)
+	if err := e.userService.CreateGuest(userId); err != nil {
+		return err
+	}
+	accessToken, err := e.tokenService.NewAccessToken(userId)
+	if err != nil {
+		return err
+	}
+	return authResponse{
+		UserId:      userId,
+		AccessToken: accessToken.String(),
+	}
+}
+
+func (e authEndpoint) upgradeGuest(flows []types.AuthFlow, body *registerRequest) interface{} {
+	token, err := e.tokenService.ParseAccessToken(body.GuestAccessToken)
+	if err != nil {
+		return err
+	}
+	userId := token.UserId()
+	isGuest, err := e.userService.IsGuest(userId, userId)
+	if err != nil {
+		return err
+	}
+	if !isGuest {
+		return types.ForbiddenError("user '" + userId.String() + "' is not a guest")
+	}
+	if body.Username != "" && body.Username != userId.Id {
+		return types.InvalidUsernameError("upgraded guests keep their user id")
 	}
 	if body.Password == "" {
 		return types.BadJsonError("Missing or invalid password")
 	}
-	userId := ct.NewUserId(body.Username, hostname)
-	err := e.userService.CreateUser(userId)
+	err = e.authService.Authenticate(authOperationRegister, flows, &userId, body.Auth)
 	if err != nil {
 		return err
 	}
-	if err := e.userService.SetPassword(userId, userId, body.Password); err != nil {
+	if err := e.userService.UpgradeGuest(userId, userId, body.Password); err != nil {
+		return err
+	}
+	if err := e.useAuthToken(userId, body.Auth); err != nil {
+		return err
+	}
+	if err := e.tokenService.RevokeAllAccessTokens(userId, nil); err != nil {
 		return err
 	}
 	accessToken, err := e.tokenService.NewAccessToken(userId)
@@ -98,13 +211,77 @@ func (e authEndpoint) registerWithPassword(hostname string, body *authRequest) i
 	}
 }
 
-func (e authEndpoint) postRegister(req *http.Request, body *authRequest) interface{} {
-	switch body.Type {
-	case LoginTypePassword:
-		hostname := strings.Split(req.Host, ":")[0]
-		return e.registerWithPassword(hostname, body)
+func (e authEndpoint) postRegister(req *http.Request, body *registerRequest) interface{} {
+	hostname := strings.Split(req.Host, ":")[0]
+	kind := req.URL.Query().Get("kind")
+	switch kind {
+	case "guest":
+		return e.registerGuest(hostname)
+	case "", "user":
+	default:
+		return types.BadQueryError("invalid registration kind: " + kind)
 	}
-	return types.BadJsonError(fmt.Sprintf("Missing or invalid login type: '%s'", body.Type))
+	flows, err := e.registrationService.Flows()
+	if err != nil {
+		return err
+	}
+	if body.GuestAccessToken != "" {
+		return e.upgradeGuest(flows, body)
+	}
+	userId, err := e.newUserId(hostname, body.Username, body.Password)
+	if err != nil {
+		return err
+	}
+	err = e.authService.Authenticate(authOperationRegister, flows, nil, body.Auth)
+	if err != nil {
+		return err
+	}
+	if err := e.testUserIdAvailable(userId); err != nil {
+		return err
+	}
+	return e.registerUser(userId, body.Password, false, body.Auth)
+}
+
+func (e authEndpoint) getRegisterAvailable(req *http.Request) interface{} {
+	if !e.availabilityLimiter.allow(clientAddress(req)) {
+		return types.LimitExceededError("too many username availability checks")
+	}
+	if _, err := e.registrationService.Flows(); err != nil {
+		return err
+	}
+	username := req.URL.Query().Get("username")
+	if err := e.registrationService.ValidateLocalpart(username); err != nil {
+		return err
+	}
+	hostname := strings.Split(req.Host, ":")[0]
+	if err := e.testUserIdAvailable(ct.NewUserId(username, hostname)); err != nil {
+		return err
+	}
+	return availableResponse{true}
+}
+
+func (e authEndpoint) getSharedSecretNonce() interface{} {
+	nonce, err := e.registrationService.NewSharedSecretNonce()
+	if err != nil {
+		return err
+	}
+	return nonceResponse{nonce}
+}
+
+func (e authEndpoint) postSharedSecretRegister(req *http.Request, body *sharedSecretRegisterRequest) interface{} {
+	hostname := strings.Split(req.Host, ":")[0]
+	userId, err := e.newUserId(hostname, body.Username, body.Password)
+	if err != nil {
+		return err
+	}
+	err = e.registrationService.VerifySharedSecret(body.Nonce, body.Username, body.Password, body.Admin, body.Mac)
+	if err != nil {
+		return err
+	}
+	if err := e.testUserIdAvailable(userId); err != nil {
+		return err
+	}
+	return e.registerUser(userId, body.Password, body.Admin, nil)
 }
 
 func (e authEndpoint) loginWithPassword(hostname string, body *authRequest) interface{} {
@@ -141,7 +318,7 @@ func (e authEndpoint) loginWithPassword(hostname string, body *authRequest) inte
 
 func (e authEndpoint) postLogin(req *http.Request, body *authRequest) interface{} {
 	switch body.Type {
-	case LoginTypePassword:
+	case types.LoginTypePassword:
 		hostname := strings.Split(req.Host, ":")[0]
 		return e.loginWithPassword(hostname, body)
 	}
@@ -149,27 +326,36 @@ func (e authEndpoint) postLogin(req *http.Request, body *authRequest) interface{
 }
 
 func (e authEndpoint) Register(mux *httprouter.Router) {
-	mux.GET("/register", jsonHandler(func() interface{} {
-		return &defaultRegisterFlows
-	}))
+	mux.GET("/register", jsonHandler(e.getRegister))
 	mux.GET("/login", jsonHandler(func() interface{} {
 		return &defaultLoginFlows
 	}))
 	mux.POST("/register", jsonHandler(e.postRegister))
+	mux.GET("/register/available", jsonHandler(e.getRegisterAvailable))
+	mux.GET("/register/shared_secret", jsonHandler(e.getSharedSecretNonce))
+	mux.POST("/register/shared_secret", jsonHandler(e.postSharedSecretRegister))
 	mux.POST("/login", jsonHandler(e.postLogin))
 }
 
 type authEndpoint struct {
-	userService  interfaces.UserService
-	tokenService interfaces.TokenService
+	userService         interfaces.UserService
+	tokenService        interfaces.TokenService
+	authService         interfaces.InteractiveAuthService
+	registrationService interfaces.RegistrationService
+	availabilityLimiter *rateLimiter
 }
 
 func NewAuthEndpoint(
 	userService interfaces.UserService,
 	tokenService interfaces.TokenService,
+	authService interfaces.InteractiveAuthService,
+	registrationService interfaces.RegistrationService,
 ) Endpoint {
 	return authEndpoint{
-		userService:  userService,
-		tokenService: tokenService,
+		userService:         userService,
+		tokenService:        tokenService,
+		authService:         authService,
+		registrationService: registrationService,
+		availabilityLimiter: newRateLimiter(availabilityCheckRate, availabilityCheckBurst),
 	}
 }
@@ -26,10 +26,11 @@ import (
 )
 
 func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
+	accessToken, err := readToken(e.userService, e.tokenService, req)
 	if err != nil {
 		return err
 	}
+	authedUser := accessToken.UserId()
 
 	query := urlQuery{req.URL.Query()}
 
@@ -75,7 +76,7 @@ func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
 		close(cancel)
 	}(time.Millisecond * time.Duration(timeout))
 
-	chunk, err := e.eventService.Range(authedUser, from, to, uint(limit), cancel)
+	chunk, err := e.eventService.Range(authedUser, accessToken.SessionId(), from, to, uint(limit), cancel)
 	if err != nil {
 		return err
 	}
@@ -84,15 +85,16 @@ func (e eventsEndpoint) getEvents(req *http.Request) interface{} {
 }
 
 func (e eventsEndpoint) getSingleEvent(req *http.Request, params httprouter.Params) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
+	accessToken, err := readToken(e.userService, e.tokenService, req)
 	if err != nil {
 		return err
 	}
+	authedUser := accessToken.UserId()
 	eventId, parseErr := ct.ParseEventId(params[0].Value)
 	if parseErr != nil {
 		return types.BadJsonError(parseErr.Error())
 	}
-	event, err := e.eventService.Event(authedUser, eventId)
+	event, err := e.eventService.Event(authedUser, accessToken.SessionId(), eventId)
 	if err != nil {
 		return err
 	}
@@ -100,10 +102,11 @@ func (e eventsEndpoint) getSingleEvent(req *http.Request, params httprouter.Para
 }
 
 func (e eventsEndpoint) getInitialSync(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
+	accessToken, err := readToken(e.userService, e.tokenService, req)
 	if err != nil {
 		return err
 	}
+	authedUser := accessToken.UserId()
 
 	query := urlQuery{req.URL.Query()}
 
@@ -115,26 +118,22 @@ func (e eventsEndpoint) getInitialSync(req *http.Request) interface{} {
 		limit = 100 //TODO: make configurable
 	}
 
-	initialSync, err := e.syncService.FullSync(authedUser, uint(limit))
+	archived, err := query.parseBool("archived", false)
 	if err != nil {
 		return err
 	}
-	return initialSync
-}
 
-func (e eventsEndpoint) getPublicRooms(req *http.Request) interface{} {
-	authedUser, err := readAccessToken(e.userService, e.tokenService, req)
+	initialSync, err := e.syncService.FullSync(authedUser, accessToken.SessionId(), uint(limit), archived)
 	if err != nil {
 		return err
 	}
-	return authedUser
+	return initialSync
 }
 
 func (e eventsEndpoint) Register(mux *httprouter.Router) {
 	mux.GET("/events", jsonHandler(e.getEvents))
 	mux.PUT("/events/:eventId", jsonHandler(e.getSingleEvent))
 	mux.GET("/initialSync", jsonHandler(e.getInitialSync))
-	mux.PUT("/publicRooms", jsonHandler(e.getPublicRooms))
 }
 
 type eventsEndpoint struct {
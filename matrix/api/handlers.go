@@ -168,22 +168,34 @@ func readAccessToken(
 	tokenService interfaces.TokenService,
 	req *http.Request,
 ) (ct.UserId, types.Error) {
+	info, err := readToken(userService, tokenService, req)
+	if err != nil {
+		return ct.UserId{}, err
+	}
+	return info.UserId(), nil
+}
+
+func readToken(
+	userService interfaces.UserService,
+	tokenService interfaces.TokenService,
+	req *http.Request,
+) (interfaces.Token, types.Error) {
 	token := req.URL.Query().Get("access_token")
 	if token == "" {
-		return ct.UserId{}, types.DefaultMissingTokenError
+		return nil, types.DefaultMissingTokenError
 	}
 	info, err := tokenService.ParseAccessToken(token)
 	if err != nil {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return nil, types.DefaultUnknownTokenError
 	}
 	exists, err := userService.UserExists(info.UserId(), info.UserId())
 	if err != nil {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return nil, types.DefaultUnknownTokenError
 	}
 	if !exists {
-		return ct.UserId{}, types.DefaultUnknownTokenError
+		return nil, types.DefaultUnknownTokenError
 	}
-	return info.UserId(), nil
+	return info, nil
 }
 
 type urlParams struct {
@@ -232,6 +244,19 @@ func (q urlQuery) parseUint(name string, defaultValue uint64) (uint64, types.Err
 	return value, nil
 }
 
+func (q urlQuery) parseBool(name string, defaultValue bool) (bool, types.Error) {
+	str := q.Get(name)
+	if str == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, types.BadQueryError(err.Error())
+	}
+	return value, nil
+}
+
 func (q urlQuery) parseStreamToken(name string) (*types.StreamToken, types.Error) {
 	str := q.Get(name)
 	if str == "" {
@@ -0,0 +1,95 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Buckets are swept once there are this many of them
+const rateLimiterSweepSize = 1024
+
+// A token bucket rate limiter keyed by client address
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*rateBucket
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*rateBucket{},
+		now:     time.Now,
+	}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	if len(l.buckets) >= rateLimiterSweepSize {
+		l.sweep(now)
+	}
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{l.burst, now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = l.refill(bucket, now)
+		bucket.updated = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+func (l *rateLimiter) refill(bucket *rateBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.updated).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// Removes all buckets that have been refilled, since they are equivalent to new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if l.refill(bucket, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func clientAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
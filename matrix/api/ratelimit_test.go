@@ -0,0 +1,108 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns a limiter with a clock that only moves when the returned function is called
+func newTestRateLimiter(rate float64, burst int) (*rateLimiter, func(time.Duration)) {
+	limiter := newRateLimiter(rate, burst)
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time {
+		return now
+	}
+	return limiter, func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter, _ := newTestRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("a") {
+			t.Fatal("expected request within burst to be allowed: ", i)
+		}
+	}
+	if limiter.allow("a") {
+		t.Error("expected request beyond burst to be limited")
+	}
+	if !limiter.allow("b") {
+		t.Error("expected other clients to have their own bucket")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter, advance := newTestRateLimiter(0.5, 2)
+	limiter.allow("a")
+	limiter.allow("a")
+	advance(time.Second)
+	if limiter.allow("a") {
+		t.Fatal("expected half a token not to be enough")
+	}
+	advance(time.Second)
+	if !limiter.allow("a") {
+		t.Fatal("expected a token to be refilled after two seconds")
+	}
+	if limiter.allow("a") {
+		t.Fatal("expected the refilled token to be used up")
+	}
+	advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !limiter.allow("a") {
+			t.Fatal("expected bucket to be refilled up to the burst: ", i)
+		}
+	}
+	if limiter.allow("a") {
+		t.Error("expected refill to be capped at the burst")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter, advance := newTestRateLimiter(1, 1)
+	for i := 0; i < rateLimiterSweepSize; i++ {
+		limiter.allow(string(rune('a' + i)))
+	}
+	advance(time.Second)
+	limiter.allow("new")
+	if len(limiter.buckets) != 1 {
+		t.Error("expected refilled buckets to be swept, got ", len(limiter.buckets))
+	}
+}
+
+func TestRegisterAvailableRateLimited(t *testing.T) {
+	limiter, _ := newTestRateLimiter(0, 0)
+	e := authEndpoint{availabilityLimiter: limiter}
+	req := httptest.NewRequest("GET", "/register/available?username=test", nil)
+	rw := httptest.NewRecorder()
+	jsonHandler(e.getRegisterAvailable)(rw, req, nil)
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatal("expected status 429, got ", rw.Code)
+	}
+	var body struct {
+		ErrorCode string `json:"errcode"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrorCode != "M_LIMIT_EXCEEDED" {
+		t.Error("expected M_LIMIT_EXCEEDED, got ", body.ErrorCode)
+	}
+}
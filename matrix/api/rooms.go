@@ -45,6 +45,10 @@ type userRequest struct {
 	UserId ct.UserId `json:"user_id"`
 }
 
+type redactRequest struct {
+	Reason string `json:"reason"`
+}
+
 func (e roomsEndpoint) createRoom(req *http.Request, body *types.RoomDescription) interface{} {
 	creator, err := readAccessToken(e.userService, e.tokenService, req)
 	if err != nil {
@@ -58,6 +62,22 @@ func (e roomsEndpoint) createRoom(req *http.Request, body *types.RoomDescription
 	return CreateRoomResponse{room, alias}
 }
 
+type publicRoomsResponse struct {
+	Chunk []types.PublicRoom `json:"chunk"`
+}
+
+func (e roomsEndpoint) getPublicRooms(req *http.Request) interface{} {
+	user, err := readAccessToken(e.userService, e.tokenService, req)
+	if err != nil {
+		return err
+	}
+	rooms, err := e.roomService.PublicRooms(user)
+	if err != nil {
+		return err
+	}
+	return publicRoomsResponse{rooms}
+}
+
 func (e roomsEndpoint) doWildcardJoin(req *http.Request, params httprouter.Params) interface{} {
 	user, err := readAccessToken(e.userService, e.tokenService, req)
 	if err != nil {
@@ -85,23 +105,49 @@ func (e roomsEndpoint) doWildcardJoin(req *http.Request, params httprouter.Param
 }
 
 func (e roomsEndpoint) sendMessage(req *http.Request, params httprouter.Params, content *map[string]interface{}) interface{} {
-	user, err := readAccessToken(e.userService, e.tokenService, req)
+	token, err := readToken(e.userService, e.tokenService, req)
 	if err != nil {
 		return err
 	}
+	user := token.UserId()
 	room, parseErr := ct.ParseRoomId(params[0].Value)
 	if parseErr != nil {
 		return types.BadParamError(parseErr.Error())
 	}
 	eventType := params[1].Value
+	txnId := ""
+	if len(params) > 2 {
+		txnId = params[2].Value
+	}
 	typedContent := types.NewGenericContent(*content, eventType)
-	message, err := e.roomService.AddMessage(room, user, typedContent)
+	message, err := e.roomService.AddMessage(room, user, typedContent, transaction(token, txnId))
 	if err != nil {
 		return err
 	}
 	return eventIdResponse{message.EventId}
 }
 
+func (e roomsEndpoint) doRedact(req *http.Request, params httprouter.Params, body *redactRequest) interface{} {
+	room, token, err := e.getRoomAndToken(req, params)
+	if err != nil {
+		return err
+	}
+	user := token.UserId()
+	eventId, parseErr := ct.ParseEventId(params[1].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	txnId := ""
+	if len(params) > 2 {
+		txnId = params[2].Value
+	}
+	redaction, err := e.roomService.Redact(room, user, eventId, body.Reason, transaction(token, txnId))
+	if err != nil {
+		return err
+	}
+	return eventIdResponse{redaction.EventId}
+}
+
 func (e roomsEndpoint) doInvite(req *http.Request, params httprouter.Params, body *userRequest) interface{} {
 	room, user, err := e.getRoomAndUser(req, params)
 	if err != nil {
@@ -186,11 +232,43 @@ func (e roomsEndpoint) doLeave(req *http.Request, params httprouter.Params) inte
 	return eventIdResponse{state.EventId}
 }
 
-func (e roomsEndpoint) doInitialSync(req *http.Request, params httprouter.Params) interface{} {
+func (e roomsEndpoint) doForget(req *http.Request, params httprouter.Params) interface{} {
 	room, user, err := e.getRoomAndUser(req, params)
 	if err != nil {
 		return err
 	}
+	if err := e.roomService.ForgetRoom(room, user); err != nil {
+		return err
+	}
+	return struct{}{}
+}
+
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom ct.RoomId `json:"replacement_room"`
+}
+
+func (e roomsEndpoint) doUpgrade(req *http.Request, params httprouter.Params, body *upgradeRoomRequest) interface{} {
+	room, user, err := e.getRoomAndUser(req, params)
+	if err != nil {
+		return err
+	}
+	replacement, err := e.roomService.UpgradeRoom(room, user, body.NewVersion)
+	if err != nil {
+		return err
+	}
+	return upgradeRoomResponse{replacement}
+}
+
+func (e roomsEndpoint) doInitialSync(req *http.Request, params httprouter.Params) interface{} {
+	room, token, err := e.getRoomAndToken(req, params)
+	if err != nil {
+		return err
+	}
+	user := token.UserId()
 
 	query := req.URL.Query()
 	limitStr := query.Get("limit")
@@ -209,7 +287,7 @@ func (e roomsEndpoint) doInitialSync(req *http.Request, params httprouter.Params
 		}
 	}
 
-	roomSync, err := e.syncService.RoomSync(user, room, uint(limit))
+	roomSync, err := e.syncService.RoomSync(user, token.SessionId(), room, uint(limit))
 	if err != nil {
 		return err
 	}
@@ -228,19 +306,7 @@ func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request,
 		stateKey = params[2].Value
 	}
 
-	var content types.TypedContent
-	switch eventType {
-	case types.EventTypeMembership:
-		content = &types.MembershipEventContent{}
-	case types.EventTypeName:
-		content = &types.NameEventContent{}
-	case types.EventTypeTopic:
-		content = &types.TopicEventContent{}
-	case types.EventTypePowerLevels:
-		content = &types.PowerLevelsEventContent{}
-	case types.EventTypeJoinRules:
-		content = &types.JoinRulesEventContent{}
-	}
+	content := types.NewStateContent(eventType)
 	var jsonErr error
 	if content != nil {
 		jsonErr = json.NewDecoder(req.Body).Decode(content)
@@ -272,10 +338,11 @@ func (e roomsEndpoint) handlePutState(rw http.ResponseWriter, req *http.Request,
 }
 
 func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params) interface{} {
-	room, user, err := e.getRoomAndUser(req, params)
+	room, accessToken, err := e.getRoomAndToken(req, params)
 	if err != nil {
 		return err
 	}
+	user := accessToken.UserId()
 
 	var from *types.StreamToken
 	var to *types.StreamToken
@@ -321,7 +388,15 @@ func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params)
 			limit = 100 //TODO: make configurable
 		}
 	}
-	eventRange, err := e.eventService.Messages(user, room, from, to, uint(limit))
+	var filter *types.RoomEventFilter
+	if filterStr := query.Get("filter"); filterStr != "" {
+		filter = &types.RoomEventFilter{}
+		if err := json.Unmarshal([]byte(filterStr), filter); err != nil {
+			return types.BadQueryError(err.Error())
+		}
+	}
+
+	eventRange, err := e.eventService.Messages(user, accessToken.SessionId(), room, from, to, uint(limit), filter)
 	log.Println("TO", to, eventRange)
 	if err != nil {
 		return err
@@ -330,6 +405,73 @@ func (e roomsEndpoint) getMessages(req *http.Request, params httprouter.Params)
 	return eventRange
 }
 
+func (e roomsEndpoint) getRelations(req *http.Request, params httprouter.Params) interface{} {
+	room, token, err := e.getRoomAndToken(req, params)
+	if err != nil {
+		return err
+	}
+	user := token.UserId()
+	parent, parseErr := ct.ParseEventId(params[1].Value)
+	if parseErr != nil {
+		return types.BadParamError(parseErr.Error())
+	}
+	var relType, eventType string
+	if len(params) > 2 {
+		relType = params[2].Value
+	}
+	if len(params) > 3 {
+		eventType = params[3].Value
+	}
+
+	query := urlQuery{req.URL.Query()}
+
+	from, err := query.parseStreamToken("from")
+	if err != nil {
+		return err
+	}
+	limit, err := query.parseUint("limit", 10)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+
+	chunk, err := e.eventService.Relations(user, token.SessionId(), room, parent, relType, eventType, from, uint(limit))
+	if err != nil {
+		return err
+	}
+	return chunk
+}
+
+func (e roomsEndpoint) getThreads(req *http.Request, params httprouter.Params) interface{} {
+	room, token, err := e.getRoomAndToken(req, params)
+	if err != nil {
+		return err
+	}
+	user := token.UserId()
+
+	query := urlQuery{req.URL.Query()}
+
+	from, err := query.parseStreamToken("from")
+	if err != nil {
+		return err
+	}
+	limit, err := query.parseUint("limit", 10)
+	if err != nil {
+		return err
+	}
+	if limit > 100 {
+		limit = 100 //TODO: make configurable
+	}
+
+	chunk, err := e.eventService.Threads(user, token.SessionId(), room, from, uint(limit))
+	if err != nil {
+		return err
+	}
+	return chunk
+}
+
 func (e roomsEndpoint) getRoomAndUser(req *http.Request, params httprouter.Params) (ct.RoomId, ct.UserId, types.Error) {
 	user, err := readAccessToken(e.userService, e.tokenService, req)
 	if err != nil {
@@ -342,9 +484,31 @@ func (e roomsEndpoint) getRoomAndUser(req *http.Request, params httprouter.Param
 	return room, user, nil
 }
 
+func (e roomsEndpoint) getRoomAndToken(req *http.Request, params httprouter.Params) (ct.RoomId, interfaces.Token, types.Error) {
+	token, err := readToken(e.userService, e.tokenService, req)
+	if err != nil {
+		return ct.RoomId{}, nil, err
+	}
+	room, err := urlParams{params}.room(0)
+	if err != nil {
+		return ct.RoomId{}, nil, err
+	}
+	return room, token, nil
+}
+
+// Scopes the transaction id to the session of the token, events sent without an id have no transaction
+func transaction(token interfaces.Token, txnId string) *types.Transaction {
+	if txnId == "" {
+		return nil
+	}
+	return &types.Transaction{SessionId: token.SessionId(), Id: txnId}
+}
+
 func (e roomsEndpoint) Register(mux *httprouter.Router) {
 	mux.POST("/rooms/:roomId/send/:eventType", jsonHandler(e.sendMessage))
 	mux.PUT("/rooms/:roomId/send/:eventType/:txn", jsonHandler(e.sendMessage))
+	mux.POST("/rooms/:roomId/redact/:eventId", jsonHandler(e.doRedact))
+	mux.PUT("/rooms/:roomId/redact/:eventId/:txn", jsonHandler(e.doRedact))
 	mux.PUT("/rooms/:roomId/state/:eventType", e.handlePutState)
 	mux.PUT("/rooms/:roomId/state/:eventType/:stateKey", e.handlePutState)
 	// mux.GET("/rooms/:roomId/state/:eventType", jsonHandler(dummy))
@@ -355,13 +519,20 @@ func (e roomsEndpoint) Register(mux *httprouter.Router) {
 	mux.POST("/rooms/:roomId/join", jsonHandler(e.doJoin))
 	mux.POST("/rooms/:roomId/knock", jsonHandler(e.doKnock))
 	mux.POST("/rooms/:roomId/leave", jsonHandler(e.doLeave))
+	mux.POST("/rooms/:roomId/forget", jsonHandler(e.doForget))
+	mux.POST("/rooms/:roomId/upgrade", jsonHandler(e.doUpgrade))
 	mux.GET("/rooms/:roomId/messages", jsonHandler(e.getMessages))
+	mux.GET("/rooms/:roomId/relations/:eventId", jsonHandler(e.getRelations))
+	mux.GET("/rooms/:roomId/relations/:eventId/:relType", jsonHandler(e.getRelations))
+	mux.GET("/rooms/:roomId/relations/:eventId/:relType/:eventType", jsonHandler(e.getRelations))
+	mux.GET("/rooms/:roomId/threads", jsonHandler(e.getThreads))
 	// mux.GET("/rooms/:roomId/members", jsonHandler(dummy))
 	// mux.GET("/rooms/:roomId/state", jsonHandler(dummy))
 	// mux.PUT("/rooms/:roomId/typing/:userId", jsonHandler(dummy))
 	mux.GET("/rooms/:roomId/initialSync", jsonHandler(e.doInitialSync))
 	mux.POST("/join/:roomAliasOrId", jsonHandler(e.doWildcardJoin))
 	mux.POST("/createRoom", jsonHandler(e.createRoom))
+	mux.GET("/publicRooms", jsonHandler(e.getPublicRooms))
 }
 
 type roomsEndpoint struct {
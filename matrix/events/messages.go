@@ -17,6 +17,7 @@ package events
 import (
 	"container/list"
 	"log"
+	"sort"
 	"sync"
 	"sync/atomic"
 
@@ -38,11 +39,38 @@ func (m *indexedEvent) Index() uint64 {
 	return m.index
 }
 
+type roomMember struct {
+	room ct.RoomId
+	user ct.UserId
+}
+
+type membershipChange struct {
+	index      uint64
+	membership types.Membership
+}
+
+type visibilityChange struct {
+	index      uint64
+	visibility types.HistoryVisibility
+}
+
 type messageStream struct {
-	lock           sync.RWMutex
-	list           *list.List
-	byId           map[ct.Id]indexedEvent
-	byIndex        []*indexedEvent
+	lock    sync.RWMutex
+	list    *list.List
+	byId    map[ct.Id]indexedEvent
+	byIndex []*indexedEvent
+	// index of the first entry in byIndex, everything before it has been purged
+	offset       uint64
+	historyStart map[ct.RoomId]uint64
+	// membership and history visibility changes in stream order, used to decide what users may see
+	memberships  map[roomMember][]membershipChange
+	visibilities map[ct.RoomId][]visibilityChange
+	// indices of the events that relate to each event, in stream order
+	relations map[ct.EventId][]uint64
+	// the roots of the threads in each room
+	threads map[ct.RoomId]map[ct.EventId]struct{}
+	// the version of each room, from its create event
+	versions       map[ct.RoomId]*types.RoomVersion
 	max            uint64
 	members        interfaces.MembershipStore
 	asyncEventSink interfaces.AsyncEventSink
@@ -56,6 +84,12 @@ func NewMessageStream(
 		list:           list.New(),
 		byId:           map[ct.Id]indexedEvent{},
 		byIndex:        []*indexedEvent{},
+		historyStart:   map[ct.RoomId]uint64{},
+		memberships:    map[roomMember][]membershipChange{},
+		visibilities:   map[ct.RoomId][]visibilityChange{},
+		relations:      map[ct.EventId][]uint64{},
+		threads:        map[ct.RoomId]map[ct.EventId]struct{}{},
+		versions:       map[ct.RoomId]*types.RoomVersion{},
 		members:        members,
 		asyncEventSink: asyncEventSink,
 	}, nil
@@ -68,11 +102,32 @@ func (s *messageStream) Send(event types.Event) (uint64, types.Error) {
 	index := atomic.AddUint64(&s.max, 1) - 1
 	indexed := indexedEvent{event, index}
 
-	if currentItem, ok := s.byId[event.GetEventKey()]; ok {
-		s.byIndex[currentItem.index] = nil
+	if currentItem, ok := s.byId[event.GetEventKey()]; ok && currentItem.index >= s.offset {
+		s.byIndex[currentItem.index-s.offset] = nil
 	}
 	s.byIndex = append(s.byIndex, &indexed)
 	s.byId[event.GetEventKey()] = indexed
+	s.trackVisibility(event, index)
+	if create, ok := event.GetContent().(*types.CreateEventContent); ok {
+		if version, err := create.Version(); err == nil {
+			s.versions[*event.GetRoomId()] = version
+		} else {
+			log.Println("failed to get room version of create event:", err)
+		}
+	}
+	if redaction, ok := event.GetContent().(*types.RedactionEventContent); ok {
+		s.redact(redaction.Redacts, event)
+	}
+	if relation, _ := types.ContentRelation(event.GetContent()); relation != nil {
+		s.relations[relation.EventId] = append(s.relations[relation.EventId], index)
+		if relation.RelType == types.RelationThread {
+			room := *event.GetRoomId()
+			if s.threads[room] == nil {
+				s.threads[room] = map[ct.EventId]struct{}{}
+			}
+			s.threads[room][relation.EventId] = struct{}{}
+		}
+	}
 
 	users, err := s.members.Users(*event.GetRoomId())
 	if err != nil {
@@ -89,13 +144,130 @@ func (s *messageStream) Send(event types.Event) (uint64, types.Error) {
 	return index, nil
 }
 
+// Replaces the redacted event with a redacted copy, the original event is left untouched
+// since it may still be in use. Must be called with the write lock held
+func (s *messageStream) redact(eventId ct.EventId, redaction types.Event) {
+	indexed, ok := s.byId[ct.Id(eventId)]
+	if !ok || *indexed.event.GetRoomId() != *redaction.GetRoomId() {
+		return
+	}
+	version, ok := s.versions[*redaction.GetRoomId()]
+	if !ok {
+		log.Println("missing room version, can't redact event:", eventId)
+		return
+	}
+	redacted, err := types.Redact(version, indexed.event, redaction)
+	if err != nil {
+		log.Println("failed to redact event:", eventId, err)
+		return
+	}
+	redactedIndexed := indexedEvent{redacted, indexed.index}
+	s.byId[ct.Id(eventId)] = redactedIndexed
+	if indexed.index >= s.offset && s.byIndex[indexed.index-s.offset] != nil {
+		s.byIndex[indexed.index-s.offset] = &redactedIndexed
+	}
+}
+
+// Must be called with the write lock held
+func (s *messageStream) trackVisibility(event types.Event, index uint64) {
+	state, ok := event.(*types.State)
+	if !ok {
+		return
+	}
+	switch content := state.Content.(type) {
+	case *types.MembershipEventContent:
+		user, err := ct.ParseUserId(state.StateKey)
+		if err != nil {
+			log.Println("failed to parse user id state key:", state.StateKey)
+			return
+		}
+		key := roomMember{state.RoomId, user}
+		s.memberships[key] = append(s.memberships[key], membershipChange{index, content.Membership})
+	case *types.HistoryVisibilityEventContent:
+		change := visibilityChange{index, content.HistoryVisibility}
+		s.visibilities[state.RoomId] = append(s.visibilities[state.RoomId], change)
+	}
+}
+
+func (s *messageStream) EventVisible(user ct.UserId, room ct.RoomId, index uint64) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.eventVisible(user, room, index)
+}
+
+// Must be called with a lock held
+func (s *messageStream) eventVisible(user ct.UserId, room ct.RoomId, index uint64) bool {
+	visibility := types.HistoryVisibilityShared
+	for _, change := range s.visibilities[room] {
+		if change.index > index {
+			break
+		}
+		visibility = change.visibility
+	}
+	if visibility == types.HistoryVisibilityWorldReadable {
+		return true
+	}
+	changes := s.memberships[roomMember{room, user}]
+	membership := types.MembershipNone
+	joinedLater := false
+	for _, change := range changes {
+		if change.index == index {
+			// users can always see changes to their own membership
+			return true
+		}
+		if change.index < index {
+			membership = change.membership
+		} else if change.membership == types.MembershipMember {
+			joinedLater = true
+			break
+		}
+	}
+	switch {
+	case membership == types.MembershipMember:
+		return true
+	case visibility == types.HistoryVisibilityInvited:
+		return membership == types.MembershipInvited
+	case visibility == types.HistoryVisibilityShared:
+		return joinedLater
+	}
+	return false
+}
+
+func (s *messageStream) ReadableUntil(user ct.UserId, room ct.RoomId) (uint64, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	max := atomic.LoadUint64(&s.max)
+	visibilities := s.visibilities[room]
+	if len(visibilities) > 0 && visibilities[len(visibilities)-1].visibility == types.HistoryVisibilityWorldReadable {
+		return max, true
+	}
+	changes := s.memberships[roomMember{room, user}]
+	if len(changes) == 0 {
+		return 0, false
+	}
+	last := changes[len(changes)-1]
+	switch last.membership {
+	case types.MembershipMember, types.MembershipInvited:
+		return max, true
+	case types.MembershipLeaving, types.MembershipBanned:
+		for _, change := range changes {
+			if change.membership == types.MembershipMember || change.membership == types.MembershipInvited {
+				return last.index + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func extraUserForEvent(event types.Event) *ct.UserId {
 	if event.GetEventType() == types.EventTypeMembership {
 		membership := event.GetContent().(*types.MembershipEventContent).Membership
 		isInvited := membership == types.MembershipInvited
 		isKnocking := membership == types.MembershipKnocking
 		isBanned := membership == types.MembershipBanned
-		if isInvited || isKnocking || isBanned {
+		// the user has already been removed from the room when the leave event is sent
+		isLeaving := membership == types.MembershipLeaving
+		if isInvited || isKnocking || isBanned || isLeaving {
 			state, ok := event.(*types.State)
 			if !ok {
 				log.Println("membership event was not a state event:", event)
@@ -117,20 +289,17 @@ func (s *messageStream) Event(
 	eventId ct.EventId,
 ) (types.Event, types.Error) {
 	s.lock.RLock()
-	indexed := s.byId[ct.Id(eventId)]
+	indexed, ok := s.byId[ct.Id(eventId)]
 	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
 	extraUser := extraUserForEvent(indexed.event)
 	if extraUser != nil && *extraUser == user {
 		return indexed.event, nil
 	}
-	rooms, err := s.members.Rooms(user)
-	if err != nil {
-		return nil, err
-	}
-	for _, room := range rooms {
-		if room == *indexed.event.GetRoomId() {
-			return indexed.event, nil
-		}
+	if s.EventVisible(user, *indexed.event.GetRoomId(), indexed.index) {
+		return indexed.event, nil
 	}
 	return nil, nil
 }
@@ -164,7 +333,7 @@ func (s *messageStream) Range(
 	}
 	i := from
 	for uint(len(result)) < limit && i < max {
-		indexed := s.byIndex[i]
+		indexed := s.at(i)
 		if indexed != nil {
 			_, ok := roomSet[*indexed.Event().GetRoomId()]
 			if ok {
@@ -191,6 +360,262 @@ func (s *messageStream) Range(
 	return result, nil
 }
 
+func (s *messageStream) Relations(
+	user ct.UserId,
+	parent ct.EventId,
+	relType, eventType string,
+	from uint64,
+	limit uint,
+) ([]types.IndexedEvent, types.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]types.IndexedEvent, 0, limit)
+	parentEvent, ok := s.byId[ct.Id(parent)]
+	if !ok {
+		return result, nil
+	}
+	room := *parentEvent.event.GetRoomId()
+	children := s.relations[parent]
+	for i := len(children) - 1; i >= 0 && uint(len(result)) < limit; i -= 1 {
+		index := children[i]
+		if index >= from {
+			continue
+		}
+		indexed := s.at(index)
+		if indexed == nil || *indexed.event.GetRoomId() != room {
+			continue
+		}
+		relation, _ := types.ContentRelation(indexed.event.GetContent())
+		if relation == nil || (relType != "" && relation.RelType != relType) {
+			continue
+		}
+		if eventType != "" && indexed.event.GetEventType() != eventType {
+			continue
+		}
+		if s.eventVisible(user, room, index) {
+			result = append(result, indexed)
+		}
+	}
+	return result, nil
+}
+
+type annotationKey struct {
+	eventType string
+	key       string
+}
+
+type annotationSender struct {
+	annotationKey
+	sender ct.UserId
+}
+
+// Sorts annotations by descending count, sort.Stable keeps the ones with equal counts in the order they were first sent
+type annotationsByCount []types.AnnotationCount
+
+func (a annotationsByCount) Len() int           { return len(a) }
+func (a annotationsByCount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a annotationsByCount) Less(i, j int) bool { return a[i].Count > a[j].Count }
+
+// Sorts threads by their latest reply, newest first
+type threadsByActivity []types.IndexedEvent
+
+func (t threadsByActivity) Len() int           { return len(t) }
+func (t threadsByActivity) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t threadsByActivity) Less(i, j int) bool { return t[i].Index() > t[j].Index() }
+
+// The thread roots are indexed by the latest reply in the thread that is visible to the user, and
+// only threads where that reply is before from are returned, so that a thread is on a single page
+func (s *messageStream) Threads(
+	user ct.UserId,
+	room ct.RoomId,
+	from uint64,
+	limit uint,
+) ([]types.IndexedEvent, types.Error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	threads := threadsByActivity{}
+	for root := range s.threads[room] {
+		rootEvent, ok := s.byId[ct.Id(root)]
+		if !ok || !s.eventVisible(user, room, rootEvent.index) {
+			continue
+		}
+		children := s.relations[root]
+		for i := len(children) - 1; i >= 0; i -= 1 {
+			index := children[i]
+			indexed := s.at(index)
+			if indexed == nil || *indexed.event.GetRoomId() != room {
+				continue
+			}
+			relation, _ := types.ContentRelation(indexed.event.GetContent())
+			if relation != nil && relation.RelType == types.RelationThread && s.eventVisible(user, room, index) {
+				if index < from {
+					threads = append(threads, &indexedEvent{rootEvent.event, index})
+				}
+				break
+			}
+		}
+	}
+	sort.Sort(threads)
+	if uint(len(threads)) > limit {
+		threads = threads[:limit]
+	}
+	return threads, nil
+}
+
+// Each user is counted once per annotation, and only edits by the sender of the parent that keep the event type are used
+func (s *messageStream) Aggregations(user ct.UserId, parent types.Event) (*types.RelationsAggregation, types.Error) {
+	room := parent.GetRoomId()
+	sender := parent.GetUserId()
+	if room == nil || sender == nil {
+		return nil, nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	children := s.relations[ct.EventId(parent.GetEventKey())]
+	if len(children) == 0 {
+		return nil, nil
+	}
+	annotations := annotationsByCount{}
+	annotationIndices := map[annotationKey]int{}
+	annotationSenders := map[annotationSender]struct{}{}
+	var replace types.Event
+	var thread *types.ThreadAggregation
+	for _, index := range children {
+		indexed := s.at(index)
+		if indexed == nil || *indexed.event.GetRoomId() != *room {
+			continue
+		}
+		relation, _ := types.ContentRelation(indexed.event.GetContent())
+		if relation == nil || !s.eventVisible(user, *room, index) {
+			continue
+		}
+		event := indexed.event
+		switch relation.RelType {
+		case types.RelationAnnotation:
+			key := annotationKey{event.GetEventType(), relation.Key}
+			if _, ok := annotationSenders[annotationSender{key, *event.GetUserId()}]; ok {
+				continue
+			}
+			annotationSenders[annotationSender{key, *event.GetUserId()}] = struct{}{}
+			if i, ok := annotationIndices[key]; ok {
+				annotations[i].Count += 1
+			} else {
+				annotationIndices[key] = len(annotations)
+				annotations = append(annotations, types.AnnotationCount{
+					EventType: key.eventType,
+					Key:       key.key,
+					Count:     1,
+				})
+			}
+		case types.RelationReplace:
+			if *event.GetUserId() == *sender && event.GetEventType() == parent.GetEventType() {
+				replace = event
+			}
+		case types.RelationThread:
+			if thread == nil {
+				thread = &types.ThreadAggregation{CurrentUserParticipated: *sender == user}
+			}
+			thread.LatestEvent = event
+			thread.Count += 1
+			if *event.GetUserId() == user {
+				thread.CurrentUserParticipated = true
+			}
+		}
+	}
+	if len(annotations) == 0 && replace == nil && thread == nil {
+		return nil, nil
+	}
+	aggregation := &types.RelationsAggregation{Replace: replace, Thread: thread}
+	if len(annotations) > 0 {
+		sort.Stable(annotations)
+		aggregation.Annotation = &types.AnnotationAggregation{Chunk: annotations}
+	}
+	return aggregation, nil
+}
+
+func (s *messageStream) PurgeRoom(room ct.RoomId) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, indexed := range s.byIndex {
+		if indexed != nil && *indexed.event.GetRoomId() == room {
+			s.byIndex[i] = nil
+			delete(s.byId, indexed.event.GetEventKey())
+			delete(s.relations, ct.EventId(indexed.event.GetEventKey()))
+		}
+	}
+	delete(s.historyStart, room)
+	delete(s.visibilities, room)
+	delete(s.threads, room)
+	delete(s.versions, room)
+	for key := range s.memberships {
+		if key.room == room {
+			delete(s.memberships, key)
+		}
+	}
+	s.compact()
+	return nil
+}
+
+func (s *messageStream) PurgeRoomHistory(
+	room ct.RoomId,
+	before uint64,
+	keep map[ct.EventId]struct{},
+) types.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if before > s.max {
+		before = s.max
+	}
+	for i := s.offset; i < before; i += 1 {
+		indexed := s.byIndex[i-s.offset]
+		if indexed == nil || *indexed.event.GetRoomId() != room {
+			continue
+		}
+		if _, ok := keep[ct.EventId(indexed.event.GetEventKey())]; ok {
+			continue
+		}
+		s.byIndex[i-s.offset] = nil
+		delete(s.byId, indexed.event.GetEventKey())
+		delete(s.relations, ct.EventId(indexed.event.GetEventKey()))
+		delete(s.threads[room], ct.EventId(indexed.event.GetEventKey()))
+	}
+	if before > s.historyStart[room] {
+		s.historyStart[room] = before
+	}
+	s.compact()
+	return nil
+}
+
+func (s *messageStream) HistoryStart(room ct.RoomId) uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.historyStart[room]
+}
+
+// Must be called with the write lock held
+func (s *messageStream) compact() {
+	count := 0
+	for count < len(s.byIndex) && s.byIndex[count] == nil {
+		count += 1
+	}
+	if count == 0 {
+		return
+	}
+	// copy to let the purged part of the backing array be collected
+	byIndex := make([]*indexedEvent, len(s.byIndex)-count)
+	copy(byIndex, s.byIndex[count:])
+	s.byIndex = byIndex
+	s.offset += uint64(count)
+}
+
+// Must be called with a lock held
+func (s *messageStream) at(index uint64) *indexedEvent {
+	if index < s.offset {
+		return nil
+	}
+	return s.byIndex[index-s.offset]
+}
+
 func (s *messageStream) Max() uint64 {
 	return atomic.LoadUint64(&s.max)
 }
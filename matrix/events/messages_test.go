@@ -69,6 +69,54 @@ func TestMessageStream(t *testing.T) {
 	es.check(3, 7, 5, "user6", "user7")
 }
 
+func TestMessageStreamPurge(t *testing.T) {
+	memberCache, err := cd.NewIdMultiMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := stores.NewMembershipStore(memberCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamMux, err := ce.NewStreamMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_es, err := NewMessageStream(members, streamMux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := MessageStreamTest{_es, t}
+	room := ct.NewRoomId("room", "test")
+	es.push(message("event1", "user1"), 0)
+	es.push(message("event2", "user2"), 1)
+	es.push(message("event3", "user3"), 2)
+	es.push(message("event4", "user4"), 3)
+	es.push(message("event5", "user5"), 4)
+
+	keep := map[ct.EventId]struct{}{ct.NewEventId("event2", "test"): struct{}{}}
+	if err := es.PurgeRoomHistory(room, 3, keep); err != nil {
+		t.Fatal(err)
+	}
+	if start := es.HistoryStart(room); start != 3 {
+		t.Fatal("history start should be 3, was", start)
+	}
+	es.check(0, 5, 5, "user2", "user4", "user5")
+	es.check(5, 0, 5, "user5", "user4", "user2")
+	es.check(2, 5, 5, "user4", "user5")
+	if event, _ := es.Event(ct.NewUserId("user1", "test"), ct.NewEventId("event1", "test")); event != nil {
+		t.Fatal("purged event should not be found")
+	}
+
+	if err := es.PurgeRoomHistory(room, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+	es.check(0, 5, 5)
+	es.push(message("event6", "user6"), 5)
+	es.check(0, 6, 5, "user6")
+	es.check(6, 0, 5, "user6")
+}
+
 type MessageStreamTest struct {
 	interfaces.EventStream
 	t *testing.T
@@ -108,7 +156,7 @@ func (es MessageStreamTest) check(from, to uint64, limit uint, expect ...string)
 func message(eventId, userId string) *types.Message {
 	event := types.Message{}
 	event.EventType = "m.room.create"
-	event.Content = types.CreateEventContent{ct.NewUserId(userId, "test")}
+	event.Content = types.CreateEventContent{Creator: ct.NewUserId(userId, "test")}
 	event.RoomId = ct.NewRoomId("room", "test")
 	event.Timestamp = ct.Timestamp{time.Now()}
 	event.EventId = ct.NewEventId(eventId, "test")
@@ -16,6 +16,7 @@ package interfaces
 
 import (
 	"fmt"
+	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -28,11 +29,23 @@ type RoomService interface {
 		desc *types.RoomDescription,
 	) (ct.RoomId, *ct.Alias, types.Error)
 	RoomExists(room ct.RoomId, caller ct.UserId) types.Error
+	JoinedRooms(user, caller ct.UserId) ([]ct.RoomId, types.Error)
+	// Rooms that the user has been invited to or has knocked on
+	PendingRooms(user, caller ct.UserId) ([]ct.RoomId, types.Error)
 	LookupAlias(alias ct.Alias) (ct.RoomId, types.Error)
 	AddMessage(
 		room ct.RoomId,
 		caller ct.UserId,
 		content types.TypedContent,
+		txn *types.Transaction,
+	) (*types.Message, types.Error)
+	// Sends a redaction of the event, which strips its content down to what the redaction algorithm keeps
+	Redact(
+		room ct.RoomId,
+		caller ct.UserId,
+		eventId ct.EventId,
+		reason string,
+		txn *types.Transaction,
 	) (*types.Message, types.Error)
 	State(
 		room ct.RoomId,
@@ -45,11 +58,28 @@ type RoomService interface {
 		content types.TypedContent,
 		stateKey string,
 	) (*types.State, types.Error)
+	// Replaces the room with a new room of the given version with the same state, and returns the
+	// id of the new room. The default room version is used if the version is empty
+	UpgradeRoom(room ct.RoomId, caller ct.UserId, newVersion string) (ct.RoomId, types.Error)
+	// Rooms with the public join rule, largest rooms first
+	PublicRooms(caller ct.UserId) ([]types.PublicRoom, types.Error)
+	// Admin only
+	AdminState(room ct.RoomId, caller ct.UserId) ([]*types.State, types.Error)
+	AdminMembers(room ct.RoomId, caller ct.UserId) ([]ct.UserId, types.Error)
+	// Admin only, kicks all members and removes all aliases and events of the room, and then the room itself
+	PurgeRoom(room ct.RoomId, caller ct.UserId) types.Error
+	// Admin only, joins a room where no member is able to change the power levels,
+	// and gives the caller enough power level to do so
+	AdminJoin(room ct.RoomId, caller ct.UserId) (*types.State, types.Error)
+	// Hides a room that the caller has left from the caller's archived rooms and history,
+	// the room is purged once all former members have forgotten it
+	ForgetRoom(room ct.RoomId, caller ct.UserId) types.Error
 }
 
+// The session is the id of the access token the events are served to, see Token.SessionId
 type SyncService interface {
-	FullSync(user ct.UserId, limit uint) (*types.InitialSync, types.Error)
-	RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*types.RoomInitialSync, types.Error)
+	FullSync(user ct.UserId, session string, limit uint, archived bool) (*types.InitialSync, types.Error)
+	RoomSync(user ct.UserId, session string, room ct.RoomId, limit uint) (*types.RoomInitialSync, types.Error)
 }
 
 type UserService interface {
@@ -57,6 +87,18 @@ type UserService interface {
 	UserExists(user, caller ct.UserId) (bool, types.Error)
 	VerifyPassword(user ct.UserId, password string) (bool, types.Error)
 	SetPassword(user, caller ct.UserId, password string) types.Error
+	Deactivate(user, caller ct.UserId) types.Error
+	CreateGuest(ct.UserId) types.Error
+	CreateAdmin(ct.UserId) types.Error
+	IsGuest(user, caller ct.UserId) (bool, types.Error)
+	// Turns a guest into a full user with the given password
+	UpgradeGuest(user, caller ct.UserId, password string) types.Error
+	// Admin only
+	Users(caller ct.UserId) ([]ct.UserId, types.Error)
+	UserInfo(user, caller ct.UserId) (*types.UserInfo, types.Error)
+	IsAdmin(user, caller ct.UserId) (bool, types.Error)
+	// Admin only, admins can't demote themselves
+	SetAdmin(user, caller ct.UserId, admin bool) types.Error
 }
 
 type ProfileService interface {
@@ -79,40 +121,142 @@ type PresenceService interface {
 type TokenService interface {
 	NewAccessToken(ct.UserId) (Token, types.Error)
 	ParseAccessToken(token string) (Token, types.Error)
+	RevokeAccessToken(Token) types.Error
+	// Revokes all tokens of the user, except for the given token, which may be nil
+	RevokeAllAccessTokens(user ct.UserId, except Token) types.Error
+}
+
+type RegistrationService interface {
+	AuthTokenValidator
+	// Returns the flows that have to be completed to register, or an error if registration is disabled
+	Flows() ([]types.AuthFlow, types.Error)
+	ValidateLocalpart(localpart string) types.Error
+	AllowsGuests() bool
+	// Shared secret registration is available in all modes as long as a secret is configured
+	NewSharedSecretNonce() (string, types.Error)
+	// Consumes the nonce and checks the mac of a shared secret registration
+	VerifySharedSecret(nonce, localpart, password string, admin bool, mac string) types.Error
+	// Counts a completed registration with the token, fails if the token has been
+	// used up or has expired since it was validated
+	UseAuthToken(token string) types.Error
+	CreateToken(token types.RegistrationToken) (*types.RegistrationToken, types.Error)
+	Tokens() ([]types.RegistrationToken, types.Error)
+	DeleteToken(token string) types.Error
+}
+
+type RetentionService interface {
+	// Purges the history of all rooms according to the server and room retention policies
+	EnforceRetention(now time.Time) types.Error
+	// Admin only, purges all history of the room before the token, the current state is kept
+	PurgeHistory(room ct.RoomId, caller ct.UserId, before types.StreamToken) types.Error
+}
+
+type InteractiveAuthService interface {
+	// Returns nil once a flow has been completed for the session in the auth dict,
+	// otherwise an error listing the flows and the stages completed so far.
+	// Sessions are bound to the operation and user they were started with.
+	Authenticate(
+		operation string,
+		flows []types.AuthFlow,
+		user *ct.UserId,
+		auth *types.AuthDict,
+	) types.Error
+}
+
+type AuthStage interface {
+	Type() types.LoginType
+	// Parameters passed to the client for the stage, may be nil
+	Params() interface{}
+	// The user is nil if the request is not authenticated
+	Complete(user *ct.UserId, auth *types.AuthDict) types.Error
+}
+
+type AuthTokenValidator interface {
+	// Checks that the token can be used, without counting it as used
+	ValidateAuthToken(token string) types.Error
 }
 
 type Token interface {
 	fmt.Stringer
 	UserId() ct.UserId
+	// Whether the user was an admin when the token was parsed
+	IsAdmin() bool
+	// Identifies the token without revealing it, transaction ids are scoped to it
+	SessionId() string
 }
 
+// The session is the id of the access token the events are served to, see Token.SessionId
 type EventService interface {
-	Event(caller ct.UserId, eventId ct.EventId) (types.Event, types.Error)
+	Event(caller ct.UserId, session string, eventId ct.EventId) (types.Event, types.Error)
 	Range(
 		caller ct.UserId,
+		session string,
 		from, to *types.StreamToken,
 		limit uint,
 		cancel chan struct{},
 	) (*types.EventStreamRange, types.Error)
 	Messages(
 		user ct.UserId,
+		session string,
 		room ct.RoomId,
 		from, to *types.StreamToken,
 		limit uint,
+		filter *types.RoomEventFilter,
 	) (*types.EventStreamRange, types.Error)
+	// Returns a page of the events in the room that relate to the parent event, newest first
+	Relations(
+		user ct.UserId,
+		session string,
+		room ct.RoomId,
+		parent ct.EventId,
+		relType, eventType string,
+		from *types.StreamToken,
+		limit uint,
+	) (*types.RelationsChunk, types.Error)
+	// Returns a page of the threads in the room, the thread with the latest reply first
+	Threads(
+		user ct.UserId,
+		session string,
+		room ct.RoomId,
+		from *types.StreamToken,
+		limit uint,
+	) (*types.RelationsChunk, types.Error)
+}
+
+type GuestProvider interface {
+	UserIsGuest(ct.UserId) (bool, types.Error)
+}
+
+type AdminProvider interface {
+	UserIsAdmin(ct.UserId) (bool, types.Error)
 }
 
 type UserStore interface {
+	GuestProvider
+	AdminProvider
 	CreateUser(ct.UserId) (exists bool, err types.Error)
 	UserExists(ct.UserId) (exists bool, err types.Error)
 	SetUserPasswordHash(id ct.UserId, hash string) types.Error
 	UserPasswordHash(ct.UserId) (string, types.Error)
+	SetUserDeactivated(ct.UserId) types.Error
+	UserDeactivated(ct.UserId) (bool, types.Error)
+	SetUserGuest(id ct.UserId, guest bool) types.Error
+	SetUserAdmin(id ct.UserId, admin bool) types.Error
+	Users() ([]ct.UserId, types.Error)
+	AddUserToken(id ct.UserId, token string) types.Error
+	RemoveUserToken(id ct.UserId, token string) types.Error
+	UserTokenExists(id ct.UserId, token string) (bool, types.Error)
+	UserTokens(ct.UserId) ([]string, types.Error)
 }
 
 type RoomStore interface {
 	CreateRoom(id ct.RoomId) (exists bool, err types.Error)
 	RoomExists(ct.RoomId) (bool, types.Error)
-	SetRoomState(roomId ct.RoomId, userId ct.UserId, content types.TypedContent, stateKey string) (*types.State, types.Error)
+	RemoveRoom(ct.RoomId) (existed bool, err types.Error)
+	Rooms() ([]ct.RoomId, types.Error)
+	SetRoomState(roomId ct.RoomId, eventId ct.EventId, userId ct.UserId, content types.TypedContent, stateKey string) (*types.State, types.Error)
+	// Replaces the state with its redacted copy, unless the state has been replaced since
+	RedactRoomState(redacted *types.State) types.Error
 	RoomState(roomId ct.RoomId, eventType, stateKey string) (*types.State, types.Error)
 	EntireRoomState(roomId ct.RoomId) ([]*types.State, types.Error)
 }
@@ -124,12 +268,40 @@ type AliasStore interface {
 	Room(ct.Alias) (*ct.RoomId, types.Error)
 }
 
+type RegistrationTokenStore interface {
+	AddToken(types.RegistrationToken) (exists bool, err types.Error)
+	Token(token string) (*types.RegistrationToken, types.Error)
+	Tokens() ([]types.RegistrationToken, types.Error)
+	// Increments the completed count of the token if it is still valid at the given time
+	UseToken(token string, now time.Time) (used bool, err types.Error)
+	RemoveToken(token string) (existed bool, err types.Error)
+}
+
 type MembershipStore interface {
 	AddMember(ct.RoomId, ct.UserId) types.Error
 	RemoveMember(ct.RoomId, ct.UserId) types.Error
 	Rooms(ct.UserId) ([]ct.RoomId, types.Error)
 	Users(ct.RoomId) ([]ct.UserId, types.Error)
 	Peers(ct.UserId) (map[ct.UserId]struct{}, types.Error)
+	// Replaces any previous archived entry of the user for the room
+	ArchiveRoom(ct.UserId, types.ArchivedRoom) types.Error
+	UnarchiveRoom(ct.RoomId, ct.UserId) types.Error
+	ArchivedRooms(ct.UserId) ([]types.ArchivedRoom, types.Error)
+	// Users that have an archived entry for the room, i.e. former members that haven't forgotten it
+	ArchivedUsers(ct.RoomId) ([]ct.UserId, types.Error)
+	// Removes the archived entry of the user for the room and marks the room as forgotten
+	ForgetRoom(ct.RoomId, ct.UserId) types.Error
+	RememberRoom(ct.RoomId, ct.UserId) types.Error
+	RoomForgotten(ct.RoomId, ct.UserId) (bool, types.Error)
+	AddInvite(ct.RoomId, ct.UserId) types.Error
+	RemoveInvite(ct.RoomId, ct.UserId) types.Error
+	InvitedRooms(ct.UserId) ([]ct.RoomId, types.Error)
+	// Removes all archived entries, forgotten marks and invites of a room that is being removed
+	RemoveRoom(ct.RoomId) types.Error
+	// Positions of the current members and invited users of the room, increasing in the order in
+	// which they joined or were invited. Later membership events of the user don't change them.
+	JoinPositions(ct.RoomId) (map[ct.UserId]uint64, types.Error)
+	InvitePositions(ct.RoomId) (map[ct.UserId]uint64, types.Error)
 }
 
 type AsyncEventSink interface {
@@ -159,6 +331,18 @@ type EventProvider interface {
 	Event(ct.UserId, ct.EventId) (types.Event, types.Error)
 }
 
+type EventPurger interface {
+	// Removes all events in the room from the stream
+	PurgeRoom(ct.RoomId) types.Error
+	// Removes the events in the room with an index lower than before, except for the ones in keep
+	PurgeRoomHistory(room ct.RoomId, before uint64, keep map[ct.EventId]struct{}) types.Error
+}
+
+type HistoryProvider interface {
+	// Returns the index before which the history of the room has been purged
+	HistoryStart(ct.RoomId) uint64
+}
+
 type ProfileEventSink interface {
 	SetUserProfile(ct.UserId, types.UserProfile) (types.IndexedEvent, types.Error)
 }
@@ -183,9 +367,40 @@ type TypingProvider interface {
 	Typing(room ct.RoomId) ([]ct.UserId, types.Error)
 }
 
+type VisibilityProvider interface {
+	// Returns whether the user may see the event at the given index in the room, based on the
+	// history visibility of the room and the membership of the user when the event was sent
+	EventVisible(user ct.UserId, room ct.RoomId, index uint64) bool
+	// Returns the index up to which the user may read the room, which is the event after the user
+	// left or was banned, or false if the user is not allowed to read the room at all
+	ReadableUntil(user ct.UserId, room ct.RoomId) (end uint64, allowed bool)
+}
+
+type RelationProvider interface {
+	// Returns the events in the room of the parent that relate to the parent and are visible to the user,
+	// newest first, starting before the index from. Empty relation or event types match all events.
+	Relations(
+		user ct.UserId,
+		parent ct.EventId,
+		relType, eventType string,
+		from uint64,
+		limit uint,
+	) ([]types.IndexedEvent, types.Error)
+	// Summarizes the annotations, the latest edit and the thread of the event that are visible to the user,
+	// returns nil if there is nothing to aggregate
+	Aggregations(user ct.UserId, parent types.Event) (*types.RelationsAggregation, types.Error)
+	// Returns the roots of the threads in the room, ordered by their latest reply visible to the user,
+	// newest first, starting with threads with replies before the index from
+	Threads(user ct.UserId, room ct.RoomId, from uint64, limit uint) ([]types.IndexedEvent, types.Error)
+}
+
 type EventStream interface {
 	EventSink
 	EventProvider
+	EventPurger
+	HistoryProvider
+	VisibilityProvider
+	RelationProvider
 	IndexedEventSource
 }
 
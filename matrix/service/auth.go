@@ -0,0 +1,289 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const authSessionLifetime = 15 * time.Minute
+
+// Sessions are created by unauthenticated requests, so the number of sessions is limited
+const maxAuthSessions = 4096
+
+func NewInteractiveAuthService(
+	stages ...interfaces.AuthStage,
+) (interfaces.InteractiveAuthService, error) {
+	stageMap := map[types.LoginType]interfaces.AuthStage{}
+	for _, stage := range stages {
+		stageMap[stage.Type()] = stage
+	}
+	return &interactiveAuthService{
+		stages:   stageMap,
+		sessions: map[string]*authSession{},
+	}, nil
+}
+
+type interactiveAuthService struct {
+	lock     sync.Mutex
+	stages   map[types.LoginType]interfaces.AuthStage
+	sessions map[string]*authSession
+}
+
+type authSession struct {
+	operation string
+	user      *ct.UserId
+	completed []types.LoginType
+	created   time.Time
+}
+
+func (s *interactiveAuthService) Authenticate(
+	operation string,
+	flows []types.AuthFlow,
+	user *ct.UserId,
+	auth *types.AuthDict,
+) types.Error {
+	for _, flow := range flows {
+		for _, stage := range flow.Stages {
+			if s.stages[stage] == nil {
+				return types.ServerError("auth stage is not available: " + string(stage))
+			}
+		}
+	}
+	id, completed, err := s.session(operation, user, auth)
+	if err != nil {
+		return err
+	}
+	if auth == nil || auth.Type == "" {
+		return s.authRequired(id, completed, flows, nil)
+	}
+	if !isNextStage(flows, completed, auth.Type) {
+		err := types.BadJsonError("auth stage is not allowed: " + string(auth.Type))
+		return s.authRequired(id, completed, flows, err)
+	}
+	if err := s.stages[auth.Type].Complete(user, auth); err != nil {
+		return s.authRequired(id, completed, flows, err)
+	}
+	completed = append(completed, auth.Type)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if isFlowCompleted(flows, completed) {
+		delete(s.sessions, id)
+		return nil
+	}
+	if session := s.sessions[id]; session != nil {
+		session.completed = completed
+	}
+	return s.authRequired(id, completed, flows, nil)
+}
+
+// Looks up or creates the session, and returns a copy of the completed stages
+func (s *interactiveAuthService) session(
+	operation string,
+	user *ct.UserId,
+	auth *types.AuthDict,
+) (string, []types.LoginType, types.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if auth == nil || auth.Session == "" {
+		if len(s.sessions) >= maxAuthSessions {
+			s.removeExpiredSessions(now)
+		}
+		if len(s.sessions) >= maxAuthSessions {
+			return "", nil, types.LimitExceededError("too many auth sessions in progress")
+		}
+		id := utils.RandomString(24)
+		s.sessions[id] = &authSession{
+			operation: operation,
+			user:      user,
+			completed: []types.LoginType{},
+			created:   now,
+		}
+		return id, []types.LoginType{}, nil
+	}
+	session := s.sessions[auth.Session]
+	if session != nil && now.Sub(session.created) > authSessionLifetime {
+		delete(s.sessions, auth.Session)
+		session = nil
+	}
+	if session == nil || session.operation != operation || !sameUser(session.user, user) {
+		return "", nil, types.ForbiddenError("unknown or expired auth session: " + auth.Session)
+	}
+	completed := make([]types.LoginType, len(session.completed))
+	copy(completed, session.completed)
+	return auth.Session, completed, nil
+}
+
+// Must be called with the lock held
+func (s *interactiveAuthService) removeExpiredSessions(now time.Time) {
+	for id, session := range s.sessions {
+		if now.Sub(session.created) > authSessionLifetime {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *interactiveAuthService) authRequired(
+	id string,
+	completed []types.LoginType,
+	flows []types.AuthFlow,
+	cause types.Error,
+) types.Error {
+	params := map[string]interface{}{}
+	for _, flow := range flows {
+		for _, loginType := range flow.Stages {
+			if stageParams := s.stages[loginType].Params(); stageParams != nil {
+				params[string(loginType)] = stageParams
+			}
+		}
+	}
+	err := &types.AuthRequiredError{
+		Flows:     flows,
+		Completed: completed,
+		Session:   id,
+		Params:    params,
+	}
+	if cause != nil {
+		err.ErrorCode = cause.Code()
+		err.ErrorMessage = cause.Error()
+	}
+	return err
+}
+
+func sameUser(a, b *ct.UserId) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func isNextStage(flows []types.AuthFlow, completed []types.LoginType, next types.LoginType) bool {
+	for _, flow := range flows {
+		if len(flow.Stages) > len(completed) && hasStagePrefix(flow.Stages, completed) {
+			if flow.Stages[len(completed)] == next {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isFlowCompleted(flows []types.AuthFlow, completed []types.LoginType) bool {
+	for _, flow := range flows {
+		if len(flow.Stages) == len(completed) && hasStagePrefix(flow.Stages, completed) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasStagePrefix(stages, prefix []types.LoginType) bool {
+	for i, loginType := range prefix {
+		if stages[i] != loginType {
+			return false
+		}
+	}
+	return true
+}
+
+func NewPasswordAuthStage(users interfaces.UserService) interfaces.AuthStage {
+	return passwordAuthStage{users}
+}
+
+type passwordAuthStage struct {
+	users interfaces.UserService
+}
+
+func (s passwordAuthStage) Type() types.LoginType {
+	return types.LoginTypePassword
+}
+
+func (s passwordAuthStage) Params() interface{} {
+	return nil
+}
+
+func (s passwordAuthStage) Complete(user *ct.UserId, auth *types.AuthDict) types.Error {
+	if user == nil {
+		return types.ForbiddenError("password stage requires an authenticated user")
+	}
+	if auth.User != "" && auth.User != user.String() {
+		return types.ForbiddenError("auth user does not match the authenticated user")
+	}
+	if auth.Password == "" {
+		return types.BadJsonError("Missing or invalid password")
+	}
+	verified, err := s.users.VerifyPassword(*user, auth.Password)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return types.ForbiddenError("invalid credentials")
+	}
+	return nil
+}
+
+func NewDummyAuthStage() interfaces.AuthStage {
+	return dummyAuthStage{}
+}
+
+type dummyAuthStage struct{}
+
+func (s dummyAuthStage) Type() types.LoginType {
+	return types.LoginTypeDummy
+}
+
+func (s dummyAuthStage) Params() interface{} {
+	return nil
+}
+
+func (s dummyAuthStage) Complete(user *ct.UserId, auth *types.AuthDict) types.Error {
+	return nil
+}
+
+// A stage that is completed by presenting a token that is accepted by the validator
+func NewTokenAuthStage(
+	loginType types.LoginType,
+	validator interfaces.AuthTokenValidator,
+) interfaces.AuthStage {
+	return tokenAuthStage{loginType, validator}
+}
+
+type tokenAuthStage struct {
+	loginType types.LoginType
+	validator interfaces.AuthTokenValidator
+}
+
+func (s tokenAuthStage) Type() types.LoginType {
+	return s.loginType
+}
+
+func (s tokenAuthStage) Params() interface{} {
+	return nil
+}
+
+func (s tokenAuthStage) Complete(user *ct.UserId, auth *types.AuthDict) types.Error {
+	if auth.Token == "" {
+		return types.BadJsonError("Missing or invalid token")
+	}
+	return s.validator.ValidateAuthToken(auth.Token)
+}
@@ -16,6 +16,7 @@ package service
 
 import (
 	"log"
+	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
@@ -29,6 +30,9 @@ func NewEventService(
 	asyncEventSource interfaces.AsyncEventSource,
 	eventProvider interfaces.EventProvider,
 	membershipStore interfaces.MembershipStore,
+	historyProvider interfaces.HistoryProvider,
+	visibilityProvider interfaces.VisibilityProvider,
+	relationProvider interfaces.RelationProvider,
 ) (interfaces.EventService, error) {
 	return &eventService{
 		messageSource,
@@ -37,31 +41,133 @@ func NewEventService(
 		asyncEventSource,
 		eventProvider,
 		membershipStore,
+		historyProvider,
+		visibilityProvider,
+		relationProvider,
 	}, nil
 }
 
 type eventService struct {
-	messageSource    interfaces.IndexedEventSource
-	presenceSource   interfaces.IndexedEventSource
-	typingSource     interfaces.IndexedEventSource
-	asyncEventSource interfaces.AsyncEventSource
-	eventProvider    interfaces.EventProvider
-	membershipStore  interfaces.MembershipStore
+	messageSource      interfaces.IndexedEventSource
+	presenceSource     interfaces.IndexedEventSource
+	typingSource       interfaces.IndexedEventSource
+	asyncEventSource   interfaces.AsyncEventSource
+	eventProvider      interfaces.EventProvider
+	membershipStore    interfaces.MembershipStore
+	historyProvider    interfaces.HistoryProvider
+	visibilityProvider interfaces.VisibilityProvider
+	relationProvider   interfaces.RelationProvider
 }
 
-func (s eventService) Event(user ct.UserId, eventId ct.EventId) (types.Event, types.Error) {
+func (s eventService) Event(user ct.UserId, session string, eventId ct.EventId) (types.Event, types.Error) {
 	event, err := s.eventProvider.Event(user, eventId)
 	if err != nil {
 		return nil, err
 	}
 	if event == nil {
-		return nil, types.NotFoundError("event not found: " + event.GetEventKey().String())
+		return nil, types.NotFoundError("event not found: " + eventId.String())
 	}
-	return event, nil
+	if room := event.GetRoomId(); room != nil {
+		if err := testNotForgotten(s.membershipStore, user, *room); err != nil {
+			return nil, types.NotFoundError("event not found: " + eventId.String())
+		}
+	}
+	return newEventSerializer(s.relationProvider, user, session).event(event)
+}
+
+// Prepares events to be served to a user. The unsigned data is added to copies of the events,
+// so that the stored events are never modified
+type eventSerializer struct {
+	relationProvider interfaces.RelationProvider
+	user             ct.UserId
+	// the access token session of the user, which is the only one that sees its transaction ids
+	session string
+	// the time the events are served at, used to calculate their age
+	now time.Time
+}
+
+func newEventSerializer(relationProvider interfaces.RelationProvider, user ct.UserId, session string) eventSerializer {
+	return eventSerializer{relationProvider, user, session, time.Now()}
+}
+
+func (s eventSerializer) event(event types.Event) (types.Event, types.Error) {
+	var message *types.Message
+	var state *types.State
+	switch e := event.(type) {
+	case *types.Message:
+		message = e
+	case *types.State:
+		message = &e.Message
+		state = e
+	default:
+		return event, nil
+	}
+	unsigned := &types.Unsigned{
+		Age: int64(s.now.Sub(message.Timestamp.Time) / time.Millisecond),
+	}
+	if txn := message.Transaction; txn != nil && message.UserId == s.user && s.session != "" && txn.SessionId == s.session {
+		unsigned.TransactionId = txn.Id
+	}
+	if state != nil && state.OldState != nil {
+		prevSender := state.OldState.UserId
+		replacesState := state.OldState.EventId
+		unsigned.PrevContent = state.OldState.Content
+		unsigned.PrevSender = &prevSender
+		unsigned.ReplacesState = &replacesState
+	}
+	if message.RedactedBecause != nil {
+		redactedBecause, err := s.event(message.RedactedBecause)
+		if err != nil {
+			return nil, err
+		}
+		unsigned.RedactedBecause = redactedBecause
+	}
+	aggregation, err := s.relationProvider.Aggregations(s.user, event)
+	if err != nil {
+		return nil, err
+	}
+	unsigned.Relations = aggregation
+	return types.WithUnsigned(event, unsigned), nil
+}
+
+func (s eventSerializer) events(events []types.Event) ([]types.Event, types.Error) {
+	serialized := make([]types.Event, len(events))
+	for i, event := range events {
+		var err types.Error
+		if serialized[i], err = s.event(event); err != nil {
+			return nil, err
+		}
+	}
+	return serialized, nil
+}
+
+func (s eventSerializer) states(states []*types.State) ([]*types.State, types.Error) {
+	serialized := make([]*types.State, len(states))
+	for i, state := range states {
+		event, err := s.event(state)
+		if err != nil {
+			return nil, err
+		}
+		serialized[i] = event.(*types.State)
+	}
+	return serialized, nil
+}
+
+// Forgotten rooms are no longer readable by the user, until the user joins the room again
+func testNotForgotten(membershipStore interfaces.MembershipStore, user ct.UserId, room ct.RoomId) types.Error {
+	forgotten, err := membershipStore.RoomForgotten(room, user)
+	if err != nil {
+		return err
+	}
+	if forgotten {
+		return types.ForbiddenError("room " + room.String() + " has been forgotten by " + user.String())
+	}
+	return nil
 }
 
 func (s eventService) Range(
 	user ct.UserId,
+	session string,
 	from, to *types.StreamToken,
 	limit uint,
 	cancel chan struct{},
@@ -126,8 +232,12 @@ func (s eventService) Range(
 	if err != nil {
 		return nil, err
 	}
+	var historyStart uint64
 	for _, room := range rooms {
 		roomSet[room] = struct{}{}
+		if roomStart := s.historyProvider.HistoryStart(room); roomStart > historyStart {
+			historyStart = roomStart
+		}
 	}
 
 	messages, err := s.messageSource.Range(&user, userSet, roomSet, fromMessage, toMessage, limit)
@@ -220,8 +330,16 @@ func (s eventService) Range(
 		}
 	}
 	log.Printf("got events from %d to %d: %#v", fromMessage, messageIndex, events)
+	events, err = newEventSerializer(s.relationProvider, user, session).events(events)
+	if err != nil {
+		return nil, err
+	}
 
 	chunk = types.NewEventStreamRange(events, start, end)
+	if fromMessage < historyStart {
+		historyToken := types.NewStreamToken(historyStart, fromPresence, fromTyping)
+		chunk.HistoryStart = &historyToken
+	}
 
 	return chunk, nil
 
@@ -252,13 +370,63 @@ func (s eventService) Range(
 	//	}
 }
 
+// Reads events of the room from the source until limit events that are visible to the user and
+// pass the filter have been found
+func visibleRange(
+	source interfaces.IndexedEventSource,
+	visibility interfaces.VisibilityProvider,
+	user ct.UserId,
+	room ct.RoomId,
+	from, to uint64,
+	limit uint,
+	filter *types.RoomEventFilter,
+) ([]types.IndexedEvent, types.Error) {
+	roomSet := map[ct.RoomId]struct{}{
+		room: struct{}{},
+	}
+	reverse := to < from
+	result := make([]types.IndexedEvent, 0, limit)
+	for uint(len(result)) < limit {
+		events, err := source.Range(nil, nil, roomSet, from, to, limit-uint(len(result)))
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if filter.Matches(event.Event()) && visibility.EventVisible(user, room, event.Index()) {
+				result = append(result, event)
+			}
+		}
+		last := events[len(events)-1].Index()
+		if reverse {
+			if last <= to {
+				break
+			}
+			from = last
+		} else {
+			from = last + 1
+		}
+	}
+	return result, nil
+}
+
 func (s eventService) Messages(
 	user ct.UserId,
+	session string,
 	room ct.RoomId,
 	from, to *types.StreamToken,
 	limit uint,
+	filter *types.RoomEventFilter,
 ) (eventRange *types.EventStreamRange, err types.Error) {
-	maxMessage := s.messageSource.Max()
+	if err := testNotForgotten(s.membershipStore, user, room); err != nil {
+		return nil, err
+	}
+	maxMessage, allowed := s.visibilityProvider.ReadableUntil(user, room)
+	if !allowed {
+		return nil, types.ForbiddenError("not allowed to read the messages of room " + room.String())
+	}
 
 	var fromMessage uint64
 	var presenceIndex uint64
@@ -281,16 +449,31 @@ func (s eventService) Messages(
 
 	if to != nil {
 		toMessage = to.MessageIndex
+		if toMessage > maxMessage {
+			toMessage = maxMessage
+		}
 	} else {
 		toMessage = maxMessage
 	}
 	log.Println("to message", toMessage, to)
 
-	roomSet := map[ct.RoomId]struct{}{
-		room: struct{}{},
+	historyStart := s.historyProvider.HistoryStart(room)
+	// never read past the start of the history, and make sure the direction stays the same
+	if toMessage < fromMessage {
+		if toMessage < historyStart {
+			toMessage = historyStart
+			if toMessage > fromMessage {
+				toMessage = fromMessage
+			}
+		}
+	} else if fromMessage < historyStart {
+		fromMessage = historyStart
+		if fromMessage > toMessage {
+			fromMessage = toMessage
+		}
 	}
 
-	messages, err := s.messageSource.Range(nil, nil, roomSet, fromMessage, toMessage, limit)
+	messages, err := visibleRange(s.messageSource, s.visibilityProvider, user, room, fromMessage, toMessage, limit, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -318,8 +501,89 @@ func (s eventService) Messages(
 		events[i] = messages[i].Event()
 	}
 	log.Printf("got messages from %d to %d: %#v", messagesStart, messagesEnd, events)
+	events, err = newEventSerializer(s.relationProvider, user, session).events(events)
+	if err != nil {
+		return nil, err
+	}
 
 	eventRange = types.NewEventStreamRange(events, start, end)
+	if historyStart > 0 {
+		historyToken := types.NewStreamToken(historyStart, presenceIndex, typingIndex)
+		eventRange.HistoryStart = &historyToken
+	}
 
 	return eventRange, nil
 }
+
+func (s eventService) Relations(
+	user ct.UserId,
+	session string,
+	room ct.RoomId,
+	parent ct.EventId,
+	relType, eventType string,
+	from *types.StreamToken,
+	limit uint,
+) (*types.RelationsChunk, types.Error) {
+	if err := testNotForgotten(s.membershipStore, user, room); err != nil {
+		return nil, err
+	}
+	event, err := s.eventProvider.Event(user, parent)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil || event.GetRoomId() == nil || *event.GetRoomId() != room {
+		return nil, types.NotFoundError("event not found: " + parent.String())
+	}
+	fromMessage := s.messageSource.Max()
+	if from != nil && from.MessageIndex < fromMessage {
+		fromMessage = from.MessageIndex
+	}
+	related, err := s.relationProvider.Relations(user, parent, relType, eventType, fromMessage, limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := newEventSerializer(s.relationProvider, user, session).events(indexedToEvents(related))
+	if err != nil {
+		return nil, err
+	}
+	chunk := &types.RelationsChunk{Events: events}
+	if len(related) > 0 && uint(len(related)) == limit {
+		next := types.NewStreamToken(related[len(related)-1].Index(), s.presenceSource.Max(), s.typingSource.Max())
+		chunk.NextBatch = &next
+	}
+	return chunk, nil
+}
+
+func (s eventService) Threads(
+	user ct.UserId,
+	session string,
+	room ct.RoomId,
+	from *types.StreamToken,
+	limit uint,
+) (*types.RelationsChunk, types.Error) {
+	if err := testNotForgotten(s.membershipStore, user, room); err != nil {
+		return nil, err
+	}
+	maxMessage, allowed := s.visibilityProvider.ReadableUntil(user, room)
+	if !allowed {
+		return nil, types.ForbiddenError("not allowed to read the threads of room " + room.String())
+	}
+	fromMessage := maxMessage
+	if from != nil && from.MessageIndex < fromMessage {
+		fromMessage = from.MessageIndex
+	}
+	roots, err := s.relationProvider.Threads(user, room, fromMessage, limit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := newEventSerializer(s.relationProvider, user, session).events(indexedToEvents(roots))
+	if err != nil {
+		return nil, err
+	}
+	chunk := &types.RelationsChunk{Events: events}
+	if len(roots) > 0 && uint(len(roots)) == limit {
+		next := types.NewStreamToken(roots[len(roots)-1].Index(), s.presenceSource.Max(), s.typingSource.Max())
+		chunk.NextBatch = &next
+	}
+	return chunk, nil
+}
@@ -84,7 +84,12 @@ func (s profileService) UpdateProfile(
 		}
 		content := *membership.Content.(*types.MembershipEventContent)
 		content.UserProfile = &profile
-		state, err := s.rooms.SetRoomState(room, user, &content, user.String()) //TODO: fix race, CAS?
+		version, err := roomVersion(s.rooms, room)
+		if err != nil {
+			log.Println("failed to get room version when updating profile: " + err.Error())
+			continue
+		}
+		state, err := s.rooms.SetRoomState(room, version.NewEventId(user), user, &content, user.String()) //TODO: fix race, CAS?
 		if err != nil {
 			log.Println("failed to set membership when updating profile: " + err.Error())
 			continue
@@ -0,0 +1,222 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const sharedSecretNonceLifetime = 5 * time.Minute
+const maxRegistrationTokenLength = 64
+
+func NewRegistrationService(
+	config types.RegistrationConfig,
+	tokens interfaces.RegistrationTokenStore,
+) (interfaces.RegistrationService, error) {
+	if config.Mode == types.RegistrationModeSharedSecret && config.SharedSecret == "" {
+		return nil, errors.New("shared secret registration mode requires a shared secret")
+	}
+	if config.MinLocalpartLength < 1 || config.MaxLocalpartLength < config.MinLocalpartLength {
+		return nil, fmt.Errorf("invalid localpart length limits [%d, %d]", config.MinLocalpartLength, config.MaxLocalpartLength)
+	}
+	return &registrationService{
+		config: config,
+		tokens: tokens,
+		nonces: map[string]time.Time{},
+	}, nil
+}
+
+type registrationService struct {
+	config    types.RegistrationConfig
+	tokens    interfaces.RegistrationTokenStore
+	nonceLock sync.Mutex
+	nonces    map[string]time.Time
+}
+
+func (s *registrationService) Flows() ([]types.AuthFlow, types.Error) {
+	switch s.config.Mode {
+	case types.RegistrationModeOpen:
+		return []types.AuthFlow{
+			{Stages: []types.LoginType{types.LoginTypeDummy}},
+		}, nil
+	case types.RegistrationModeToken:
+		return []types.AuthFlow{
+			{Stages: []types.LoginType{types.LoginTypeRegistrationToken}},
+		}, nil
+	case types.RegistrationModeSharedSecret:
+		return nil, types.ForbiddenError("registration requires a shared secret")
+	}
+	return nil, types.ForbiddenError("registration is disabled")
+}
+
+func (s *registrationService) AllowsGuests() bool {
+	return s.config.AllowGuests
+}
+
+func isLocalpartChar(char rune) bool {
+	switch {
+	case 'a' <= char && char <= 'z':
+		return true
+	case '0' <= char && char <= '9':
+		return true
+	}
+	return strings.ContainsRune("._=-/", char)
+}
+
+func (s *registrationService) ValidateLocalpart(localpart string) types.Error {
+	if len(localpart) < s.config.MinLocalpartLength {
+		msg := fmt.Sprintf("username must be at least %d characters", s.config.MinLocalpartLength)
+		return types.InvalidUsernameError(msg)
+	}
+	if len(localpart) > s.config.MaxLocalpartLength {
+		msg := fmt.Sprintf("username must be at most %d characters", s.config.MaxLocalpartLength)
+		return types.InvalidUsernameError(msg)
+	}
+	for _, char := range localpart {
+		if !isLocalpartChar(char) {
+			msg := fmt.Sprintf("username contains invalid character '%c'", char)
+			return types.InvalidUsernameError(msg)
+		}
+	}
+	for _, reserved := range s.config.ReservedLocalparts {
+		if localpart == reserved {
+			return types.InvalidUsernameError("username '" + localpart + "' is reserved")
+		}
+	}
+	for _, prefix := range s.config.ReservedPrefixes {
+		if strings.HasPrefix(localpart, prefix) {
+			return types.InvalidUsernameError("usernames starting with '" + prefix + "' are reserved")
+		}
+	}
+	return nil
+}
+
+func (s *registrationService) NewSharedSecretNonce() (string, types.Error) {
+	if s.config.SharedSecret == "" {
+		return "", types.ForbiddenError("shared secret registration is disabled")
+	}
+	nonce := utils.RandomString(32)
+	s.nonceLock.Lock()
+	defer s.nonceLock.Unlock()
+	s.expireNonces(time.Now())
+	s.nonces[nonce] = time.Now()
+	return nonce, nil
+}
+
+func (s *registrationService) expireNonces(now time.Time) {
+	for nonce, created := range s.nonces {
+		if now.Sub(created) > sharedSecretNonceLifetime {
+			delete(s.nonces, nonce)
+		}
+	}
+}
+
+func (s *registrationService) VerifySharedSecret(nonce, localpart, password string, admin bool, mac string) types.Error {
+	if s.config.SharedSecret == "" {
+		return types.ForbiddenError("shared secret registration is disabled")
+	}
+	s.nonceLock.Lock()
+	s.expireNonces(time.Now())
+	_, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	s.nonceLock.Unlock()
+	if !ok {
+		return types.ForbiddenError("unknown or expired nonce")
+	}
+	expected := hmac.New(sha256.New, []byte(s.config.SharedSecret))
+	adminStr := "notadmin"
+	if admin {
+		adminStr = "admin"
+	}
+	expected.Write([]byte(nonce + "\x00" + localpart + "\x00" + password + "\x00" + adminStr))
+	actual, err := hex.DecodeString(mac)
+	if err != nil || !hmac.Equal(actual, expected.Sum(nil)) {
+		return types.ForbiddenError("invalid mac")
+	}
+	return nil
+}
+
+func (s *registrationService) ValidateAuthToken(token string) types.Error {
+	existing, err := s.tokens.Token(token)
+	if err != nil {
+		return err
+	}
+	if existing == nil || !existing.Valid(time.Now()) {
+		return types.ForbiddenError("invalid or expired registration token")
+	}
+	return nil
+}
+
+func (s *registrationService) UseAuthToken(token string) types.Error {
+	used, err := s.tokens.UseToken(token, time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return types.ForbiddenError("invalid or expired registration token")
+	}
+	return nil
+}
+
+func (s *registrationService) CreateToken(token types.RegistrationToken) (*types.RegistrationToken, types.Error) {
+	if token.Token == "" {
+		token.Token = utils.RandomString(16)
+	}
+	if len(token.Token) > maxRegistrationTokenLength {
+		msg := fmt.Sprintf("registration token must be at most %d characters", maxRegistrationTokenLength)
+		return nil, types.BadJsonError(msg)
+	}
+	for _, char := range token.Token {
+		isAlphaNum := ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || ('0' <= char && char <= '9')
+		if !isAlphaNum && !strings.ContainsRune("._~-", char) {
+			return nil, types.BadJsonError(fmt.Sprintf("registration token contains invalid character '%c'", char))
+		}
+	}
+	token.Completed = 0
+	exists, err := s.tokens.AddToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, types.BadJsonError("registration token '" + token.Token + "' already exists")
+	}
+	return &token, nil
+}
+
+func (s *registrationService) Tokens() ([]types.RegistrationToken, types.Error) {
+	return s.tokens.Tokens()
+}
+
+func (s *registrationService) DeleteToken(token string) types.Error {
+	existed, err := s.tokens.RemoveToken(token)
+	if err != nil {
+		return err
+	}
+	if !existed {
+		return types.NotFoundError("registration token '" + token + "' doesn't exist")
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+const retentionPageSize = 256
+
+func NewRetentionService(
+	policy types.RetentionPolicy,
+	rooms interfaces.RoomStore,
+	eventSource interfaces.IndexedEventSource,
+	eventPurger interfaces.EventPurger,
+	historyProvider interfaces.HistoryProvider,
+	adminProvider interfaces.AdminProvider,
+) (interfaces.RetentionService, error) {
+	return retentionService{
+		policy,
+		rooms,
+		eventSource,
+		eventPurger,
+		historyProvider,
+		adminProvider,
+	}, nil
+}
+
+type retentionService struct {
+	policy          types.RetentionPolicy
+	rooms           interfaces.RoomStore
+	eventSource     interfaces.IndexedEventSource
+	eventPurger     interfaces.EventPurger
+	historyProvider interfaces.HistoryProvider
+	adminProvider   interfaces.AdminProvider
+}
+
+func (s retentionService) EnforceRetention(now time.Time) types.Error {
+	rooms, err := s.rooms.Rooms()
+	if err != nil {
+		return err
+	}
+	policies := map[ct.RoomId]types.RetentionPolicy{}
+	for _, room := range rooms {
+		policy, err := s.roomPolicy(room)
+		if err != nil {
+			log.Printf("failed to enforce retention policy in %s: %s", room, err)
+			continue
+		}
+		if !policy.Unlimited() {
+			policies[room] = policy
+		}
+	}
+	boundaries, err := s.retentionBoundaries(policies, now)
+	if err != nil {
+		return err
+	}
+	for room, boundary := range boundaries {
+		if boundary <= s.historyProvider.HistoryStart(room) {
+			continue
+		}
+		if err := s.purge(room, boundary); err != nil {
+			log.Printf("failed to enforce retention policy in %s: %s", room, err)
+		}
+	}
+	return nil
+}
+
+func (s retentionService) PurgeHistory(room ct.RoomId, caller ct.UserId, before types.StreamToken) types.Error {
+	admin, err := s.adminProvider.UserIsAdmin(caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return types.ForbiddenError("only admins are allowed to do that")
+	}
+	exists, err := s.rooms.RoomExists(room)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return types.NotFoundError("room '" + room.String() + "' doesn't exist")
+	}
+	return s.purge(room, before.MessageIndex)
+}
+
+func (s retentionService) roomPolicy(room ct.RoomId) (types.RetentionPolicy, types.Error) {
+	state, err := s.rooms.RoomState(room, types.EventTypeRetention, "")
+	if err != nil {
+		return types.RetentionPolicy{}, err
+	}
+	if state == nil {
+		return s.policy, nil
+	}
+	content, ok := state.Content.(*types.RetentionEventContent)
+	if !ok {
+		return types.RetentionPolicy{}, types.ServerError("invalid retention content, was " + reflect.TypeOf(state.Content).String())
+	}
+	return s.policy.WithRoomPolicy(content), nil
+}
+
+// Returns the index before which the events in each room fall outside of its policy.
+// The boundaries of all rooms are found in a single pass backwards through the stream,
+// which ends once every room has either reached its boundary or the start of its history.
+func (s retentionService) retentionBoundaries(
+	policies map[ct.RoomId]types.RetentionPolicy,
+	now time.Time,
+) (map[ct.RoomId]uint64, types.Error) {
+	boundaries := map[ct.RoomId]uint64{}
+	counts := map[ct.RoomId]uint{}
+	pending := make(map[ct.RoomId]struct{}, len(policies))
+	for room := range policies {
+		pending[room] = struct{}{}
+	}
+	from := s.eventSource.Max()
+	for from > 0 {
+		to := from
+		for room := range pending {
+			start := s.historyProvider.HistoryStart(room)
+			if start >= from {
+				delete(pending, room)
+			} else if start < to {
+				to = start
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		events, err := s.eventSource.Range(nil, nil, pending, from, to, retentionPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, indexed := range events {
+			room := *indexed.Event().GetRoomId()
+			if _, ok := pending[room]; !ok {
+				continue
+			}
+			policy := policies[room]
+			counts[room] += 1
+			tooMany := policy.MaxCount > 0 && counts[room] > policy.MaxCount
+			tooOld := policy.MaxAge > 0 && eventTimestamp(indexed.Event()).Before(now.Add(-policy.MaxAge))
+			if tooMany || tooOld {
+				boundaries[room] = indexed.Index() + 1
+				delete(pending, room)
+			}
+		}
+		from = events[len(events)-1].Index()
+	}
+	return boundaries, nil
+}
+
+func (s retentionService) purge(room ct.RoomId, before uint64) types.Error {
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return err
+	}
+	keep := make(map[ct.EventId]struct{}, len(states))
+	for _, state := range states {
+		keep[state.EventId] = struct{}{}
+	}
+	return s.eventPurger.PurgeRoomHistory(room, before, keep)
+}
+
+func eventTimestamp(event types.Event) time.Time {
+	switch event := event.(type) {
+	case *types.Message:
+		return event.Timestamp.Time
+	case *types.State:
+		return event.Timestamp.Time
+	}
+	return time.Time{}
+}
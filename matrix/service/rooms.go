@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
 	"time"
 
 	ct "github.com/matrix-org/bullettime/core/types"
@@ -34,6 +35,10 @@ func CreateRoomService(
 	profileProvider interfaces.ProfileProvider,
 	typingSink interfaces.TypingEventSink,
 	typingProvider interfaces.TypingProvider,
+	guestProvider interfaces.GuestProvider,
+	adminProvider interfaces.AdminProvider,
+	eventPurger interfaces.EventPurger,
+	eventProvider interfaces.EventProvider,
 ) (interfaces.RoomService, error) {
 	return roomService{
 		roomStore,
@@ -43,6 +48,10 @@ func CreateRoomService(
 		profileProvider,
 		typingSink,
 		typingProvider,
+		guestProvider,
+		adminProvider,
+		eventPurger,
+		eventProvider,
 	}, nil
 }
 
@@ -54,6 +63,10 @@ type roomService struct {
 	profileProvider interfaces.ProfileProvider
 	typingSink      interfaces.TypingEventSink
 	typingProvider  interfaces.TypingProvider
+	guestProvider   interfaces.GuestProvider
+	adminProvider   interfaces.AdminProvider
+	eventPurger     interfaces.EventPurger
+	eventProvider   interfaces.EventProvider
 }
 
 func (s roomService) RoomExists(id ct.RoomId, caller ct.UserId) types.Error {
@@ -67,6 +80,40 @@ func (s roomService) RoomExists(id ct.RoomId, caller ct.UserId) types.Error {
 	return nil
 }
 
+func (s roomService) JoinedRooms(user, caller ct.UserId) ([]ct.RoomId, types.Error) {
+	if user != caller {
+		return nil, types.ForbiddenError("can't list the rooms of other users")
+	}
+	rooms, err := s.members.Rooms(user)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ct.RoomId, len(rooms))
+	copy(result, rooms)
+	return result, nil
+}
+
+func (s roomService) PendingRooms(user, caller ct.UserId) ([]ct.RoomId, types.Error) {
+	if user != caller {
+		return nil, types.ForbiddenError("can't list the rooms of other users")
+	}
+	rooms, err := s.rooms.Rooms()
+	if err != nil {
+		return nil, err
+	}
+	result := []ct.RoomId{}
+	for _, room := range rooms {
+		membership, err := s.userMembership(room, user)
+		if err != nil {
+			return nil, err
+		}
+		if membership == types.MembershipInvited || membership == types.MembershipKnocking {
+			result = append(result, room)
+		}
+	}
+	return result, nil
+}
+
 func (s roomService) LookupAlias(alias ct.Alias) (ct.RoomId, types.Error) {
 	room, err := s.aliases.Room(alias)
 	if err != nil {
@@ -78,103 +125,281 @@ func (s roomService) LookupAlias(alias ct.Alias) (ct.RoomId, types.Error) {
 	return *room, nil
 }
 
+// State that the presets set up when a room is created
+var presetStates = map[types.RoomPreset][]types.TypedContent{
+	types.RoomPresetPrivateChat: {
+		&types.JoinRulesEventContent{JoinRule: types.JoinRuleInvite},
+		&types.HistoryVisibilityEventContent{HistoryVisibility: types.HistoryVisibilityShared},
+		&types.GuestAccessEventContent{GuestAccess: types.GuestAccessCanJoin},
+	},
+	types.RoomPresetTrustedPrivateChat: {
+		&types.JoinRulesEventContent{JoinRule: types.JoinRuleInvite},
+		&types.HistoryVisibilityEventContent{HistoryVisibility: types.HistoryVisibilityShared},
+		&types.GuestAccessEventContent{GuestAccess: types.GuestAccessCanJoin},
+	},
+	types.RoomPresetPublicChat: {
+		&types.JoinRulesEventContent{JoinRule: types.JoinRulePublic},
+		&types.HistoryVisibilityEventContent{HistoryVisibility: types.HistoryVisibilityShared},
+		&types.GuestAccessEventContent{GuestAccess: types.GuestAccessForbidden},
+	},
+}
+
+// State that can't be part of the initial state, since it is set up from other parts of the room description
+var disallowedInitialStateTypes = map[string]struct{}{
+	types.EventTypeCreate:      struct{}{},
+	types.EventTypeMembership:  struct{}{},
+	types.EventTypePowerLevels: struct{}{},
+	types.EventTypeAliases:     struct{}{},
+}
+
 func (s roomService) CreateRoom(
 	domain string,
 	creator ct.UserId,
 	desc *types.RoomDescription,
 ) (ct.RoomId, *ct.Alias, types.Error) {
+	isGuest, err := s.guestProvider.UserIsGuest(creator)
+	if err != nil {
+		return ct.RoomId{}, nil, err
+	}
+	if isGuest {
+		return ct.RoomId{}, nil, types.ForbiddenError("guests cannot create rooms")
+	}
+	preset := desc.Preset
+	if preset == types.RoomPresetNone {
+		preset = desc.Visibility.ToPreset()
+	}
+	for _, initialState := range desc.InitialState {
+		if _, ok := disallowedInitialStateTypes[initialState.EventType]; ok {
+			return ct.RoomId{}, nil, types.BadJsonError("cannot set " + initialState.EventType + " in initial state")
+		}
+		if initialState.Content == nil || initialState.Content.GetEventType() != initialState.EventType {
+			return ct.RoomId{}, nil, types.BadJsonError("invalid content of initial state " + initialState.EventType)
+		}
+	}
+	createContent := types.CreateEventContent{}
+	if desc.CreationContent != nil {
+		createContent = *desc.CreationContent
+	}
+	createContent.Creator = creator
+	createContent.RoomVersion = types.DefaultRoomVersion
+	if desc.RoomVersion != "" {
+		createContent.RoomVersion = desc.RoomVersion
+	}
+	powerLevels := types.DefaultPowerLevels(creator)
+	if preset == types.RoomPresetTrustedPrivateChat {
+		for _, invited := range desc.Invited {
+			powerLevels.Users[invited.String()] = powerLevels.Users[creator.String()]
+		}
+	}
+	if len(desc.PowerLevelContentOverride) > 0 {
+		if err := powerLevels.Override(desc.PowerLevelContentOverride); err != nil {
+			return ct.RoomId{}, nil, types.BadJsonError("invalid power level content override: " + err.Error())
+		}
+	}
+
+	profile, err := s.profileProvider.Profile(creator)
+	if err != nil {
+		return ct.RoomId{}, nil, err
+	}
+
 	var alias *ct.Alias
 	id := ct.NewRoomId(utils.RandomString(16), domain)
 	if desc.Alias != nil {
 		a := ct.NewAlias(*desc.Alias, domain)
-		err := s.aliases.AddAlias(a, id)
-		if err != nil {
-			return ct.RoomId{}, nil, err
-		}
 		alias = &a
 	}
-	exists, err := s.rooms.CreateRoom(id)
-	if exists {
-		return ct.RoomId{}, nil, types.RoomInUseError("room '" + id.String() + "' already exists")
+
+	// all of the initial state is built before anything is created
+	membership := &types.MembershipEventContent{UserProfile: &profile, Membership: types.MembershipMember}
+	initialState := []types.InitialState{
+		{EventType: types.EventTypeCreate, Content: &createContent},
+		{EventType: types.EventTypeMembership, StateKey: creator.String(), Content: membership},
+		{EventType: types.EventTypePowerLevels, Content: powerLevels},
 	}
-	if err != nil {
-		return ct.RoomId{}, nil, err
+	if alias != nil {
+		aliases := &types.AliasesEventContent{[]ct.Alias{*alias}}
+		initialState = append(initialState, types.InitialState{EventType: types.EventTypeAliases, Content: aliases})
+	}
+	for _, content := range presetStates[preset] {
+		initialState = append(initialState, types.InitialState{EventType: content.GetEventType(), Content: content})
+	}
+	// the state requested by the creator is checked like any other state change
+	requestedState := append([]types.InitialState{}, desc.InitialState...)
+	if desc.Name != nil {
+		name := &types.NameEventContent{*desc.Name}
+		requestedState = append(requestedState, types.InitialState{EventType: types.EventTypeName, Content: name})
+	}
+	if desc.Topic != nil {
+		topic := &types.TopicEventContent{*desc.Topic}
+		requestedState = append(requestedState, types.InitialState{EventType: types.EventTypeTopic, Content: topic})
 	}
-	s.members.AddMember(id, creator)
 
-	_, err = s.sendMessage(id, creator, &types.CreateEventContent{creator})
-	if err != nil {
+	if err := s.commitRoom(id, creator, alias, initialState, requestedState, desc.Invited, desc.IsDirect); err != nil {
 		return ct.RoomId{}, nil, err
 	}
-	_, err = s.setState(id, creator, &types.CreateEventContent{creator}, "")
-	if err != nil {
-		return ct.RoomId{}, nil, err
+	return id, alias, nil
+}
+
+// Creates the room and initializes it, or removes everything that was added if anything fails.
+// The requested state is set after the initial state, once it has passed the checks of SetState
+func (s roomService) commitRoom(
+	room ct.RoomId,
+	creator ct.UserId,
+	alias *ct.Alias,
+	initialState []types.InitialState,
+	requestedState []types.InitialState,
+	invited []ct.UserId,
+	isDirect bool,
+) types.Error {
+	allState := append(append([]types.InitialState{}, initialState...), requestedState...)
+	if err := testInitialStateVersion(allState); err != nil {
+		return err
 	}
-	profile, err := s.profileProvider.Profile(creator)
-	if err != nil {
-		return ct.RoomId{}, nil, err
+	exists, err := s.rooms.CreateRoom(room)
+	if exists {
+		return types.RoomInUseError("room '" + room.String() + "' already exists")
 	}
-	membership := &types.MembershipEventContent{&profile, types.MembershipMember}
-	_, err = s.setState(id, creator, membership, creator.String())
 	if err != nil {
-		return ct.RoomId{}, nil, err
+		return err
 	}
-	_, err = s.setState(id, creator, types.DefaultPowerLevels(creator), "")
-	if err != nil {
-		return ct.RoomId{}, nil, err
+	if err := s.initializeRoom(room, creator, alias, initialState, requestedState, invited, isDirect); err != nil {
+		if rollbackErr := s.rollbackRoom(room); rollbackErr != nil {
+			log.Printf("failed to roll back creation of room %s: %s", room, rollbackErr)
+		}
+		return err
 	}
-	joinRuleContent := types.JoinRulesEventContent{desc.Visibility.ToJoinRule()}
-	_, err = s.setState(id, creator, &joinRuleContent, "")
+	return nil
+}
+
+// Fails if the initial state uses rules that the version of the new room doesn't support. The first
+// initial state is the create event, which decides the version
+func testInitialStateVersion(initialState []types.InitialState) types.Error {
+	create, ok := initialState[0].Content.(*types.CreateEventContent)
+	if !ok {
+		return types.ServerError("initial state must start with the create event")
+	}
+	version, err := create.Version()
 	if err != nil {
-		return ct.RoomId{}, nil, err
+		return err
 	}
+	for _, state := range initialState {
+		joinRules, ok := state.Content.(*types.JoinRulesEventContent)
+		if ok && !version.JoinRuleAllowed(joinRules.JoinRule) {
+			return types.BadJsonError("join rule " + joinRules.JoinRule.String() + " is not supported in room version " + version.Id)
+		}
+	}
+	return nil
+}
+
+// Adds the alias, creator, initial state, requested state and invites to a newly created room
+func (s roomService) initializeRoom(
+	room ct.RoomId,
+	creator ct.UserId,
+	alias *ct.Alias,
+	initialState []types.InitialState,
+	requestedState []types.InitialState,
+	invited []ct.UserId,
+	isDirect bool,
+) types.Error {
 	if alias != nil {
-		_, err = s.setState(id, creator, &types.AliasesEventContent{[]ct.Alias{*alias}}, "")
-		if err != nil {
-			return ct.RoomId{}, nil, err
+		if err := s.aliases.AddAlias(*alias, room); err != nil {
+			return err
 		}
 	}
-	if desc.Name != nil {
-		_, err = s.setState(id, creator, &types.NameEventContent{*desc.Name}, "")
-		if err != nil {
-			return ct.RoomId{}, nil, err
+	if err := s.members.AddMember(room, creator); err != nil {
+		return err
+	}
+	if _, err := s.sendMessage(room, creator, initialState[0].Content, nil); err != nil {
+		return err
+	}
+	for _, state := range initialState {
+		if _, err := s.setState(room, creator, state.Content, state.StateKey); err != nil {
+			return err
 		}
 	}
-	if desc.Topic != nil {
-		_, err = s.setState(id, creator, &types.TopicEventContent{*desc.Topic}, "")
-		if err != nil {
-			return ct.RoomId{}, nil, err
+	for _, state := range requestedState {
+		if err := s.testStateChange(room, creator, state.Content, state.StateKey); err != nil {
+			return err
+		}
+		if _, err := s.setState(room, creator, state.Content, state.StateKey); err != nil {
+			return err
 		}
 	}
-	for _, invited := range desc.Invited {
-		membership := types.MembershipEventContent{nil, types.MembershipInvited}
-		_, err = s.setState(id, creator, &membership, invited.String())
-		if err != nil {
-			return ct.RoomId{}, nil, err
+	for _, user := range invited {
+		membership := types.MembershipEventContent{Membership: types.MembershipInvited, IsDirect: isDirect}
+		if _, err := s.doMembershipChange(room, creator, user, &membership); err != nil {
+			return err
 		}
 	}
-	return id, alias, nil
+	return nil
+}
+
+// Removes everything that was added to a room during a failed room creation
+func (s roomService) rollbackRoom(room ct.RoomId) types.Error {
+	users, err := s.members.Users(room)
+	if err != nil {
+		return err
+	}
+	members := make([]ct.UserId, len(users))
+	copy(members, users)
+	for _, user := range members {
+		if err := s.members.RemoveMember(room, user); err != nil {
+			return err
+		}
+	}
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		membership, ok := state.Content.(*types.MembershipEventContent)
+		if !ok || membership.Membership != types.MembershipInvited {
+			continue
+		}
+		user, parseErr := ct.ParseUserId(state.StateKey)
+		if parseErr != nil {
+			return types.ServerError("invalid membership state key: " + state.StateKey)
+		}
+		if err := s.members.RemoveInvite(room, user); err != nil {
+			return err
+		}
+	}
+	return s.removeRoom(room)
 }
 
 var disallowedMessageTypes map[string]struct{} = map[string]struct{}{
-	types.EventTypeName:        struct{}{},
-	types.EventTypeTopic:       struct{}{},
-	types.EventTypeJoinRules:   struct{}{},
-	types.EventTypePowerLevels: struct{}{},
-	types.EventTypeCreate:      struct{}{},
-	types.EventTypeAliases:     struct{}{},
-	types.EventTypeMembership:  struct{}{},
+	types.EventTypeName:              struct{}{},
+	types.EventTypeTopic:             struct{}{},
+	types.EventTypeAvatar:            struct{}{},
+	types.EventTypeCanonicalAlias:    struct{}{},
+	types.EventTypeTombstone:         struct{}{},
+	types.EventTypeJoinRules:         struct{}{},
+	types.EventTypePowerLevels:       struct{}{},
+	types.EventTypeCreate:            struct{}{},
+	types.EventTypeAliases:           struct{}{},
+	types.EventTypeMembership:        struct{}{},
+	types.EventTypeGuestAccess:       struct{}{},
+	types.EventTypeRetention:         struct{}{},
+	types.EventTypeHistoryVisibility: struct{}{},
+	types.EventTypeRedaction:         struct{}{},
 }
 
 func (s roomService) AddMessage(
 	room ct.RoomId,
 	caller ct.UserId,
 	content types.TypedContent,
+	txn *types.Transaction,
 ) (*types.Message, types.Error) {
 	eventType := content.GetEventType()
 	if _, ok := disallowedMessageTypes[eventType]; ok {
 		return nil, types.ForbiddenError("sending a message event of the type " + eventType + " is not permitted")
 	}
+	if _, err := types.ContentRelation(content); err != nil {
+		return nil, err
+	}
+	if err := s.testGuestAccess(room, caller); err != nil {
+		return nil, err
+	}
 
 	err := s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
 		if eventLevel, ok := pl.Events[eventType]; ok {
@@ -186,7 +411,64 @@ func (s roomService) AddMessage(
 		return nil, err
 	}
 
-	return s.sendMessage(room, caller, content)
+	return s.sendMessage(room, caller, content, txn)
+}
+
+// Users may redact their own events if they are allowed to send redactions, and the events of
+// others if they also have the redact power level
+func (s roomService) Redact(
+	room ct.RoomId,
+	caller ct.UserId,
+	eventId ct.EventId,
+	reason string,
+	txn *types.Transaction,
+) (*types.Message, types.Error) {
+	if err := s.testGuestAccess(room, caller); err != nil {
+		return nil, err
+	}
+	event, err := s.eventProvider.Event(caller, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil || event.GetRoomId() == nil || *event.GetRoomId() != room {
+		return nil, types.NotFoundError("event not found: " + eventId.String())
+	}
+	// the create event decides the room version, so it must stay intact
+	if event.GetEventType() == types.EventTypeCreate {
+		return nil, types.ForbiddenError("the create event of a room cannot be redacted")
+	}
+	version, err := roomVersion(s.rooms, room)
+	if err != nil {
+		return nil, err
+	}
+	err = s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+		level := pl.EventDefault
+		if eventLevel, ok := pl.Events[types.EventTypeRedaction]; ok {
+			level = eventLevel
+		}
+		if sender := event.GetUserId(); (sender == nil || *sender != caller) && pl.Redact > level {
+			level = pl.Redact
+		}
+		return level
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := &types.RedactionEventContent{Redacts: eventId, Reason: reason}
+	redaction, err := s.sendMessage(room, caller, content, txn)
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := event.(*types.State); ok {
+		redacted, err := types.Redact(version, state, redaction)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.rooms.RedactRoomState(redacted.(*types.State)); err != nil {
+			return nil, err
+		}
+	}
+	return redaction, nil
 }
 
 func (s roomService) State(
@@ -199,7 +481,16 @@ func (s roomService) State(
 		return nil, err
 	}
 	if membership != types.MembershipMember {
-		return nil, types.ForbiddenError("cannot read room state, not a member")
+		visibility, err := s.historyVisibility(room)
+		if err != nil {
+			return nil, err
+		}
+		if visibility != types.HistoryVisibilityWorldReadable {
+			return nil, types.ForbiddenError("cannot read room state, not a member")
+		}
+	}
+	if err := s.testGuestAccess(room, caller); err != nil {
+		return nil, err
 	}
 	state, err := s.rooms.RoomState(room, eventType, stateKey)
 	if err != nil {
@@ -214,6 +505,66 @@ func (s roomService) SetState(
 	content types.TypedContent,
 	stateKey string,
 ) (*types.State, types.Error) {
+	eventType := content.GetEventType()
+	if eventType == types.EventTypeMembership {
+		membership, ok := content.(*types.MembershipEventContent)
+		if !ok || membership == nil {
+			panic("expected membership event content, got " + reflect.TypeOf(content).String())
+		}
+		user, parseErr := ct.ParseUserId(stateKey)
+		if parseErr != nil {
+			return nil, types.ForbiddenError("state key must be a user id for state " + eventType)
+		}
+		return s.doMembershipChange(room, caller, user, membership)
+	}
+	if err := s.testStateChange(room, caller, content, stateKey); err != nil {
+		return nil, err
+	}
+	isGuest, err := s.guestProvider.UserIsGuest(caller)
+	if err != nil {
+		return nil, err
+	}
+	if isGuest {
+		return nil, types.ForbiddenError("guests cannot set room state")
+	}
+
+	existing, err := s.rooms.RoomState(room, eventType, stateKey)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		err := s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+			return pl.CreateState
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+		if eventLevel, ok := pl.Events[eventType]; ok {
+			return eventLevel
+		}
+		return pl.EventDefault
+	})
+	if err != nil {
+		return nil, err
+	}
+	if powerLevels, ok := content.(*types.PowerLevelsEventContent); ok {
+		if err := s.testPowerLevelsChange(room, caller, powerLevels); err != nil {
+			return nil, err
+		}
+	}
+	return s.setState(room, caller, content, stateKey)
+}
+
+// Checks the state key and content of a state change other than a membership change, without
+// checking the power level of the caller
+func (s roomService) testStateChange(
+	room ct.RoomId,
+	caller ct.UserId,
+	content types.TypedContent,
+	stateKey string,
+) types.Error {
 	userIdStateKey, parseErr := ct.ParseUserId(stateKey)
 	isUserIdStateKey := parseErr == nil
 
@@ -221,66 +572,565 @@ func (s roomService) SetState(
 	switch eventType {
 	case types.EventTypeName:
 		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+			return types.ForbiddenError("state key must be empty for state " + eventType)
 		}
 	case types.EventTypeTopic:
 		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeAvatar:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeTombstone:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeCanonicalAlias:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+		if canonicalAlias, ok := content.(*types.CanonicalAliasEventContent); ok {
+			if err := s.testCanonicalAlias(room, canonicalAlias); err != nil {
+				return err
+			}
 		}
 	case types.EventTypeJoinRules:
 		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+		if joinRules, ok := content.(*types.JoinRulesEventContent); ok {
+			version, err := roomVersion(s.rooms, room)
+			if err != nil {
+				return err
+			}
+			if !version.JoinRuleAllowed(joinRules.JoinRule) {
+				return types.ForbiddenError("join rule " + joinRules.JoinRule.String() + " is not supported in room version " + version.Id)
+			}
+			for _, condition := range joinRules.Allow {
+				if condition.Type != types.JoinRuleConditionRoomMembership {
+					return types.BadJsonError("unknown join rule condition: " + condition.Type)
+				}
+			}
 		}
 	case types.EventTypePowerLevels:
 		if stateKey != "" {
-			return nil, types.ForbiddenError("state key must be empty for state " + eventType)
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeGuestAccess:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeRetention:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
+		}
+	case types.EventTypeHistoryVisibility:
+		if stateKey != "" {
+			return types.ForbiddenError("state key must be empty for state " + eventType)
 		}
 	case types.EventTypeCreate:
-		return nil, types.ForbiddenError("cannot set state " + eventType)
+		return types.ForbiddenError("cannot set state " + eventType)
 
 	case types.EventTypeAliases:
-		return nil, types.ForbiddenError("cannot set state " + eventType)
+		return types.ForbiddenError("cannot set state " + eventType)
+	}
+	if isUserIdStateKey && userIdStateKey != caller {
+		return types.ForbiddenError("cannot set the state of another user")
+	}
+	return nil
+}
 
-	case types.EventTypeMembership:
-		membership, ok := content.(*types.MembershipEventContent)
-		if !ok || membership == nil {
-			panic("expected membership event content, got " + reflect.TypeOf(content).String())
+// Fails unless all aliases of the canonical alias content point to the room
+func (s roomService) testCanonicalAlias(room ct.RoomId, content *types.CanonicalAliasEventContent) types.Error {
+	aliases := content.AltAliases
+	if content.Alias != nil {
+		aliases = append([]ct.Alias{*content.Alias}, aliases...)
+	}
+	for _, alias := range aliases {
+		aliasRoom, err := s.aliases.Room(alias)
+		if err != nil {
+			return err
 		}
-		if !isUserIdStateKey {
-			return nil, types.ForbiddenError("state key must be a user id for state " + eventType)
+		if aliasRoom == nil || *aliasRoom != room {
+			return types.BadAliasError("alias " + alias.String() + " does not point to room " + room.String())
+		}
+	}
+	return nil
+}
+
+func (s roomService) PublicRooms(caller ct.UserId) ([]types.PublicRoom, types.Error) {
+	rooms, err := s.rooms.Rooms()
+	if err != nil {
+		return nil, err
+	}
+	publicRooms := []types.PublicRoom{}
+	for _, room := range rooms {
+		// rooms that are still being created don't have any join rules yet
+		joinRules, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
+		if err != nil {
+			return nil, err
 		}
-		state, err := s.doMembershipChange(room, caller, userIdStateKey, membership)
+		if joinRules == nil {
+			continue
+		}
+		joinRulesContent, ok := joinRules.Content.(*types.JoinRulesEventContent)
+		if !ok {
+			return nil, types.ServerError("invalid join rule content, was " + reflect.TypeOf(joinRules.Content).String())
+		}
+		if joinRulesContent.JoinRule != types.JoinRulePublic {
+			continue
+		}
+		publicRoom := types.PublicRoom{RoomId: room}
+		states, err := s.rooms.EntireRoomState(room)
+		if err != nil {
+			return nil, err
+		}
+		replaced := false
+		for _, state := range states {
+			switch content := state.Content.(type) {
+			case *types.TombstoneEventContent:
+				replaced = true
+			case *types.NameEventContent:
+				publicRoom.Name = &content.Name
+			case *types.TopicEventContent:
+				publicRoom.Topic = &content.Topic
+			case *types.CanonicalAliasEventContent:
+				publicRoom.CanonicalAlias = content.Alias
+			case *types.AvatarEventContent:
+				publicRoom.AvatarUrl = content.Url
+			case *types.HistoryVisibilityEventContent:
+				publicRoom.WorldReadable = content.HistoryVisibility == types.HistoryVisibilityWorldReadable
+			case *types.GuestAccessEventContent:
+				publicRoom.GuestCanJoin = content.GuestAccess == types.GuestAccessCanJoin
+			}
+		}
+		if replaced {
+			continue
+		}
+		aliases, err := s.aliases.Aliases(room)
 		if err != nil {
 			return nil, err
 		}
-		return state, nil
+		publicRoom.Aliases = aliases
+		members, err := s.members.Users(room)
+		if err != nil {
+			return nil, err
+		}
+		publicRoom.NumJoinedMembers = len(members)
+		publicRooms = append(publicRooms, publicRoom)
 	}
-	if isUserIdStateKey && userIdStateKey != caller {
-		return nil, types.ForbiddenError("cannot set the state of another user")
+	sort.Sort(publicRoomsByMembers(publicRooms))
+	return publicRooms, nil
+}
+
+// Sorts the largest rooms first
+type publicRoomsByMembers []types.PublicRoom
+
+func (r publicRoomsByMembers) Len() int      { return len(r) }
+func (r publicRoomsByMembers) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r publicRoomsByMembers) Less(i, j int) bool {
+	if r[i].NumJoinedMembers != r[j].NumJoinedMembers {
+		return r[i].NumJoinedMembers > r[j].NumJoinedMembers
 	}
+	return r[i].RoomId.String() < r[j].RoomId.String()
+}
 
-	existing, err := s.rooms.RoomState(room, eventType, stateKey)
+// State that is copied to the replacement room when a room is upgraded
+var upgradeStateTypes = map[string]struct{}{
+	types.EventTypePowerLevels:       struct{}{},
+	types.EventTypeJoinRules:         struct{}{},
+	types.EventTypeHistoryVisibility: struct{}{},
+	types.EventTypeGuestAccess:       struct{}{},
+	types.EventTypeRetention:         struct{}{},
+	types.EventTypeName:              struct{}{},
+	types.EventTypeTopic:             struct{}{},
+	types.EventTypeAvatar:            struct{}{},
+	types.EventTypeCanonicalAlias:    struct{}{},
+}
+
+func (s roomService) UpgradeRoom(room ct.RoomId, caller ct.UserId, newVersion string) (ct.RoomId, types.Error) {
+	if err := s.RoomExists(room, caller); err != nil {
+		return ct.RoomId{}, err
+	}
+	tombstone, err := s.rooms.RoomState(room, types.EventTypeTombstone, "")
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	if tombstone != nil {
+		return ct.RoomId{}, types.ForbiddenError("room " + room.String() + " has already been replaced")
+	}
+	err = s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+		if eventLevel, ok := pl.Events[types.EventTypeTombstone]; ok {
+			return eventLevel
+		}
+		return pl.CreateState
+	})
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	profile, err := s.profileProvider.Profile(caller)
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return ct.RoomId{}, err
+	}
+
+	createContent := types.CreateEventContent{}
+	var copiedState []types.InitialState
+	for _, state := range states {
+		switch content := state.Content.(type) {
+		case *types.CreateEventContent:
+			createContent = *content
+		case *types.MembershipEventContent:
+			// bans are carried over, everyone else has to join the new room
+			if content.Membership == types.MembershipBanned {
+				ban := &types.MembershipEventContent{Membership: types.MembershipBanned}
+				copiedState = append(copiedState, types.InitialState{EventType: state.EventType, StateKey: state.StateKey, Content: ban})
+			}
+		default:
+			typed, isTyped := state.Content.(types.TypedContent)
+			if _, ok := upgradeStateTypes[state.EventType]; ok && isTyped && state.StateKey == "" {
+				copiedState = append(copiedState, types.InitialState{EventType: state.EventType, Content: typed})
+			}
+		}
+	}
+	createContent.Creator = caller
+	createContent.Predecessor = &types.RoomPredecessor{RoomId: room}
+	createContent.RoomVersion = types.DefaultRoomVersion
+	if newVersion != "" {
+		createContent.RoomVersion = newVersion
+	}
+	membership := &types.MembershipEventContent{UserProfile: &profile, Membership: types.MembershipMember}
+	initialState := []types.InitialState{
+		{EventType: types.EventTypeCreate, Content: &createContent},
+		{EventType: types.EventTypeMembership, StateKey: caller.String(), Content: membership},
+	}
+	initialState = append(initialState, copiedState...)
+
+	replacement := ct.NewRoomId(utils.RandomString(16), ct.Id(room).Domain())
+	if err := s.commitRoom(replacement, caller, nil, initialState, nil, nil, false); err != nil {
+		return ct.RoomId{}, err
+	}
+	if err := s.replaceRoom(room, replacement, caller); err != nil {
+		if rollbackErr := s.rollbackUpgrade(room, replacement, caller, states); rollbackErr != nil {
+			log.Printf("failed to roll back upgrade of room %s: %s", room, rollbackErr)
+		}
+		return ct.RoomId{}, err
+	}
+	return replacement, nil
+}
+
+// Moves the aliases of the room to its replacement, and then locks and tombstones the room.
+// The tombstone is set last, since it can't be undone if anything fails.
+func (s roomService) replaceRoom(room, replacement ct.RoomId, caller ct.UserId) types.Error {
+	aliases, err := s.aliases.Aliases(room)
+	if err != nil {
+		return err
+	}
+	movedAliases := make([]ct.Alias, len(aliases))
+	copy(movedAliases, aliases)
+	for _, alias := range movedAliases {
+		if err := s.aliases.RemoveAlias(alias, room); err != nil {
+			return err
+		}
+		if err := s.aliases.AddAlias(alias, replacement); err != nil {
+			return err
+		}
+	}
+	if len(movedAliases) > 0 {
+		if _, err := s.setState(replacement, caller, &types.AliasesEventContent{Aliases: movedAliases}, ""); err != nil {
+			return err
+		}
+		if _, err := s.setState(room, caller, &types.AliasesEventContent{Aliases: []ct.Alias{}}, ""); err != nil {
+			return err
+		}
+	}
+	canonicalAlias, err := s.rooms.RoomState(room, types.EventTypeCanonicalAlias, "")
+	if err != nil {
+		return err
+	}
+	if canonicalAlias != nil {
+		if _, err := s.setState(room, caller, &types.CanonicalAliasEventContent{}, ""); err != nil {
+			return err
+		}
+	}
+
+	// only moderators are able to talk or invite in the old room from now on
+	powerLevels, err := s.powerLevels(room)
+	if err != nil {
+		return err
+	}
+	locked := *powerLevels
+	restricted := locked.UserDefault + 1
+	if restricted < 50 {
+		restricted = 50
+	}
+	locked.EventDefault = restricted
+	locked.Invite = restricted
+	if _, err := s.setState(room, caller, &locked, ""); err != nil {
+		return err
+	}
+	tombstoneContent := types.TombstoneEventContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: replacement,
+	}
+	_, err = s.setState(room, caller, &tombstoneContent, "")
+	return err
+}
+
+// Moves the aliases back to the room, restores the state that was changed by replaceRoom
+// from the given previous state, and removes the replacement
+func (s roomService) rollbackUpgrade(
+	room, replacement ct.RoomId,
+	caller ct.UserId,
+	previousStates []*types.State,
+) types.Error {
+	aliases, err := s.aliases.Aliases(replacement)
+	if err != nil {
+		return err
+	}
+	movedAliases := make([]ct.Alias, len(aliases))
+	copy(movedAliases, aliases)
+	for _, alias := range movedAliases {
+		if err := s.aliases.RemoveAlias(alias, replacement); err != nil {
+			return err
+		}
+		if err := s.aliases.AddAlias(alias, room); err != nil {
+			return err
+		}
+	}
+	previous := map[string]*types.State{}
+	for _, state := range previousStates {
+		if state.StateKey == "" {
+			previous[state.EventType] = state
+		}
+	}
+	for _, eventType := range []string{types.EventTypeAliases, types.EventTypeCanonicalAlias, types.EventTypePowerLevels} {
+		current, err := s.rooms.RoomState(room, eventType, "")
+		if err != nil {
+			return err
+		}
+		if current == nil || (previous[eventType] != nil && current.EventId == previous[eventType].EventId) {
+			continue
+		}
+		content := types.NewStateContent(eventType)
+		if previous[eventType] != nil {
+			typed, ok := previous[eventType].Content.(types.TypedContent)
+			if !ok {
+				return types.ServerError("invalid " + eventType + " content, was " + reflect.TypeOf(previous[eventType].Content).String())
+			}
+			content = typed
+		}
+		if _, err := s.setState(room, caller, content, ""); err != nil {
+			return err
+		}
+	}
+	return s.rollbackRoom(replacement)
+}
+
+func (s roomService) AdminState(room ct.RoomId, caller ct.UserId) ([]*types.State, types.Error) {
+	if err := s.testAdmin(caller); err != nil {
+		return nil, err
+	}
+	if err := s.RoomExists(room, caller); err != nil {
+		return nil, err
+	}
+	return s.rooms.EntireRoomState(room)
+}
+
+func (s roomService) AdminMembers(room ct.RoomId, caller ct.UserId) ([]ct.UserId, types.Error) {
+	if err := s.testAdmin(caller); err != nil {
+		return nil, err
+	}
+	if err := s.RoomExists(room, caller); err != nil {
+		return nil, err
+	}
+	users, err := s.members.Users(room)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ct.UserId, len(users))
+	copy(result, users)
+	return result, nil
+}
+
+func (s roomService) PurgeRoom(room ct.RoomId, caller ct.UserId) types.Error {
+	if err := s.testAdmin(caller); err != nil {
+		return err
+	}
+	if err := s.RoomExists(room, caller); err != nil {
+		return err
+	}
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.EventType != types.EventTypeMembership {
+			continue
+		}
+		membership, ok := state.Content.(*types.MembershipEventContent)
+		if !ok {
+			return types.ServerError("invalid membership content, was " + reflect.TypeOf(state.Content).String())
+		}
+		switch membership.Membership {
+		case types.MembershipMember, types.MembershipInvited, types.MembershipKnocking:
+		default:
+			continue
+		}
+		user, parseErr := ct.ParseUserId(state.StateKey)
+		if parseErr != nil {
+			return types.ServerError("invalid membership state key: " + state.StateKey)
+		}
+		// the admin might not have any power in the room, so the kicks are not checked
+		leave := types.MembershipEventContent{
+			Membership: types.MembershipLeaving,
+			Reason:     "room was purged by a server admin",
+		}
+		if _, err := s.applyMembershipChange(room, caller, user, membership.Membership, &leave); err != nil {
+			return err
+		}
+	}
+	return s.removeRoom(room)
+}
+
+// Removes the aliases, events and state of a room that has no members left
+func (s roomService) removeRoom(room ct.RoomId) types.Error {
+	aliases, err := s.aliases.Aliases(room)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if err := s.aliases.RemoveAlias(alias, room); err != nil {
+			return err
+		}
+	}
+	if err := s.eventPurger.PurgeRoom(room); err != nil {
+		return err
+	}
+	if err := s.members.RemoveRoom(room); err != nil {
+		return err
+	}
+	_, err = s.rooms.RemoveRoom(room)
+	return err
+}
+
+func (s roomService) ForgetRoom(room ct.RoomId, caller ct.UserId) types.Error {
+	if err := s.RoomExists(room, caller); err != nil {
+		return err
+	}
+	membership, err := s.userMembership(room, caller)
+	if err != nil {
+		return err
+	}
+	switch membership {
+	case types.MembershipLeaving, types.MembershipBanned:
+	case types.MembershipNone:
+		return types.ForbiddenError("user " + caller.String() + " has never been in the room")
+	default:
+		return types.ForbiddenError("user " + caller.String() + " has not left the room")
+	}
+	if err := s.members.ForgetRoom(room, caller); err != nil {
+		return err
+	}
+	abandoned, err := s.roomAbandoned(room)
+	if err != nil {
+		return err
+	}
+	if !abandoned {
+		return nil
+	}
+	return s.removeRoom(room)
+}
+
+// Whether the room has no members, no former members that haven't forgotten it, and no
+// pending invites or knocks
+func (s roomService) roomAbandoned(room ct.RoomId) (bool, types.Error) {
+	members, err := s.members.Users(room)
+	if err != nil {
+		return false, err
+	}
+	if len(members) > 0 {
+		return false, nil
+	}
+	formerMembers, err := s.members.ArchivedUsers(room)
+	if err != nil {
+		return false, err
+	}
+	if len(formerMembers) > 0 {
+		return false, nil
+	}
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return false, err
+	}
+	for _, state := range states {
+		membership, ok := state.Content.(*types.MembershipEventContent)
+		if !ok {
+			continue
+		}
+		if membership.Membership == types.MembershipInvited || membership.Membership == types.MembershipKnocking {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s roomService) AdminJoin(room ct.RoomId, caller ct.UserId) (*types.State, types.Error) {
+	if err := s.testAdmin(caller); err != nil {
+		return nil, err
+	}
+	if err := s.RoomExists(room, caller); err != nil {
+		return nil, err
+	}
+	powerLevels, err := s.powerLevels(room)
+	if err != nil {
+		return nil, err
+	}
+	required, err := s.eventPowerLevel(room, types.EventTypePowerLevels)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.members.Users(room)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		level, err := s.userPowerLevel(room, user)
+		if err != nil {
+			return nil, err
+		}
+		if level >= required {
+			return nil, types.ForbiddenError("room is not abandoned, " + user.String() + " can still change power levels")
+		}
+	}
+	membership, err := s.userMembership(room, caller)
 	if err != nil {
 		return nil, err
 	}
-	if existing != nil {
-		err := s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.CreateState
-		})
+	if membership != types.MembershipMember {
+		profile, err := s.profileProvider.Profile(caller)
 		if err != nil {
 			return nil, err
 		}
-	}
-	err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-		if eventLevel, ok := pl.Events[eventType]; ok {
-			return eventLevel
+		if err := s.members.AddMember(room, caller); err != nil {
+			return nil, err
+		}
+		content := types.MembershipEventContent{UserProfile: &profile, Membership: types.MembershipMember}
+		if _, err := s.setState(room, caller, &content, caller.String()); err != nil {
+			return nil, err
 		}
-		return pl.EventDefault
-	})
-	if err != nil {
-		return nil, err
 	}
-	return s.setState(room, caller, content, stateKey)
+	updated := *powerLevels
+	updated.Users = types.UserPowerLevelMap{}
+	for user, level := range powerLevels.Users {
+		updated.Users[user] = level
+	}
+	updated.Users[caller.String()] = required
+	return s.setState(room, caller, &updated, "")
 }
 
 func (s roomService) setState(
@@ -289,34 +1139,55 @@ func (s roomService) setState(
 	content types.TypedContent,
 	stateKey string,
 ) (*types.State, types.Error) {
+	state, _, err := s.sendState(room, user, content, stateKey)
+	return state, err
+}
+
+// Like setState, but also returns the index of the state event in the event stream
+func (s roomService) sendState(
+	room ct.RoomId,
+	user ct.UserId,
+	content types.TypedContent,
+	stateKey string,
+) (*types.State, uint64, types.Error) {
 	log.Printf("Setting state: %#v, %#v, %#v, %#v", room, user, content, stateKey)
-	state, err := s.rooms.SetRoomState(room, user, content, stateKey)
+	eventId, err := s.newEventId(room, user, content)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	_, err = s.eventSink.Send(state)
+	state, err := s.rooms.SetRoomState(room, eventId, user, content, stateKey)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return state, nil
+	index, err := s.eventSink.Send(state)
+	if err != nil {
+		return nil, 0, err
+	}
+	return state, index, nil
 }
 
 func (s roomService) sendMessage(
 	room ct.RoomId,
 	user ct.UserId,
 	content types.TypedContent,
+	txn *types.Transaction,
 ) (*types.Message, types.Error) {
 	log.Printf("Sending message: %#v, %#v, %#v, %#v", room, user, content)
 
+	eventId, err := s.newEventId(room, user, content)
+	if err != nil {
+		return nil, err
+	}
 	message := new(types.Message)
-	message.EventId = ct.DeriveEventId(utils.RandomString(16), ct.Id(user))
+	message.EventId = eventId
 	message.RoomId = room
 	message.UserId = user
 	message.EventType = content.GetEventType()
 	message.Timestamp = ct.Timestamp{time.Now()}
 	message.Content = content
+	message.Transaction = txn
 
-	_, err := s.eventSink.Send(message)
+	_, err = s.eventSink.Send(message)
 	if err != nil {
 		return nil, err
 	}
@@ -334,133 +1205,234 @@ func (s roomService) doMembershipChange(
 	if err != nil {
 		return nil, err
 	}
-	if currentMembership == membership.Membership {
-		return nil, types.ForbiddenError("membership change was a no-op")
+	if err := s.testMembershipChange(room, caller, user, currentMembership, membership.Membership); err != nil {
+		return nil, err
 	}
-	membership.UserProfile = nil
+	return s.applyMembershipChange(room, caller, user, currentMembership, membership)
+}
 
-	switch membership.Membership {
-	case types.MembershipNone:
-		if currentMembership != types.MembershipBanned {
-			return nil, types.BadJsonError("invalid or missing membership in membership change")
-		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.Ban
-		})
+// Changes the membership without checking whether the caller is allowed to do so
+func (s roomService) applyMembershipChange(
+	room ct.RoomId,
+	caller ct.UserId,
+	user ct.UserId,
+	currentMembership types.Membership,
+	membership *types.MembershipEventContent,
+) (*types.State, types.Error) {
+	membership.UserProfile = nil
+	if membership.Membership == types.MembershipMember {
+		profile, err := s.profileProvider.Profile(user)
 		if err != nil {
 			return nil, err
 		}
-		if user == caller {
-			return nil, types.ForbiddenError("cannot remove a ban from self")
+		membership.UserProfile = &profile
+		if err := s.members.AddMember(room, user); err != nil {
+			return nil, err
 		}
-
-	case types.MembershipInvited:
-		if currentMembership != types.MembershipNone {
-			return nil, types.ForbiddenError("could not invite user to room, already have membership '" + currentMembership.String() + "'")
+	} else if currentMembership == types.MembershipMember {
+		if err := s.members.RemoveMember(room, user); err != nil {
+			return nil, err
 		}
-		ok, err := s.allowsJoinRule(room, types.JoinRuleInvite)
-		if err != nil {
+	}
+	state, index, err := s.sendState(room, caller, membership, user.String())
+	if err != nil {
+		return nil, err
+	}
+	if membership.Membership == types.MembershipInvited {
+		if err := s.members.AddInvite(room, user); err != nil {
 			return nil, err
 		}
-		if !ok {
-			return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleInvite.String())
+	} else if currentMembership == types.MembershipInvited {
+		if err := s.members.RemoveInvite(room, user); err != nil {
+			return nil, err
 		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-			return pl.Invite
-		})
+	}
+	if membership.Membership == types.MembershipMember {
+		if err := s.members.UnarchiveRoom(room, user); err != nil {
+			return nil, err
+		}
+		if err := s.members.RememberRoom(room, user); err != nil {
+			return nil, err
+		}
+	} else if currentMembership == types.MembershipMember {
+		states, err := s.rooms.EntireRoomState(room)
 		if err != nil {
 			return nil, err
 		}
+		archived := types.ArchivedRoom{RoomId: room, End: index + 1, State: states}
+		if err := s.members.ArchiveRoom(user, archived); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// Checks whether the caller is allowed to change the membership of the user from one state to another.
+//
+//	from \ to  | none  | invite | join         | knock | leave               | ban
+//	none       |       | invite | public, self | self  |                     | ban
+//	invite     |       |        | self         |       | self or kick        | ban
+//	join       |       |        |              |       | self or kick        | ban
+//	knock      |       | invite | public, self |       | self or kick        | ban
+//	leave      |       | invite | public, self | self  |                     | ban
+//	ban        | ban   |        |              |       |                     |
+//
+// Changes of the membership of other users require the caller to be in the room and to have the
+// power level of the action, kicks and bans additionally require the caller to outrank the user.
+func (s roomService) testMembershipChange(
+	room ct.RoomId,
+	caller ct.UserId,
+	user ct.UserId,
+	from types.Membership,
+	to types.Membership,
+) types.Error {
+	if from == to {
+		return types.ForbiddenError("membership change was a no-op")
+	}
+	self := user == caller
+	disallowed := func() types.Error {
+		return types.ForbiddenError("cannot change membership from '" + from.String() + "' to '" + to.String() + "'")
+	}
+
+	switch to {
+	case types.MembershipNone:
+		if from != types.MembershipBanned {
+			return types.BadJsonError("invalid or missing membership in membership change")
+		}
+		if self {
+			return types.ForbiddenError("cannot remove a ban from self")
+		}
+		return s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+			return pl.Ban
+		})
+
+	case types.MembershipInvited:
+		switch from {
+		case types.MembershipNone, types.MembershipLeaving, types.MembershipKnocking:
+		default:
+			return types.ForbiddenError("could not invite user to room, already have membership '" + from.String() + "'")
+		}
+		// invites are allowed regardless of the join rule, it only restricts uninvited joins,
+		// and are how knocks are accepted
+		return s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+			return pl.Invite
+		})
 
 	case types.MembershipMember:
-		switch currentMembership {
-		case types.MembershipNone:
-			ok, err := s.allowsJoinRule(room, types.JoinRulePublic)
-			if err != nil {
-				return nil, err
-			}
-			if !ok {
-				return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleInvite.String())
+		if err := s.testGuestAccess(room, user); err != nil {
+			return err
+		}
+		switch from {
+		case types.MembershipNone, types.MembershipLeaving, types.MembershipKnocking:
+			if !self {
+				return types.ForbiddenError("cannot force other users to join the room")
 			}
+			return s.testJoinRuleAllowsJoin(room, user)
 		case types.MembershipInvited:
-			if user != caller {
-				return nil, types.ForbiddenError("cannot force other users to join the room")
-			}
-		case types.MembershipKnocking:
-			if user == caller {
-				return nil, types.ForbiddenError("cannot let yourself in after knocking")
-			}
-			err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-				return pl.Invite
-			})
-			if err != nil {
-				return nil, err
+			if !self {
+				return types.ForbiddenError("cannot force other users to join the room")
 			}
+			return nil
 		case types.MembershipBanned:
-			if user == caller {
-				return nil, types.ForbiddenError("you are banned from that room")
-			} else {
-				return nil, types.ForbiddenError("that user is banned from this room")
+			if self {
+				return types.ForbiddenError("you are banned from that room")
 			}
+			return types.ForbiddenError("that user is banned from this room")
 		}
-		profile, err := s.profileProvider.Profile(caller)
-		if err != nil {
-			return nil, err
-		}
-		membership.UserProfile = &profile
+		return disallowed()
 
 	case types.MembershipKnocking:
-		if user != caller {
-			return nil, types.ForbiddenError("cannot force other users to knock")
+		if !self {
+			return types.ForbiddenError("cannot force other users to knock")
 		}
-		if currentMembership != types.MembershipNone {
-			return nil, types.ForbiddenError("could not knock on room, already have membership '" + currentMembership.String() + "'")
+		switch from {
+		case types.MembershipNone, types.MembershipLeaving:
+		default:
+			return types.ForbiddenError("could not knock on room, already have membership '" + from.String() + "'")
 		}
-		ok, err := s.allowsJoinRule(room, types.JoinRuleKnock)
+		if err := s.testGuestAccess(room, user); err != nil {
+			return err
+		}
+		joinRules, err := s.joinRules(room)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if !ok {
-			return nil, types.ForbiddenError("room does not allow join method: " + types.JoinRuleKnock.String())
+		if joinRules.JoinRule != types.JoinRuleKnock {
+			return types.ForbiddenError("room does not allow join method: " + types.JoinRuleKnock.String())
+		}
+		version, err := roomVersion(s.rooms, room)
+		if err != nil {
+			return err
+		}
+		if !version.KnockingAllowed {
+			return types.ForbiddenError("knocking is not supported in room version " + version.Id)
 		}
+		return nil
 
 	case types.MembershipLeaving:
-		if currentMembership == types.MembershipNone {
-			return nil, types.ForbiddenError("tried to leave a room without current membership")
+		switch from {
+		case types.MembershipNone:
+			return types.ForbiddenError("tried to leave a room without current membership")
+		case types.MembershipBanned:
+			return types.ForbiddenError("tried to leave room with current membership '" + types.MembershipBanned.String() + "'")
 		}
-		if currentMembership == types.MembershipBanned {
-			return nil, types.ForbiddenError("tried to leave room with current membership '" + types.MembershipBanned.String() + "'")
+		// leaving, rejecting an invite and retracting a knock are always allowed
+		if self {
+			return nil
 		}
-		if user != caller {
-			err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
-				return pl.Kick
-			})
-			if err != nil {
-				return nil, err
-			}
+		// kicking, revoking an invite and denying a knock
+		if err := s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+			return pl.Kick
+		}); err != nil {
+			return err
 		}
+		return s.testOutranks(room, caller, user)
 
 	case types.MembershipBanned:
-		if user == caller {
-			return nil, types.ForbiddenError("cannot ban self")
+		if self {
+			return types.ForbiddenError("cannot ban self")
 		}
-		err = s.testPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
+		if err := s.testMemberPowerLevel(room, caller, func(pl *types.PowerLevelsEventContent) int {
 			return pl.Ban
-		})
-		if err != nil {
-			return nil, err
+		}); err != nil {
+			return err
 		}
+		return s.testOutranks(room, caller, user)
 	}
-	if membership.Membership == types.MembershipMember {
-		if err := s.members.AddMember(room, user); err != nil {
-			return nil, err
-		}
-	} else if currentMembership == types.MembershipMember {
-		if err := s.members.RemoveMember(room, user); err != nil {
-			return nil, err
-		}
+	return disallowed()
+}
+
+// Like testPowerLevel, but also requires the user to be in the room
+func (s roomService) testMemberPowerLevel(
+	room ct.RoomId,
+	user ct.UserId,
+	powerLevelFunc func(*types.PowerLevelsEventContent) int,
+) types.Error {
+	membership, err := s.userMembership(room, user)
+	if err != nil {
+		return err
+	}
+	if membership != types.MembershipMember {
+		return types.ForbiddenError("user " + user.String() + " is not in the room")
+	}
+	return s.testPowerLevel(room, user, powerLevelFunc)
+}
+
+// Fails unless the caller has a higher power level than the user
+func (s roomService) testOutranks(room ct.RoomId, caller, user ct.UserId) types.Error {
+	callerPowerLevel, err := s.userPowerLevel(room, caller)
+	if err != nil {
+		return err
+	}
+	userPowerLevel, err := s.userPowerLevel(room, user)
+	if err != nil {
+		return err
 	}
-	return s.setState(room, caller, membership, user.String())
+	if callerPowerLevel <= userPowerLevel {
+		msg := fmt.Sprintf("not enough power level to act on %s (%d <= %d)", user, callerPowerLevel, userPowerLevel)
+		return types.ForbiddenError(msg)
+	}
+	return nil
 }
 
 func (s roomService) testPowerLevel(
@@ -484,6 +1456,143 @@ func (s roomService) testPowerLevel(
 	return nil
 }
 
+// Fails if the caller would grant a power level above its own, or change anything that is
+// at or above its own power level, except for lowering its own level
+func (s roomService) testPowerLevelsChange(
+	room ct.RoomId,
+	caller ct.UserId,
+	updated *types.PowerLevelsEventContent,
+) types.Error {
+	if updated == nil {
+		return types.BadJsonError("missing power levels")
+	}
+	for user := range updated.Users {
+		if _, err := ct.ParseUserId(user); err != nil {
+			return types.ForbiddenError("invalid user id in power levels: " + user)
+		}
+	}
+	for eventType := range updated.Events {
+		if eventType == "" {
+			return types.ForbiddenError("empty event type in power levels")
+		}
+	}
+	current, err := s.powerLevels(room)
+	if err != nil {
+		return err
+	}
+	callerLevel, err := s.userPowerLevel(room, caller)
+	if err != nil {
+		return err
+	}
+	testLevel := func(name string, from, to int, fromExists, toExists bool) types.Error {
+		if from == to && fromExists == toExists {
+			return nil
+		}
+		if fromExists && from > callerLevel {
+			msg := fmt.Sprintf("cannot change power level of %s, which is above own level (%d > %d)", name, from, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		if toExists && to > callerLevel {
+			msg := fmt.Sprintf("cannot raise power level of %s above own level (%d > %d)", name, to, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		return nil
+	}
+
+	levels := []struct {
+		name     string
+		from, to int
+	}{
+		{"ban", current.Ban, updated.Ban},
+		{"kick", current.Kick, updated.Kick},
+		{"invite", current.Invite, updated.Invite},
+		{"redact", current.Redact, updated.Redact},
+		{"users_default", current.UserDefault, updated.UserDefault},
+		{"state_default", current.CreateState, updated.CreateState},
+		{"events_default", current.EventDefault, updated.EventDefault},
+	}
+	for _, level := range levels {
+		if err := testLevel(level.name, level.from, level.to, true, true); err != nil {
+			return err
+		}
+	}
+
+	eventTypes := map[string]struct{}{}
+	for eventType := range current.Events {
+		eventTypes[eventType] = struct{}{}
+	}
+	for eventType := range updated.Events {
+		eventTypes[eventType] = struct{}{}
+	}
+	for eventType := range eventTypes {
+		from, fromExists := current.Events[eventType]
+		to, toExists := updated.Events[eventType]
+		if err := testLevel(eventType, from, to, fromExists, toExists); err != nil {
+			return err
+		}
+	}
+
+	users := map[string]struct{}{}
+	for user := range current.Users {
+		users[user] = struct{}{}
+	}
+	for user := range updated.Users {
+		users[user] = struct{}{}
+	}
+	for user := range users {
+		from, fromExists := current.Users[user]
+		to, toExists := updated.Users[user]
+		if from == to && fromExists == toExists {
+			continue
+		}
+		if user != caller.String() && fromExists && from >= callerLevel {
+			msg := fmt.Sprintf("cannot change power level of %s, which is not below own level (%d >= %d)", user, from, callerLevel)
+			return types.ForbiddenError(msg)
+		}
+		if err := testLevel(user, from, to, fromExists, toExists); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s roomService) testAdmin(caller ct.UserId) types.Error {
+	admin, err := s.adminProvider.UserIsAdmin(caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return types.ForbiddenError("only admins are allowed to do that")
+	}
+	return nil
+}
+
+// Fails if the user is a guest and the room does not allow guests
+func (s roomService) testGuestAccess(room ct.RoomId, user ct.UserId) types.Error {
+	isGuest, err := s.guestProvider.UserIsGuest(user)
+	if err != nil {
+		return err
+	}
+	if !isGuest {
+		return nil
+	}
+	state, err := s.rooms.RoomState(room, types.EventTypeGuestAccess, "")
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return types.ForbiddenError("guest access is not allowed in this room")
+	}
+	guestAccess, ok := state.Content.(*types.GuestAccessEventContent)
+	if !ok {
+		return types.ServerError("invalid guest access content, was " + reflect.TypeOf(state.Content).String())
+	}
+	if guestAccess.GuestAccess != types.GuestAccessCanJoin {
+		return types.ForbiddenError("guest access is not allowed in this room")
+	}
+	return nil
+}
+
 func (s roomService) userMembership(room ct.RoomId, user ct.UserId) (types.Membership, types.Error) {
 	state, err := s.rooms.RoomState(room, types.EventTypeMembership, user.String())
 	if err != nil {
@@ -494,27 +1603,116 @@ func (s roomService) userMembership(room ct.RoomId, user ct.UserId) (types.Membe
 	}
 	membership, ok := state.Content.(*types.MembershipEventContent)
 	if !ok {
-		panic("invalid membership content, was " + reflect.TypeOf(state.Content).String())
+		return types.MembershipNone, types.ServerError("invalid membership content, was " + reflect.TypeOf(state.Content).String())
 	}
 	return membership.Membership, nil
 }
 
-func (s roomService) allowsJoinRule(room ct.RoomId, joinRule types.JoinRule) (bool, types.Error) {
+func (s roomService) historyVisibility(room ct.RoomId) (types.HistoryVisibility, types.Error) {
+	state, err := s.rooms.RoomState(room, types.EventTypeHistoryVisibility, "")
+	if err != nil {
+		return types.HistoryVisibilityShared, err
+	}
+	if state == nil {
+		return types.HistoryVisibilityShared, nil
+	}
+	content, ok := state.Content.(*types.HistoryVisibilityEventContent)
+	if !ok {
+		return types.HistoryVisibilityShared, types.ServerError("invalid history visibility content, was " + reflect.TypeOf(state.Content).String())
+	}
+	return content.HistoryVisibility, nil
+}
+
+func (s roomService) joinRules(room ct.RoomId) (*types.JoinRulesEventContent, types.Error) {
 	state, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if state == nil {
-		panic("room power levels are invalid or missing: " + room.String())
+		return nil, types.ServerError("room join rules are missing: " + room.String())
 	}
 	joinRules, ok := state.Content.(*types.JoinRulesEventContent)
 	if !ok {
-		panic("invalid join rule content, was " + reflect.TypeOf(state.Content).String())
+		return nil, types.ServerError("invalid join rule content, was " + reflect.TypeOf(state.Content).String())
 	}
-	if joinRules.JoinRule != joinRule {
-		return false, types.ForbiddenError("room does not allow join rule: " + joinRule.String())
+	return joinRules, nil
+}
+
+// Returns the version of the room, which is set by its create event
+func roomVersion(rooms interfaces.RoomStore, room ct.RoomId) (*types.RoomVersion, types.Error) {
+	state, err := rooms.RoomState(room, types.EventTypeCreate, "")
+	if err != nil {
+		return nil, err
 	}
-	return true, nil
+	if state == nil {
+		return nil, types.ServerError("room create event is missing: " + room.String())
+	}
+	create, ok := state.Content.(*types.CreateEventContent)
+	if !ok {
+		return nil, types.ServerError("invalid create event content, was " + reflect.TypeOf(state.Content).String())
+	}
+	return create.Version()
+}
+
+// Creates an id for a new event in the room, in the format of the room version. The version of
+// a room that is being created is taken from the content of its create event
+func (s roomService) newEventId(room ct.RoomId, sender ct.UserId, content types.TypedContent) (ct.EventId, types.Error) {
+	var version *types.RoomVersion
+	var err types.Error
+	if create, ok := content.(*types.CreateEventContent); ok {
+		version, err = create.Version()
+	} else {
+		version, err = roomVersion(s.rooms, room)
+	}
+	if err != nil {
+		return ct.EventId{}, err
+	}
+	return version.NewEventId(sender), nil
+}
+
+// Checks whether the join rules of the room let the user join without an invite.
+// Anyone may join public rooms, and restricted rooms may be joined by members of any of the
+// rooms listed in the join rules. Invite, private and knock rooms can only be joined by invite,
+// where private rooms differ from invite rooms only in that they are never advertised as public.
+func (s roomService) testJoinRuleAllowsJoin(room ct.RoomId, user ct.UserId) types.Error {
+	joinRules, err := s.joinRules(room)
+	if err != nil {
+		return err
+	}
+	version, err := roomVersion(s.rooms, room)
+	if err != nil {
+		return err
+	}
+	switch joinRules.JoinRule {
+	case types.JoinRulePublic:
+		return nil
+	case types.JoinRuleRestricted:
+		if !version.RestrictedJoinsAllowed {
+			break
+		}
+		for _, condition := range joinRules.Allow {
+			if condition.Type != types.JoinRuleConditionRoomMembership {
+				continue
+			}
+			// rooms that have been removed since the join rules were set have no members
+			exists, err := s.rooms.RoomExists(condition.RoomId)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			membership, err := s.userMembership(condition.RoomId, user)
+			if err != nil {
+				return err
+			}
+			if membership == types.MembershipMember {
+				return nil
+			}
+		}
+		return types.ForbiddenError("not a member of any of the rooms that allow joining " + room.String())
+	}
+	return types.ForbiddenError("room does not allow join method: " + types.JoinRulePublic.String())
 }
 
 func (s roomService) powerLevels(room ct.RoomId) (*types.PowerLevelsEventContent, types.Error) {
@@ -523,11 +1721,11 @@ func (s roomService) powerLevels(room ct.RoomId) (*types.PowerLevelsEventContent
 		return nil, err
 	}
 	if state == nil {
-		panic("room power levels are invalid or missing: " + room.String())
+		return nil, types.ServerError("room power levels are missing: " + room.String())
 	}
 	powerLevels, ok := state.Content.(*types.PowerLevelsEventContent)
 	if !ok {
-		panic("invalid power level content, was " + reflect.TypeOf(state.Content).String())
+		return nil, types.ServerError("invalid power level content, was " + reflect.TypeOf(state.Content).String())
 	}
 	return powerLevels, nil
 }
@@ -15,6 +15,10 @@
 package service
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
 	"github.com/matrix-org/bullettime/matrix/types"
@@ -26,6 +30,9 @@ func NewSyncService(
 	typingSource interfaces.IndexedEventSource,
 	rooms interfaces.RoomStore,
 	membershipStore interfaces.MembershipStore,
+	visibilityProvider interfaces.VisibilityProvider,
+	profileProvider interfaces.ProfileProvider,
+	relationProvider interfaces.RelationProvider,
 ) (interfaces.SyncService, error) {
 	return &syncService{
 		messageSource,
@@ -33,15 +40,21 @@ func NewSyncService(
 		typingSource,
 		rooms,
 		membershipStore,
+		visibilityProvider,
+		profileProvider,
+		relationProvider,
 	}, nil
 }
 
 type syncService struct {
-	messageSource   interfaces.IndexedEventSource
-	presenceSource  interfaces.IndexedEventSource
-	typingSource    interfaces.IndexedEventSource
-	rooms           interfaces.RoomStore
-	membershipStore interfaces.MembershipStore
+	messageSource      interfaces.IndexedEventSource
+	presenceSource     interfaces.IndexedEventSource
+	typingSource       interfaces.IndexedEventSource
+	rooms              interfaces.RoomStore
+	membershipStore    interfaces.MembershipStore
+	visibilityProvider interfaces.VisibilityProvider
+	profileProvider    interfaces.ProfileProvider
+	relationProvider   interfaces.RelationProvider
 }
 
 func indexedToEvents(indexed []types.IndexedEvent) []types.Event {
@@ -52,7 +65,7 @@ func indexedToEvents(indexed []types.IndexedEvent) []types.Event {
 	return events
 }
 
-func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, types.Error) {
+func (s syncService) FullSync(user ct.UserId, session string, limit uint, archived bool) (*types.InitialSync, types.Error) {
 	maxMessage := s.messageSource.Max()
 	maxPresence := s.presenceSource.Max()
 	maxTyping := s.typingSource.Max()
@@ -75,9 +88,53 @@ func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, t
 	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping)
 
 	for i, room := range rooms {
-		if err := s.roomSummary(&summaries[i], user, room, end, limit); err != nil {
+		if err := s.roomSummary(&summaries[i], user, session, room, end, limit); err != nil {
+			return nil, err
+		}
+	}
+	invitedRooms, err := s.membershipStore.InvitedRooms(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, room := range invitedRooms {
+		var summary types.RoomSummary
+		if err := s.inviteSummary(&summary, user, room, end); err != nil {
 			return nil, err
 		}
+		summaries = append(summaries, summary)
+	}
+	if archived {
+		archivedRooms, err := s.membershipStore.ArchivedRooms(user)
+		if err != nil {
+			return nil, err
+		}
+		// a room stays archived while the user is invited again, it's only listed once
+		listed := make(map[ct.RoomId]struct{}, len(rooms)+len(invitedRooms))
+		for _, room := range rooms {
+			listed[room] = struct{}{}
+		}
+		for _, room := range invitedRooms {
+			listed[room] = struct{}{}
+		}
+		for _, archivedRoom := range archivedRooms {
+			if _, ok := listed[archivedRoom.RoomId]; ok {
+				continue
+			}
+			exists, err := s.rooms.RoomExists(archivedRoom.RoomId)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			var summary types.RoomSummary
+			archivedEnd := types.NewStreamToken(archivedRoom.End, maxPresence, maxTyping)
+			err = s.summarize(&summary, user, session, archivedRoom.RoomId, archivedEnd, archivedRoom.State, limit)
+			if err != nil {
+				return nil, err
+			}
+			summaries = append(summaries, summary)
+		}
 	}
 
 	initialSync := types.InitialSync{end, presences, summaries}
@@ -85,8 +142,14 @@ func (s syncService) FullSync(user ct.UserId, limit uint) (*types.InitialSync, t
 	return &initialSync, nil
 }
 
-func (s syncService) RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*types.RoomInitialSync, types.Error) {
-	maxMessage := s.messageSource.Max()
+func (s syncService) RoomSync(user ct.UserId, session string, room ct.RoomId, limit uint) (*types.RoomInitialSync, types.Error) {
+	if err := testNotForgotten(s.membershipStore, user, room); err != nil {
+		return nil, err
+	}
+	maxMessage, allowed := s.visibilityProvider.ReadableUntil(user, room)
+	if !allowed {
+		return nil, types.ForbiddenError("not allowed to read room " + room.String())
+	}
 	maxPresence := s.presenceSource.Max()
 	maxTyping := s.typingSource.Max()
 
@@ -110,7 +173,7 @@ func (s syncService) RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*type
 	}
 
 	end := types.NewStreamToken(maxMessage, maxPresence, maxTyping)
-	if err := s.roomSummary(&sync.RoomSummary, user, room, end, limit); err != nil {
+	if err := s.roomSummary(&sync.RoomSummary, user, session, room, end, limit); err != nil {
 		return nil, err
 	}
 	return &sync, nil
@@ -119,42 +182,265 @@ func (s syncService) RoomSync(user ct.UserId, room ct.RoomId, limit uint) (*type
 func (s syncService) roomSummary(
 	summary *types.RoomSummary,
 	user ct.UserId,
+	session string,
 	room ct.RoomId,
 	end types.StreamToken,
 	limit uint,
 ) types.Error {
-	roomSet := map[ct.RoomId]struct{}{
-		room: struct{}{},
+	states, err := s.rooms.EntireRoomState(room)
+	if err != nil {
+		return err
 	}
-	messages, err := s.messageSource.Range(nil, nil, roomSet, end.MessageIndex, 0, limit)
+	return s.summarize(summary, user, session, room, end, states, limit)
+}
+
+// State that is shown to invited users before they join
+var inviteStateTypes = []string{
+	types.EventTypeName,
+	types.EventTypeCanonicalAlias,
+	types.EventTypeAvatar,
+	types.EventTypeJoinRules,
+}
+
+// Summarizes a room that the user is invited to, without any history or the full room state
+func (s syncService) inviteSummary(
+	summary *types.RoomSummary,
+	user ct.UserId,
+	room ct.RoomId,
+	end types.StreamToken,
+) types.Error {
+	invite, err := s.rooms.RoomState(room, types.EventTypeMembership, user.String())
 	if err != nil {
 		return err
 	}
-	startIndex := end.MessageIndex
-	if len(messages) > 0 {
-		startIndex = messages[0].Index()
+	if invite == nil {
+		return types.ServerError("missing invite of " + user.String() + " in " + room.String())
+	}
+	inviteState := []*types.State{invite}
+	joinRule := types.JoinRuleNone
+	for _, eventType := range inviteStateTypes {
+		state, err := s.rooms.RoomState(room, eventType, "")
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			continue
+		}
+		switch content := state.Content.(type) {
+		case *types.JoinRulesEventContent:
+			joinRule = content.JoinRule
+		case *types.CanonicalAliasEventContent:
+			summary.CanonicalAlias = content.Alias
+		case *types.AvatarEventContent:
+			summary.AvatarUrl = content.Url
+		}
+		inviteState = append(inviteState, state)
 	}
-	start := types.NewStreamToken(startIndex, end.PresenceIndex, end.TypingIndex)
-	eventRange := types.NewEventStreamRange(indexedToEvents(messages), start, end)
 	states, err := s.rooms.EntireRoomState(room)
 	if err != nil {
 		return err
 	}
-	membershipState, err := s.rooms.RoomState(room, types.EventTypeMembership, user.String())
+	if err := s.summarizeMembers(summary, user, room, states); err != nil {
+		return err
+	}
+	inviter := invite.UserId
+	summary.Membership = types.MembershipInvited
+	summary.RoomId = room
+	summary.Messages = types.NewEventStreamRange([]types.Event{}, end, end)
+	summary.Visibility = joinRule.ToVisibility()
+	summary.Inviter = &inviter
+	summary.InviteState = inviteState
+	return nil
+}
+
+// Summarizes the room with the history up to end and the given room state
+func (s syncService) summarize(
+	summary *types.RoomSummary,
+	user ct.UserId,
+	session string,
+	room ct.RoomId,
+	end types.StreamToken,
+	states []*types.State,
+	limit uint,
+) types.Error {
+	messages, err := visibleRange(s.messageSource, s.visibilityProvider, user, room, end.MessageIndex, 0, limit, nil)
 	if err != nil {
 		return err
 	}
-	membership := membershipState.Content.(*types.MembershipEventContent).Membership
-	joinRuleState, err := s.rooms.RoomState(room, types.EventTypeJoinRules, "")
+	startIndex := end.MessageIndex
+	if len(messages) > 0 {
+		startIndex = messages[0].Index()
+	}
+	start := types.NewStreamToken(startIndex, end.PresenceIndex, end.TypingIndex)
+	serializer := newEventSerializer(s.relationProvider, user, session)
+	events, err := serializer.events(indexedToEvents(messages))
 	if err != nil {
 		return err
 	}
-	joinRule := joinRuleState.Content.(*types.JoinRulesEventContent).JoinRule
-	visibility := joinRule.ToVisibility()
+	eventRange := types.NewEventStreamRange(events, start, end)
+	membership := types.MembershipNone
+	joinRule := types.JoinRuleNone
+	for _, state := range states {
+		switch content := state.Content.(type) {
+		case *types.MembershipEventContent:
+			if state.StateKey == user.String() {
+				membership = content.Membership
+			}
+		case *types.JoinRulesEventContent:
+			joinRule = content.JoinRule
+		case *types.CanonicalAliasEventContent:
+			summary.CanonicalAlias = content.Alias
+		case *types.AvatarEventContent:
+			summary.AvatarUrl = content.Url
+		}
+	}
+	if err := s.summarizeMembers(summary, user, room, states); err != nil {
+		return err
+	}
 	summary.Membership = membership
 	summary.RoomId = room
 	summary.Messages = eventRange
-	summary.State = states
-	summary.Visibility = visibility
+	summary.State, err = serializer.states(states)
+	if err != nil {
+		return err
+	}
+	summary.Visibility = joinRule.ToVisibility()
+	return nil
+}
+
+// The number of members that are used to name a room that doesn't have a name or canonical alias
+const maxHeroes = 5
+
+// Sorts membership states by the time of the membership change
+// Orders membership states by the position of the user in the room. Users without a
+// position, which only occur in archived state, come last and are ordered by timestamp.
+type statesByPosition struct {
+	states    []*types.State
+	positions map[string]uint64
+}
+
+func (s statesByPosition) Len() int      { return len(s.states) }
+func (s statesByPosition) Swap(i, j int) { s.states[i], s.states[j] = s.states[j], s.states[i] }
+func (s statesByPosition) Less(i, j int) bool {
+	a, b := s.states[i], s.states[j]
+	positionA, okA := s.positions[a.StateKey]
+	positionB, okB := s.positions[b.StateKey]
+	if okA && okB {
+		return positionA < positionB
+	}
+	if okA != okB {
+		return okA
+	}
+	if !a.Timestamp.Equal(b.Timestamp.Time) {
+		return a.Timestamp.Before(b.Timestamp.Time)
+	}
+	return a.StateKey < b.StateKey
+}
+
+// Returns the positions keyed by the state key of the membership states of the users
+func positionsByStateKey(positions map[ct.UserId]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(positions))
+	for user, position := range positions {
+		result[user.String()] = position
+	}
+	return result
+}
+
+// Computes the member counts, heroes and display name of the room from the given room state
+func (s syncService) summarizeMembers(
+	summary *types.RoomSummary,
+	user ct.UserId,
+	room ct.RoomId,
+	states []*types.State,
+) types.Error {
+	var joined, invited []*types.State
+	var name string
+	counted := false
+	for _, state := range states {
+		switch content := state.Content.(type) {
+		case *types.MembershipEventContent:
+			if state.StateKey == user.String() {
+				counted = content.Membership == types.MembershipMember || content.Membership == types.MembershipInvited
+			}
+			if content.Membership == types.MembershipMember {
+				joined = append(joined, state)
+			} else if content.Membership == types.MembershipInvited {
+				invited = append(invited, state)
+			}
+		case *types.NameEventContent:
+			name = content.Name
+		}
+	}
+	joinPositions, err := s.membershipStore.JoinPositions(room)
+	if err != nil {
+		return err
+	}
+	invitePositions, err := s.membershipStore.InvitePositions(room)
+	if err != nil {
+		return err
+	}
+	sort.Sort(statesByPosition{joined, positionsByStateKey(joinPositions)})
+	sort.Sort(statesByPosition{invited, positionsByStateKey(invitePositions)})
+
+	heroes := []ct.UserId{}
+	for _, state := range append(joined, invited...) {
+		if len(heroes) == maxHeroes {
+			break
+		}
+		if state.StateKey == user.String() {
+			continue
+		}
+		hero, err := ct.ParseUserId(state.StateKey)
+		if err != nil {
+			return types.ServerError("invalid membership state key: " + state.StateKey)
+		}
+		heroes = append(heroes, hero)
+	}
+	summary.Summary = types.RoomMemberSummary{
+		Heroes:             heroes,
+		JoinedMemberCount:  len(joined),
+		InvitedMemberCount: len(invited),
+	}
+
+	switch {
+	case name != "":
+		summary.Name = name
+	case summary.CanonicalAlias != nil:
+		summary.Name = summary.CanonicalAlias.String()
+	default:
+		others := len(joined) + len(invited)
+		if counted {
+			others -= 1
+		}
+		heroNames := make([]string, len(heroes))
+		for i, hero := range heroes {
+			profile, err := s.profileProvider.Profile(hero)
+			if err != nil {
+				return err
+			}
+			heroNames[i] = profile.DisplayName
+			if heroNames[i] == "" {
+				heroNames[i] = hero.String()
+			}
+		}
+		summary.Name = heroesRoomName(heroNames, others)
+	}
 	return nil
 }
+
+// Names a room after some of its members, where others is the number of members
+// in the room other than the user, including the heroes
+func heroesRoomName(heroNames []string, others int) string {
+	switch {
+	case len(heroNames) == 0:
+		return "Empty room"
+	case others == len(heroNames)+1:
+		return strings.Join(heroNames, ", ") + " and 1 other"
+	case others > len(heroNames):
+		return fmt.Sprintf("%s and %d others", strings.Join(heroNames, ", "), others-len(heroNames))
+	case len(heroNames) == 1:
+		return heroNames[0]
+	}
+	last := len(heroNames) - 1
+	return strings.Join(heroNames[:last], ", ") + " and " + heroNames[last]
+}
@@ -15,6 +15,7 @@
 package service
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -25,27 +26,52 @@ import (
 	"github.com/matrix-org/bullettime/utils"
 )
 
-func CreateTokenService() (interfaces.TokenService, error) {
-	return tokenService{}, nil
+func CreateTokenService(
+	users interfaces.UserStore,
+) (interfaces.TokenService, error) {
+	return tokenService{
+		users,
+	}, nil
 }
 
-type tokenService struct{}
+type tokenService struct {
+	users interfaces.UserStore
+}
 
 type tokenInfo struct {
 	userId ct.UserId
+	secret string
+	admin  bool
 }
 
 func (t tokenInfo) String() string {
 	encodedUserId := base64.RawURLEncoding.EncodeToString([]byte(t.userId.String()))
-	return fmt.Sprintf("%s..%s", encodedUserId, utils.RandomString(16))
+	return fmt.Sprintf("%s..%s", encodedUserId, t.secret)
 }
 
 func (t tokenInfo) UserId() ct.UserId {
 	return t.userId
 }
 
+func (t tokenInfo) IsAdmin() bool {
+	return t.admin
+}
+
+func (t tokenInfo) SessionId() string {
+	hash := sha256.Sum256([]byte(t.String()))
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
+}
+
 func (t tokenService) NewAccessToken(userId ct.UserId) (interfaces.Token, types.Error) {
-	return tokenInfo{userId}, nil
+	admin, err := t.users.UserIsAdmin(userId)
+	if err != nil {
+		return nil, err
+	}
+	token := tokenInfo{userId, utils.RandomString(16), admin}
+	if err := t.users.AddUserToken(userId, token.secret); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
 func (t tokenService) ParseAccessToken(token string) (interfaces.Token, types.Error) {
@@ -61,5 +87,37 @@ func (t tokenService) ParseAccessToken(token string) (interfaces.Token, types.Er
 	if err != nil {
 		return nil, types.DefaultUnknownTokenError
 	}
-	return tokenInfo{userId}, nil
+	exists, existsErr := t.users.UserTokenExists(userId, splits[1])
+	if existsErr != nil || !exists {
+		return nil, types.DefaultUnknownTokenError
+	}
+	admin, adminErr := t.users.UserIsAdmin(userId)
+	if adminErr != nil {
+		return nil, adminErr
+	}
+	return tokenInfo{userId, splits[1], admin}, nil
+}
+
+func (t tokenService) RevokeAccessToken(token interfaces.Token) types.Error {
+	info, ok := token.(tokenInfo)
+	if !ok {
+		return types.DefaultUnknownTokenError
+	}
+	return t.users.RemoveUserToken(info.userId, info.secret)
+}
+
+func (t tokenService) RevokeAllAccessTokens(user ct.UserId, except interfaces.Token) types.Error {
+	secrets, err := t.users.UserTokens(user)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if info, ok := except.(tokenInfo); ok && info.userId == user && info.secret == secret {
+			continue
+		}
+		if err := t.users.RemoveUserToken(user, secret); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -49,6 +49,13 @@ func (s userService) CreateUser(id ct.UserId) types.Error {
 }
 
 func (s userService) VerifyPassword(user ct.UserId, password string) (bool, types.Error) {
+	deactivated, err := s.users.UserDeactivated(user)
+	if err != nil {
+		return false, err
+	}
+	if deactivated {
+		return false, types.ForbiddenError("user '" + user.String() + "' has been deactivated")
+	}
 	hash, err := s.users.UserPasswordHash(user)
 	if err != nil {
 		return false, err
@@ -72,3 +79,106 @@ func (s userService) SetPassword(user, caller ct.UserId, password string) types.
 	}
 	return nil
 }
+
+func (s userService) Deactivate(user, caller ct.UserId) types.Error {
+	if user != caller {
+		return types.ForbiddenError("can't deactivate other users")
+	}
+	if err := s.users.SetUserPasswordHash(user, ""); err != nil {
+		return err
+	}
+	return s.users.SetUserDeactivated(user)
+}
+
+func (s userService) CreateGuest(id ct.UserId) types.Error {
+	if err := s.CreateUser(id); err != nil {
+		return err
+	}
+	return s.users.SetUserGuest(id, true)
+}
+
+func (s userService) CreateAdmin(id ct.UserId) types.Error {
+	if err := s.CreateUser(id); err != nil {
+		return err
+	}
+	return s.users.SetUserAdmin(id, true)
+}
+
+func (s userService) IsGuest(user, caller ct.UserId) (bool, types.Error) {
+	return s.users.UserIsGuest(user)
+}
+
+func (s userService) UpgradeGuest(user, caller ct.UserId, password string) types.Error {
+	if user != caller {
+		return types.ForbiddenError("can't upgrade other users")
+	}
+	guest, err := s.users.UserIsGuest(user)
+	if err != nil {
+		return err
+	}
+	if !guest {
+		return types.ForbiddenError("user '" + user.String() + "' is not a guest")
+	}
+	if err := s.SetPassword(user, caller, password); err != nil {
+		return err
+	}
+	return s.users.SetUserGuest(user, false)
+}
+
+func (s userService) testAdmin(caller ct.UserId) types.Error {
+	admin, err := s.users.UserIsAdmin(caller)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return types.ForbiddenError("only admins are allowed to do that")
+	}
+	return nil
+}
+
+func (s userService) Users(caller ct.UserId) ([]ct.UserId, types.Error) {
+	if err := s.testAdmin(caller); err != nil {
+		return nil, err
+	}
+	return s.users.Users()
+}
+
+func (s userService) UserInfo(user, caller ct.UserId) (*types.UserInfo, types.Error) {
+	if user != caller {
+		if err := s.testAdmin(caller); err != nil {
+			return nil, err
+		}
+	}
+	exists, err := s.users.UserExists(user)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, types.NotFoundError("user '" + user.String() + "' doesn't exist")
+	}
+	info := types.UserInfo{UserId: user}
+	if info.Admin, err = s.users.UserIsAdmin(user); err != nil {
+		return nil, err
+	}
+	if info.Guest, err = s.users.UserIsGuest(user); err != nil {
+		return nil, err
+	}
+	if info.Deactivated, err = s.users.UserDeactivated(user); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (s userService) IsAdmin(user, caller ct.UserId) (bool, types.Error) {
+	return s.users.UserIsAdmin(user)
+}
+
+func (s userService) SetAdmin(user, caller ct.UserId, admin bool) types.Error {
+	if err := s.testAdmin(caller); err != nil {
+		return err
+	}
+	if user == caller && !admin {
+		return types.ForbiddenError("admins can't demote themselves")
+	}
+	return s.users.SetUserAdmin(user, admin)
+}
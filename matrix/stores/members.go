@@ -16,6 +16,7 @@ package stores
 
 import (
 	"fmt"
+	"sync"
 	"unsafe"
 
 	ci "github.com/matrix-org/bullettime/core/interfaces"
@@ -26,10 +27,34 @@ import (
 
 type memberStore struct {
 	idMap ci.IdMultiMap
+
+	archivedLock sync.RWMutex
+	archived     map[ct.UserId]map[ct.RoomId]types.ArchivedRoom
+
+	invitesLock sync.RWMutex
+	invites     map[ct.UserId]map[ct.RoomId]struct{}
+
+	forgottenLock sync.RWMutex
+	forgotten     map[ct.UserId]map[ct.RoomId]struct{}
+
+	// joins and invites are numbered in the order they happened, so that members
+	// can be ordered by when they joined, regardless of later membership events
+	positionsLock   sync.RWMutex
+	nextPosition    uint64
+	joinPositions   map[ct.RoomId]map[ct.UserId]uint64
+	invitePositions map[ct.RoomId]map[ct.UserId]uint64
 }
 
 func NewMembershipStore(idMultiMap ci.IdMultiMap) (interfaces.MembershipStore, error) {
-	return &memberStore{idMultiMap}, nil
+	return &memberStore{
+		idMap:     idMultiMap,
+		archived:  map[ct.UserId]map[ct.RoomId]types.ArchivedRoom{},
+		invites:   map[ct.UserId]map[ct.RoomId]struct{}{},
+		forgotten: map[ct.UserId]map[ct.RoomId]struct{}{},
+
+		joinPositions:   map[ct.RoomId]map[ct.UserId]uint64{},
+		invitePositions: map[ct.RoomId]map[ct.UserId]uint64{},
+	}, nil
 }
 
 func (db *memberStore) AddMember(roomId ct.RoomId, userId ct.UserId) types.Error {
@@ -41,6 +66,7 @@ func (db *memberStore) AddMember(roomId ct.RoomId, userId ct.UserId) types.Error
 		msg := fmt.Sprintf("user %s is already a member of the room %s", userId, roomId)
 		return types.ServerError(msg)
 	}
+	db.addPosition(db.joinPositions, roomId, userId)
 	return nil
 }
 
@@ -53,6 +79,7 @@ func (db *memberStore) RemoveMember(roomId ct.RoomId, userId ct.UserId) types.Er
 		msg := fmt.Sprintf("user %s is not a member of the room %s", userId, roomId)
 		return types.ServerError(msg)
 	}
+	db.removePosition(db.joinPositions, roomId, userId)
 	return nil
 }
 
@@ -85,3 +112,192 @@ func (db *memberStore) Peers(userId ct.UserId) (map[ct.UserId]struct{}, types.Er
 	}
 	return peers, nil
 }
+
+func (db *memberStore) ArchiveRoom(userId ct.UserId, room types.ArchivedRoom) types.Error {
+	db.archivedLock.Lock()
+	defer db.archivedLock.Unlock()
+	rooms := db.archived[userId]
+	if rooms == nil {
+		rooms = map[ct.RoomId]types.ArchivedRoom{}
+		db.archived[userId] = rooms
+	}
+	rooms[room.RoomId] = room
+	return nil
+}
+
+func (db *memberStore) UnarchiveRoom(roomId ct.RoomId, userId ct.UserId) types.Error {
+	db.archivedLock.Lock()
+	defer db.archivedLock.Unlock()
+	if rooms := db.archived[userId]; rooms != nil {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.archived, userId)
+		}
+	}
+	return nil
+}
+
+func (db *memberStore) ArchivedRooms(userId ct.UserId) ([]types.ArchivedRoom, types.Error) {
+	db.archivedLock.RLock()
+	defer db.archivedLock.RUnlock()
+	rooms := make([]types.ArchivedRoom, 0, len(db.archived[userId]))
+	for _, room := range db.archived[userId] {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (db *memberStore) ArchivedUsers(roomId ct.RoomId) ([]ct.UserId, types.Error) {
+	db.archivedLock.RLock()
+	defer db.archivedLock.RUnlock()
+	users := []ct.UserId{}
+	for user, rooms := range db.archived {
+		if _, ok := rooms[roomId]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (db *memberStore) ForgetRoom(roomId ct.RoomId, userId ct.UserId) types.Error {
+	if err := db.UnarchiveRoom(roomId, userId); err != nil {
+		return err
+	}
+	db.forgottenLock.Lock()
+	defer db.forgottenLock.Unlock()
+	rooms := db.forgotten[userId]
+	if rooms == nil {
+		rooms = map[ct.RoomId]struct{}{}
+		db.forgotten[userId] = rooms
+	}
+	rooms[roomId] = struct{}{}
+	return nil
+}
+
+func (db *memberStore) RememberRoom(roomId ct.RoomId, userId ct.UserId) types.Error {
+	db.forgottenLock.Lock()
+	defer db.forgottenLock.Unlock()
+	if rooms := db.forgotten[userId]; rooms != nil {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.forgotten, userId)
+		}
+	}
+	return nil
+}
+
+func (db *memberStore) RoomForgotten(roomId ct.RoomId, userId ct.UserId) (bool, types.Error) {
+	db.forgottenLock.RLock()
+	defer db.forgottenLock.RUnlock()
+	_, forgotten := db.forgotten[userId][roomId]
+	return forgotten, nil
+}
+
+func (db *memberStore) AddInvite(roomId ct.RoomId, userId ct.UserId) types.Error {
+	db.addPosition(db.invitePositions, roomId, userId)
+	db.invitesLock.Lock()
+	defer db.invitesLock.Unlock()
+	rooms := db.invites[userId]
+	if rooms == nil {
+		rooms = map[ct.RoomId]struct{}{}
+		db.invites[userId] = rooms
+	}
+	rooms[roomId] = struct{}{}
+	return nil
+}
+
+func (db *memberStore) RemoveInvite(roomId ct.RoomId, userId ct.UserId) types.Error {
+	db.removePosition(db.invitePositions, roomId, userId)
+	db.invitesLock.Lock()
+	defer db.invitesLock.Unlock()
+	if rooms := db.invites[userId]; rooms != nil {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.invites, userId)
+		}
+	}
+	return nil
+}
+
+func (db *memberStore) InvitedRooms(userId ct.UserId) ([]ct.RoomId, types.Error) {
+	db.invitesLock.RLock()
+	defer db.invitesLock.RUnlock()
+	rooms := make([]ct.RoomId, 0, len(db.invites[userId]))
+	for room := range db.invites[userId] {
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (db *memberStore) RemoveRoom(roomId ct.RoomId) types.Error {
+	db.archivedLock.Lock()
+	for userId, rooms := range db.archived {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.archived, userId)
+		}
+	}
+	db.archivedLock.Unlock()
+	db.forgottenLock.Lock()
+	for userId, rooms := range db.forgotten {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.forgotten, userId)
+		}
+	}
+	db.forgottenLock.Unlock()
+	db.positionsLock.Lock()
+	delete(db.joinPositions, roomId)
+	delete(db.invitePositions, roomId)
+	db.positionsLock.Unlock()
+	db.invitesLock.Lock()
+	defer db.invitesLock.Unlock()
+	for userId, rooms := range db.invites {
+		delete(rooms, roomId)
+		if len(rooms) == 0 {
+			delete(db.invites, userId)
+		}
+	}
+	return nil
+}
+
+func (db *memberStore) JoinPositions(roomId ct.RoomId) (map[ct.UserId]uint64, types.Error) {
+	return db.positions(db.joinPositions, roomId), nil
+}
+
+func (db *memberStore) InvitePositions(roomId ct.RoomId) (map[ct.UserId]uint64, types.Error) {
+	return db.positions(db.invitePositions, roomId), nil
+}
+
+func (db *memberStore) addPosition(positions map[ct.RoomId]map[ct.UserId]uint64, roomId ct.RoomId, userId ct.UserId) {
+	db.positionsLock.Lock()
+	defer db.positionsLock.Unlock()
+	users := positions[roomId]
+	if users == nil {
+		users = map[ct.UserId]uint64{}
+		positions[roomId] = users
+	}
+	users[userId] = db.nextPosition
+	db.nextPosition += 1
+}
+
+func (db *memberStore) removePosition(positions map[ct.RoomId]map[ct.UserId]uint64, roomId ct.RoomId, userId ct.UserId) {
+	db.positionsLock.Lock()
+	defer db.positionsLock.Unlock()
+	if users := positions[roomId]; users != nil {
+		delete(users, userId)
+		if len(users) == 0 {
+			delete(positions, roomId)
+		}
+	}
+}
+
+func (db *memberStore) positions(positions map[ct.RoomId]map[ct.UserId]uint64, roomId ct.RoomId) map[ct.UserId]uint64 {
+	db.positionsLock.RLock()
+	defer db.positionsLock.RUnlock()
+	result := make(map[ct.UserId]uint64, len(positions[roomId]))
+	for userId, position := range positions[roomId] {
+		result[userId] = position
+	}
+	return result
+}
@@ -15,6 +15,8 @@
 package stores
 
 import (
+	"strings"
+
 	ci "github.com/matrix-org/bullettime/core/interfaces"
 	ct "github.com/matrix-org/bullettime/core/types"
 	"github.com/matrix-org/bullettime/matrix/interfaces"
@@ -26,6 +28,10 @@ type userDb struct {
 }
 
 const passwordHashKey = "pw_hash"
+const deactivatedKey = "deactivated"
+const guestKey = "guest"
+const adminKey = "admin"
+const tokenKeyPrefix = "token:"
 
 func NewUserDb(stateStore ci.StateStore) (interfaces.UserStore, error) {
 	return &userDb{stateStore}, nil
@@ -53,3 +59,94 @@ func (db *userDb) UserPasswordHash(id ct.UserId) (string, types.Error) {
 	}
 	return string(value), nil
 }
+
+func (db *userDb) SetUserDeactivated(id ct.UserId) types.Error {
+	_, err := db.SetState(ct.Id(id), deactivatedKey, []byte("true"))
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserDeactivated(id ct.UserId) (bool, types.Error) {
+	value, err := db.State(ct.Id(id), deactivatedKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return len(value) > 0, nil
+}
+
+func (db *userDb) SetUserGuest(id ct.UserId, guest bool) types.Error {
+	var value []byte
+	if guest {
+		value = []byte("true")
+	}
+	_, err := db.SetState(ct.Id(id), guestKey, value)
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserIsGuest(id ct.UserId) (bool, types.Error) {
+	value, err := db.State(ct.Id(id), guestKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return len(value) > 0, nil
+}
+
+func (db *userDb) SetUserAdmin(id ct.UserId, admin bool) types.Error {
+	var value []byte
+	if admin {
+		value = []byte("true")
+	}
+	_, err := db.SetState(ct.Id(id), adminKey, value)
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserIsAdmin(id ct.UserId) (bool, types.Error) {
+	value, err := db.State(ct.Id(id), adminKey)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return len(value) > 0, nil
+}
+
+func (db *userDb) Users() ([]ct.UserId, types.Error) {
+	ids, err := db.Buckets()
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	users := make([]ct.UserId, len(ids))
+	for i, id := range ids {
+		users[i] = ct.UserId(id)
+	}
+	return users, nil
+}
+
+func (db *userDb) AddUserToken(id ct.UserId, token string) types.Error {
+	_, err := db.SetState(ct.Id(id), tokenKeyPrefix+token, []byte("true"))
+	return types.InternalError(err)
+}
+
+func (db *userDb) RemoveUserToken(id ct.UserId, token string) types.Error {
+	_, err := db.SetState(ct.Id(id), tokenKeyPrefix+token, nil)
+	return types.InternalError(err)
+}
+
+func (db *userDb) UserTokenExists(id ct.UserId, token string) (bool, types.Error) {
+	value, err := db.State(ct.Id(id), tokenKeyPrefix+token)
+	if err != nil {
+		return false, types.InternalError(err)
+	}
+	return len(value) > 0, nil
+}
+
+func (db *userDb) UserTokens(id ct.UserId) ([]string, types.Error) {
+	states, err := db.States(ct.Id(id))
+	if err != nil {
+		return nil, types.InternalError(err)
+	}
+	tokens := []string{}
+	for _, state := range states {
+		if strings.HasPrefix(state.Key(), tokenKeyPrefix) {
+			tokens = append(tokens, strings.TrimPrefix(state.Key(), tokenKeyPrefix))
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+type LoginType string
+
+const (
+	LoginTypePassword LoginType = "m.login.password"
+	LoginTypeDummy    LoginType = "m.login.dummy"
+	LoginTypeToken    LoginType = "m.login.token"
+
+	LoginTypeRegistrationToken LoginType = "m.login.registration_token"
+)
+
+type AuthFlow struct {
+	Stages []LoginType `json:"stages,omitempty"`
+	Type   LoginType   `json:"type,omitempty"`
+}
+
+type AuthFlows struct {
+	Flows []AuthFlow `json:"flows"`
+}
+
+// The auth dictionary that is sent by the client to complete a stage
+type AuthDict struct {
+	Type     LoginType `json:"type"`
+	Session  string    `json:"session"`
+	User     string    `json:"user"`
+	Password string    `json:"password"`
+	Token    string    `json:"token"`
+}
+
+// Returned with status 401 until one of the flows has been completed
+type AuthRequiredError struct {
+	Flows        []AuthFlow             `json:"flows"`
+	Completed    []LoginType            `json:"completed"`
+	Session      string                 `json:"session"`
+	Params       map[string]interface{} `json:"params"`
+	ErrorCode    string                 `json:"errcode,omitempty"`
+	ErrorMessage string                 `json:"error,omitempty"`
+}
+
+func (e *AuthRequiredError) Code() string {
+	if e.ErrorCode == "" {
+		return "M_UNAUTHORIZED"
+	}
+	return e.ErrorCode
+}
+
+func (e *AuthRequiredError) Status() int {
+	return 401
+}
+
+func (e *AuthRequiredError) Error() string {
+	if e.ErrorMessage == "" {
+		return "additional authentication required"
+	}
+	return e.ErrorMessage
+}
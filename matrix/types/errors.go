@@ -74,6 +74,14 @@ func UserInUseError(message string) Error {
 	}
 }
 
+func InvalidUsernameError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_INVALID_USERNAME",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
 func RoomInUseError(message string) Error {
 	return apiError{
 		ErrorCode:    "M_ROOM_IN_USE",
@@ -82,6 +90,22 @@ func RoomInUseError(message string) Error {
 	}
 }
 
+func BadAliasError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_BAD_ALIAS",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
+func UnsupportedRoomVersionError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_UNSUPPORTED_ROOM_VERSION",
+		ErrorMessage: message,
+		status:       400,
+	}
+}
+
 func ForbiddenError(message string) Error {
 	return apiError{
 		ErrorCode:    "M_FORBIDDEN",
@@ -138,6 +162,14 @@ func MissingTokenError(message string) Error {
 	}
 }
 
+func LimitExceededError(message string) Error {
+	return apiError{
+		ErrorCode:    "M_LIMIT_EXCEEDED",
+		ErrorMessage: message,
+		status:       429,
+	}
+}
+
 func UnkownError(message string) Error {
 	return apiError{
 		ErrorCode:    "M_UNKNOWN",
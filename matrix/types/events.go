@@ -21,15 +21,22 @@ import (
 )
 
 const (
-	EventTypeCreate      = "m.room.create"
-	EventTypeName        = "m.room.name"
-	EventTypeTopic       = "m.room.topic"
-	EventTypeAliases     = "m.room.aliases"
-	EventTypeJoinRules   = "m.room.join_rules"
-	EventTypeMembership  = "m.room.member"
-	EventTypePowerLevels = "m.room.power_levels"
-	EventTypeTyping      = "m.typing"
-	EventTypePresence    = "m.presence"
+	EventTypeCreate            = "m.room.create"
+	EventTypeName              = "m.room.name"
+	EventTypeTopic             = "m.room.topic"
+	EventTypeAliases           = "m.room.aliases"
+	EventTypeJoinRules         = "m.room.join_rules"
+	EventTypeMembership        = "m.room.member"
+	EventTypePowerLevels       = "m.room.power_levels"
+	EventTypeGuestAccess       = "m.room.guest_access"
+	EventTypeRetention         = "m.room.retention"
+	EventTypeHistoryVisibility = "m.room.history_visibility"
+	EventTypeAvatar            = "m.room.avatar"
+	EventTypeCanonicalAlias    = "m.room.canonical_alias"
+	EventTypeTombstone         = "m.room.tombstone"
+	EventTypeRedaction         = "m.room.redaction"
+	EventTypeTyping            = "m.typing"
+	EventTypePresence          = "m.presence"
 )
 
 type Content interface{}
@@ -66,6 +73,30 @@ type Message struct {
 	RoomId    ct.RoomId    `json:"room_id"`
 	UserId    ct.UserId    `json:"user_id"`
 	Timestamp ct.Timestamp `json:"origin_server_ts"`
+	// Added to copies of the event when it is served, never set on stored events
+	Unsigned *Unsigned `json:"unsigned,omitempty"`
+	// The transaction the event was sent in, the id is only served to the session that sent it
+	Transaction *Transaction `json:"-"`
+	// The redaction event, if the event has been redacted
+	RedactedBecause Event `json:"-"`
+}
+
+// A transaction id of a client, which is scoped to the access token session that sent it
+type Transaction struct {
+	SessionId string
+	Id        string
+}
+
+// Server provided data that is added to an event when it is served to a client
+type Unsigned struct {
+	// Milliseconds since the event was sent, at the time it was served
+	Age             int64                 `json:"age"`
+	TransactionId   string                `json:"transaction_id,omitempty"`
+	PrevContent     Content               `json:"prev_content,omitempty"`
+	PrevSender      *ct.UserId            `json:"prev_sender,omitempty"`
+	ReplacesState   *ct.EventId           `json:"replaces_state,omitempty"`
+	RedactedBecause Event                 `json:"redacted_because,omitempty"`
+	Relations       *RelationsAggregation `json:"m.relations,omitempty"`
 }
 
 func (e *Message) GetContent() interface{} {
@@ -147,15 +178,42 @@ type OldState State
 
 type State struct {
 	Message
-	StateKey string    `json:"state_key"`
-	OldState *OldState `json:"prev_content"`
-}
-
-func (e *OldState) MarshalJSON() ([]byte, error) {
-	if e == nil {
-		return []byte("null"), nil
+	StateKey string `json:"state_key"`
+	// The state that this state replaced, served as unsigned prev_content
+	OldState *OldState `json:"-"`
+}
+
+// Returns empty content of the given state event type, or nil if the type doesn't have typed content
+func NewStateContent(eventType string) TypedContent {
+	switch eventType {
+	case EventTypeCreate:
+		return &CreateEventContent{}
+	case EventTypeAliases:
+		return &AliasesEventContent{}
+	case EventTypeMembership:
+		return &MembershipEventContent{}
+	case EventTypeName:
+		return &NameEventContent{}
+	case EventTypeTopic:
+		return &TopicEventContent{}
+	case EventTypeCanonicalAlias:
+		return &CanonicalAliasEventContent{}
+	case EventTypeAvatar:
+		return &AvatarEventContent{}
+	case EventTypeTombstone:
+		return &TombstoneEventContent{}
+	case EventTypePowerLevels:
+		return &PowerLevelsEventContent{}
+	case EventTypeJoinRules:
+		return &JoinRulesEventContent{}
+	case EventTypeGuestAccess:
+		return &GuestAccessEventContent{}
+	case EventTypeRetention:
+		return &RetentionEventContent{}
+	case EventTypeHistoryVisibility:
+		return &HistoryVisibilityEventContent{}
 	}
-	return json.Marshal(e.Content)
+	return nil
 }
 
 func NewGenericContent(content map[string]interface{}, eventType string) *GenericContent {
@@ -175,6 +233,15 @@ func (c *GenericContent) MarshalJSON() ([]byte, error) {
 	return json.Marshal(c.Content)
 }
 
+type RedactionEventContent struct {
+	Redacts ct.EventId `json:"redacts"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+func (c *RedactionEventContent) GetEventType() string {
+	return EventTypeRedaction
+}
+
 type TestContent struct {
 	Name string `json:"name"`
 }
@@ -182,6 +249,8 @@ type TestContent struct {
 type MembershipEventContent struct {
 	*UserProfile
 	Membership Membership `json:"membership"`
+	IsDirect   bool       `json:"is_direct,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
 }
 
 func (c *MembershipEventContent) GetEventType() string {
@@ -189,13 +258,30 @@ func (c *MembershipEventContent) GetEventType() string {
 }
 
 type CreateEventContent struct {
-	Creator ct.UserId `json:"creator"`
+	Creator     ct.UserId `json:"creator"`
+	RoomVersion string    `json:"room_version,omitempty"`
+	Federate    *bool     `json:"m.federate,omitempty"`
+	RoomType    string    `json:"type,omitempty"`
+	// Set if the room replaces a room that was upgraded
+	Predecessor *RoomPredecessor `json:"predecessor,omitempty"`
+}
+
+type RoomPredecessor struct {
+	RoomId ct.RoomId `json:"room_id"`
 }
 
 func (c *CreateEventContent) GetEventType() string {
 	return EventTypeCreate
 }
 
+// Returns the version of the room that is created with this content
+func (c *CreateEventContent) Version() (*RoomVersion, Error) {
+	if c.RoomVersion == "" {
+		return LookupRoomVersion(ImplicitRoomVersion)
+	}
+	return LookupRoomVersion(c.RoomVersion)
+}
+
 type NameEventContent struct {
 	Name string `json:"name"`
 }
@@ -212,6 +298,34 @@ func (c *TopicEventContent) GetEventType() string {
 	return EventTypeTopic
 }
 
+type CanonicalAliasEventContent struct {
+	// The canonical alias is removed by setting it to nil
+	Alias      *ct.Alias  `json:"alias,omitempty"`
+	AltAliases []ct.Alias `json:"alt_aliases,omitempty"`
+}
+
+func (c *CanonicalAliasEventContent) GetEventType() string {
+	return EventTypeCanonicalAlias
+}
+
+type AvatarEventContent struct {
+	Url  string                 `json:"url"`
+	Info map[string]interface{} `json:"info,omitempty"`
+}
+
+func (c *AvatarEventContent) GetEventType() string {
+	return EventTypeAvatar
+}
+
+type TombstoneEventContent struct {
+	Body            string    `json:"body"`
+	ReplacementRoom ct.RoomId `json:"replacement_room"`
+}
+
+func (c *TombstoneEventContent) GetEventType() string {
+	return EventTypeTombstone
+}
+
 type AliasesEventContent struct {
 	Aliases []ct.Alias `json:"aliases"`
 }
@@ -232,8 +346,14 @@ func DefaultPowerLevels(creator ct.UserId) *PowerLevelsEventContent {
 		creator.String(): 100,
 	}
 	powerLevels.Events = map[string]int{
-		"m.room.name":         100,
-		"m.room.power_levels": 100,
+		"m.room.name":               100,
+		"m.room.power_levels":       100,
+		"m.room.guest_access":       50,
+		"m.room.retention":          100,
+		"m.room.history_visibility": 100,
+		"m.room.canonical_alias":    50,
+		"m.room.avatar":             50,
+		"m.room.tombstone":          100,
 	}
 	return powerLevels
 }
@@ -250,11 +370,23 @@ type PowerLevelsEventContent struct {
 	Events       map[string]int    `json:"events"`
 }
 
+// Replaces the top level keys of the power levels that are present in the override
+func (c *PowerLevelsEventContent) Override(override json.RawMessage) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(override, &keys); err != nil {
+		return err
+	}
+	if _, ok := keys["events"]; ok {
+		c.Events = nil
+	}
+	return json.Unmarshal(override, c)
+}
+
 type UserPowerLevelMap map[string]int
 
 func (m *UserPowerLevelMap) UnmarshalJSON(bytes []byte) error {
 	userMap := map[string]int{}
-	err := json.Unmarshal(bytes, userMap)
+	err := json.Unmarshal(bytes, &userMap)
 	if err != nil {
 		return err
 	}
@@ -274,8 +406,43 @@ func (c *PowerLevelsEventContent) GetEventType() string {
 
 type JoinRulesEventContent struct {
 	JoinRule JoinRule `json:"join_rule"`
+	// Only used by the restricted join rule
+	Allow []JoinRuleCondition `json:"allow,omitempty"`
+}
+
+const JoinRuleConditionRoomMembership = "m.room_membership"
+
+type JoinRuleCondition struct {
+	Type   string    `json:"type"`
+	RoomId ct.RoomId `json:"room_id"`
 }
 
 func (c *JoinRulesEventContent) GetEventType() string {
 	return EventTypeJoinRules
 }
+
+type GuestAccessEventContent struct {
+	GuestAccess GuestAccess `json:"guest_access"`
+}
+
+func (c *GuestAccessEventContent) GetEventType() string {
+	return EventTypeGuestAccess
+}
+
+type HistoryVisibilityEventContent struct {
+	HistoryVisibility HistoryVisibility `json:"history_visibility"`
+}
+
+func (c *HistoryVisibilityEventContent) GetEventType() string {
+	return EventTypeHistoryVisibility
+}
+
+type RetentionEventContent struct {
+	// Milliseconds
+	MaxLifetime *uint64 `json:"max_lifetime,omitempty"`
+	MaxCount    *uint   `json:"max_count,omitempty"`
+}
+
+func (c *RetentionEventContent) GetEventType() string {
+	return EventTypeRetention
+}
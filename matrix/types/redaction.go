@@ -0,0 +1,80 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+)
+
+// Strips the content down to the keys that the room version keeps for the event type when it's redacted
+func RedactContent(version *RoomVersion, eventType string, content Content) (TypedContent, Error) {
+	kept := map[string]json.RawMessage{}
+	if keys := version.RedactionKeptKeys[eventType]; len(keys) > 0 {
+		bytes, err := json.Marshal(content)
+		if err != nil {
+			return nil, ServerError("failed to serialize content: " + err.Error())
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(bytes, &fields); err != nil {
+			return nil, ServerError("failed to read content: " + err.Error())
+		}
+		for _, key := range keys {
+			if value, ok := fields[key]; ok {
+				kept[key] = value
+			}
+		}
+	}
+	bytes, err := json.Marshal(kept)
+	if err != nil {
+		return nil, ServerError("failed to serialize redacted content: " + err.Error())
+	}
+	if typed := NewStateContent(eventType); typed != nil {
+		if err := json.Unmarshal(bytes, typed); err != nil {
+			return nil, ServerError("failed to read redacted content: " + err.Error())
+		}
+		return typed, nil
+	}
+	generic := NewGenericContent(map[string]interface{}{}, eventType)
+	if err := json.Unmarshal(bytes, &generic.Content); err != nil {
+		return nil, ServerError("failed to read redacted content: " + err.Error())
+	}
+	return generic, nil
+}
+
+// Returns a redacted copy of the event using the redaction algorithm of the room version,
+// events that can't be redacted are returned as they are
+func Redact(version *RoomVersion, event Event, because Event) (Event, Error) {
+	switch e := event.(type) {
+	case *Message:
+		content, err := RedactContent(version, e.EventType, e.Content)
+		if err != nil {
+			return nil, err
+		}
+		message := *e
+		message.Content = content
+		message.RedactedBecause = because
+		return &message, nil
+	case *State:
+		content, err := RedactContent(version, e.EventType, e.Content)
+		if err != nil {
+			return nil, err
+		}
+		state := *e
+		state.Content = content
+		state.RedactedBecause = because
+		return &state, nil
+	}
+	return event, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+)
+
+type RegistrationMode int
+
+const (
+	RegistrationModeOpen         RegistrationMode = 0
+	RegistrationModeClosed       RegistrationMode = 1
+	RegistrationModeToken        RegistrationMode = 2
+	RegistrationModeSharedSecret RegistrationMode = 3
+)
+
+func ParseRegistrationMode(str string) (RegistrationMode, error) {
+	switch str {
+	case "open":
+		return RegistrationModeOpen, nil
+	case "closed":
+		return RegistrationModeClosed, nil
+	case "token":
+		return RegistrationModeToken, nil
+	case "shared_secret":
+		return RegistrationModeSharedSecret, nil
+	}
+	return RegistrationModeClosed, errors.New("invalid registration mode: " + str)
+}
+
+func (m RegistrationMode) String() string {
+	switch m {
+	case RegistrationModeOpen:
+		return "open"
+	case RegistrationModeClosed:
+		return "closed"
+	case RegistrationModeToken:
+		return "token"
+	case RegistrationModeSharedSecret:
+		return "shared_secret"
+	}
+	return ""
+}
+
+func (m RegistrationMode) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", m.String())), nil
+}
+
+type RegistrationConfig struct {
+	Mode RegistrationMode
+	// Used to verify registrations in shared secret mode
+	SharedSecret       string
+	AllowGuests        bool
+	MinLocalpartLength int
+	MaxLocalpartLength int
+	ReservedLocalparts []string
+	ReservedPrefixes   []string
+}
+
+func DefaultRegistrationConfig() RegistrationConfig {
+	return RegistrationConfig{
+		Mode:               RegistrationModeOpen,
+		MinLocalpartLength: 1,
+		MaxLocalpartLength: 64,
+		ReservedPrefixes:   []string{"_"},
+	}
+}
+
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// Unlimited if nil
+	UsesAllowed *uint `json:"uses_allowed"`
+	Completed   uint  `json:"completed"`
+	// Never expires if nil
+	ExpiryTime *ct.Timestamp `json:"expiry_time"`
+}
+
+func (t *RegistrationToken) Valid(now time.Time) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	if t.ExpiryTime != nil && !now.Before(t.ExpiryTime.Time) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	ct "github.com/matrix-org/bullettime/core/types"
+)
+
+const (
+	RelationAnnotation = "m.annotation"
+	RelationReplace    = "m.replace"
+	RelationReference  = "m.reference"
+	RelationThread     = "m.thread"
+)
+
+// The m.relates_to section of the content of an event that relates to another event
+type RelatesTo struct {
+	RelType string     `json:"rel_type"`
+	EventId ct.EventId `json:"event_id"`
+	// The annotation, only used with m.annotation
+	Key string `json:"key,omitempty"`
+}
+
+// Reads the m.relates_to section of the content, returns nil if the content doesn't relate to another event
+func ContentRelation(content Content) (*RelatesTo, Error) {
+	generic, ok := content.(*GenericContent)
+	if !ok {
+		return nil, nil
+	}
+	raw, ok := generic.Content["m.relates_to"]
+	if !ok {
+		return nil, nil
+	}
+	fields, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, BadJsonError("m.relates_to must be an object")
+	}
+	relType, _ := fields["rel_type"].(string)
+	if relType == "" {
+		return nil, BadJsonError("m.relates_to is missing rel_type")
+	}
+	eventIdStr, _ := fields["event_id"].(string)
+	eventId, err := ct.ParseEventId(eventIdStr)
+	if err != nil {
+		return nil, BadJsonError("invalid m.relates_to event_id: " + err.Error())
+	}
+	relation := RelatesTo{RelType: relType, EventId: eventId}
+	if relType == RelationAnnotation {
+		key, _ := fields["key"].(string)
+		if key == "" {
+			return nil, BadJsonError("m.annotation relation is missing key")
+		}
+		relation.Key = key
+	}
+	return &relation, nil
+}
+
+// Summary of the events that relate to an event
+type RelationsAggregation struct {
+	Annotation *AnnotationAggregation `json:"m.annotation,omitempty"`
+	// The most recent edit of the event
+	Replace Event              `json:"m.replace,omitempty"`
+	Thread  *ThreadAggregation `json:"m.thread,omitempty"`
+}
+
+type AnnotationAggregation struct {
+	Chunk []AnnotationCount `json:"chunk"`
+}
+
+type AnnotationCount struct {
+	EventType string `json:"type"`
+	Key       string `json:"key"`
+	Count     int    `json:"count"`
+}
+
+// Summary of the thread that has the event as its root
+type ThreadAggregation struct {
+	LatestEvent Event `json:"latest_event"`
+	Count       int   `json:"count"`
+	// Whether the user that the event is served to has sent the root or a reply of the thread
+	CurrentUserParticipated bool `json:"current_user_participated"`
+}
+
+// A page of events that relate to an event or of thread roots, with a token for the next page if there might be more
+type RelationsChunk struct {
+	Events    []Event      `json:"chunk"`
+	NextBatch *StreamToken `json:"next_batch,omitempty"`
+}
+
+// Returns a copy of the event with the unsigned data replaced, events that can't carry unsigned data
+// are returned as they are
+func WithUnsigned(event Event, unsigned *Unsigned) Event {
+	switch e := event.(type) {
+	case *Message:
+		message := *e
+		message.Unsigned = unsigned
+		return &message
+	case *State:
+		state := *e
+		state.Unsigned = unsigned
+		return &state
+	}
+	return event
+}
@@ -0,0 +1,41 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "time"
+
+// Zero values mean that there is no limit
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxCount uint
+}
+
+func (p RetentionPolicy) Unlimited() bool {
+	return p.MaxAge == 0 && p.MaxCount == 0
+}
+
+// Returns the policy with the limits that are set in the room's retention content applied
+func (p RetentionPolicy) WithRoomPolicy(content *RetentionEventContent) RetentionPolicy {
+	if content == nil {
+		return p
+	}
+	if content.MaxLifetime != nil {
+		p.MaxAge = time.Duration(*content.MaxLifetime) * time.Millisecond
+	}
+	if content.MaxCount != nil {
+		p.MaxCount = *content.MaxCount
+	}
+	return p
+}
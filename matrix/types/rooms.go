@@ -15,6 +15,7 @@
 package types
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -22,11 +23,75 @@ import (
 )
 
 type RoomDescription struct {
-	Visibility Visibility  `json:"visibility"`
-	Alias      *string     `json:"room_alias_name"`
-	Name       *string     `json:"name"`
-	Topic      *string     `json:"topic"`
-	Invited    []ct.UserId `json:"invite"`
+	Visibility   Visibility     `json:"visibility"`
+	Alias        *string        `json:"room_alias_name"`
+	Name         *string        `json:"name"`
+	Topic        *string        `json:"topic"`
+	Invited      []ct.UserId    `json:"invite"`
+	Preset       RoomPreset     `json:"preset"`
+	InitialState []InitialState `json:"initial_state"`
+	// Top level keys replace those of the default power levels
+	PowerLevelContentOverride json.RawMessage     `json:"power_level_content_override"`
+	CreationContent           *CreateEventContent `json:"creation_content"`
+	IsDirect                  bool                `json:"is_direct"`
+	// The default room version is used if empty
+	RoomVersion string `json:"room_version"`
+}
+
+// A state event that is set when the room is created
+type InitialState struct {
+	EventType string
+	StateKey  string
+	Content   TypedContent
+}
+
+func (s *InitialState) UnmarshalJSON(bytes []byte) error {
+	var raw struct {
+		EventType string          `json:"type"`
+		StateKey  string          `json:"state_key"`
+		Content   json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return err
+	}
+	if raw.EventType == "" {
+		return errors.New("missing type of initial state")
+	}
+	content := NewStateContent(raw.EventType)
+	if content == nil {
+		genericContent := NewGenericContent(map[string]interface{}{}, raw.EventType)
+		content = genericContent
+		if err := json.Unmarshal(raw.Content, &genericContent.Content); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(raw.Content, content); err != nil {
+		return err
+	}
+	s.EventType = raw.EventType
+	s.StateKey = raw.StateKey
+	s.Content = content
+	return nil
+}
+
+// A room as it is listed in the public room directory
+type PublicRoom struct {
+	RoomId           ct.RoomId  `json:"room_id"`
+	Name             *string    `json:"name,omitempty"`
+	Topic            *string    `json:"topic,omitempty"`
+	CanonicalAlias   *ct.Alias  `json:"canonical_alias,omitempty"`
+	Aliases          []ct.Alias `json:"aliases,omitempty"`
+	AvatarUrl        string     `json:"avatar_url,omitempty"`
+	NumJoinedMembers int        `json:"num_joined_members"`
+	WorldReadable    bool       `json:"world_readable"`
+	GuestCanJoin     bool       `json:"guest_can_join"`
+}
+
+// A room that a user has left, as it was when the user left
+type ArchivedRoom struct {
+	RoomId ct.RoomId
+	// The stream position right after the event with which the user left
+	End   uint64
+	State []*State
 }
 
 type Visibility int
@@ -39,11 +104,37 @@ const (
 type JoinRule int
 
 const (
-	JoinRuleNone    JoinRule = 0
-	JoinRulePublic  JoinRule = 1
-	JoinRuleInvite  JoinRule = 2
-	JoinRulePrivate JoinRule = 3
-	JoinRuleKnock   JoinRule = 4
+	JoinRuleNone       JoinRule = 0
+	JoinRulePublic     JoinRule = 1
+	JoinRuleInvite     JoinRule = 2
+	JoinRulePrivate    JoinRule = 3
+	JoinRuleKnock      JoinRule = 4
+	JoinRuleRestricted JoinRule = 5
+)
+
+type RoomPreset int
+
+const (
+	RoomPresetNone               RoomPreset = 0
+	RoomPresetPrivateChat        RoomPreset = 1
+	RoomPresetTrustedPrivateChat RoomPreset = 2
+	RoomPresetPublicChat         RoomPreset = 3
+)
+
+type GuestAccess int
+
+const (
+	GuestAccessForbidden GuestAccess = 0
+	GuestAccessCanJoin   GuestAccess = 1
+)
+
+type HistoryVisibility int
+
+const (
+	HistoryVisibilityShared        HistoryVisibility = 0
+	HistoryVisibilityInvited       HistoryVisibility = 1
+	HistoryVisibilityJoined        HistoryVisibility = 2
+	HistoryVisibilityWorldReadable HistoryVisibility = 3
 )
 
 type Membership int
@@ -65,6 +156,14 @@ func (v Visibility) ToJoinRule() JoinRule {
 	}
 }
 
+func (v Visibility) ToPreset() RoomPreset {
+	if v == VisibilityPublic {
+		return RoomPresetPublicChat
+	} else {
+		return RoomPresetPrivateChat
+	}
+}
+
 func (v *Visibility) UnmarshalJSON(bytes []byte) error {
 	str := string(bytes)
 	switch str {
@@ -104,6 +203,9 @@ func (j *JoinRule) UnmarshalJSON(bytes []byte) error {
 	case "\"knock\"":
 		*j = JoinRuleKnock
 		return nil
+	case "\"restricted\"":
+		*j = JoinRuleRestricted
+		return nil
 	}
 	return errors.New("invalid join rule: " + str)
 }
@@ -118,6 +220,8 @@ func (j JoinRule) String() string {
 		return "private"
 	case JoinRuleKnock:
 		return "knock"
+	case JoinRuleRestricted:
+		return "restricted"
 	}
 	return ""
 }
@@ -130,6 +234,104 @@ func (j JoinRule) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%s\"", str)), nil
 }
 
+func (p *RoomPreset) UnmarshalJSON(bytes []byte) error {
+	str := string(bytes)
+	switch str {
+	case "null":
+		*p = RoomPresetNone
+		return nil
+	case "\"private_chat\"":
+		*p = RoomPresetPrivateChat
+		return nil
+	case "\"trusted_private_chat\"":
+		*p = RoomPresetTrustedPrivateChat
+		return nil
+	case "\"public_chat\"":
+		*p = RoomPresetPublicChat
+		return nil
+	}
+	return errors.New("invalid preset: " + str)
+}
+
+func (p RoomPreset) String() string {
+	switch p {
+	case RoomPresetPrivateChat:
+		return "private_chat"
+	case RoomPresetTrustedPrivateChat:
+		return "trusted_private_chat"
+	case RoomPresetPublicChat:
+		return "public_chat"
+	}
+	return ""
+}
+
+func (p RoomPreset) MarshalJSON() ([]byte, error) {
+	str := p.String()
+	if str == "" {
+		return []byte("null"), nil
+	}
+	return []byte(fmt.Sprintf("\"%s\"", str)), nil
+}
+
+func (g *GuestAccess) UnmarshalJSON(bytes []byte) error {
+	str := string(bytes)
+	switch str {
+	case "\"forbidden\"":
+		*g = GuestAccessForbidden
+		return nil
+	case "\"can_join\"":
+		*g = GuestAccessCanJoin
+		return nil
+	}
+	return errors.New("invalid guest access: " + str)
+}
+
+func (g GuestAccess) String() string {
+	if g == GuestAccessCanJoin {
+		return "can_join"
+	}
+	return "forbidden"
+}
+
+func (g GuestAccess) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", g.String())), nil
+}
+
+func (h *HistoryVisibility) UnmarshalJSON(bytes []byte) error {
+	str := string(bytes)
+	switch str {
+	case "\"shared\"":
+		*h = HistoryVisibilityShared
+		return nil
+	case "\"invited\"":
+		*h = HistoryVisibilityInvited
+		return nil
+	case "\"joined\"":
+		*h = HistoryVisibilityJoined
+		return nil
+	case "\"world_readable\"":
+		*h = HistoryVisibilityWorldReadable
+		return nil
+	}
+	return errors.New("invalid history visibility: " + str)
+}
+
+func (h HistoryVisibility) String() string {
+	switch h {
+	case HistoryVisibilityInvited:
+		return "invited"
+	case HistoryVisibilityJoined:
+		return "joined"
+	case HistoryVisibilityWorldReadable:
+		return "world_readable"
+	}
+	return "shared"
+}
+
+func (h HistoryVisibility) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", h.String())), nil
+}
+
 func (m *Membership) UnmarshalJSON(bytes []byte) error {
 	str := string(bytes)
 	switch str {
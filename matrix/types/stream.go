@@ -27,12 +27,26 @@ type InitialSync struct {
 	Rooms    []RoomSummary `json:"rooms"`
 }
 
+type RoomMemberSummary struct {
+	Heroes             []ct.UserId `json:"m.heroes"`
+	JoinedMemberCount  int         `json:"m.joined_member_count"`
+	InvitedMemberCount int         `json:"m.invited_member_count"`
+}
+
 type RoomSummary struct {
-	Membership Membership        `json:"membership"`
-	RoomId     ct.RoomId         `json:"room_id"`
-	Messages   *EventStreamRange `json:"messages"`
-	State      []*State          `json:"state"`
-	Visibility Visibility        `json:"visibility"`
+	Membership     Membership        `json:"membership"`
+	RoomId         ct.RoomId         `json:"room_id"`
+	Messages       *EventStreamRange `json:"messages"`
+	State          []*State          `json:"state"`
+	Visibility     Visibility        `json:"visibility"`
+	CanonicalAlias *ct.Alias         `json:"canonical_alias,omitempty"`
+	AvatarUrl      string            `json:"avatar_url,omitempty"`
+	// The display name of the room, computed from its name, canonical alias or members
+	Name    string            `json:"name"`
+	Summary RoomMemberSummary `json:"summary"`
+	// Only set for rooms that the user is invited to
+	Inviter     *ct.UserId `json:"inviter,omitempty"`
+	InviteState []*State   `json:"invite_state,omitempty"`
 }
 
 type RoomInitialSync struct {
@@ -44,6 +58,8 @@ type EventStreamRange struct {
 	Events []Event     `json:"chunk"`
 	Start  StreamToken `json:"start"`
 	End    StreamToken `json:"end"`
+	// Set if history has been purged, events before this token are no longer available
+	HistoryStart *StreamToken `json:"history_start,omitempty"`
 }
 
 type StreamToken struct {
@@ -62,6 +78,25 @@ func (t StreamToken) String() string {
 	return fmt.Sprintf("s%d_%d_%d", t.MessageIndex, t.PresenceIndex, t.TypingIndex)
 }
 
+// Options that limit the events that are returned from a room timeline
+type RoomEventFilter struct {
+	// Leaves thread replies out, so that only the main timeline of the room is returned
+	NotInThread bool `json:"not_in_thread,omitempty"`
+}
+
+// Whether the event passes the filter, a nil filter lets all events through
+func (f *RoomEventFilter) Matches(event Event) bool {
+	if f == nil {
+		return true
+	}
+	if f.NotInThread {
+		if relation, _ := ContentRelation(event.GetContent()); relation != nil && relation.RelType == RelationThread {
+			return false
+		}
+	}
+	return true
+}
+
 func NewEventStreamRange(events []Event, start StreamToken, end StreamToken) *EventStreamRange {
 	return &EventStreamRange{
 		Events: events,
@@ -50,6 +50,13 @@ type User struct {
 	UserId ct.UserId `json:"user_id"`
 }
 
+type UserInfo struct {
+	UserId      ct.UserId `json:"user_id"`
+	Admin       bool      `json:"admin"`
+	Guest       bool      `json:"guest"`
+	Deactivated bool      `json:"deactivated"`
+}
+
 func (p *Presence) UnmarshalJSON(bytes []byte) error {
 	str := string(bytes)
 	switch str {
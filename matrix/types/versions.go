@@ -0,0 +1,134 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"sort"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/utils"
+)
+
+const (
+	// The version of rooms whose create event doesn't specify one
+	ImplicitRoomVersion = "1"
+	// The version of new rooms, unless another version is requested
+	DefaultRoomVersion = "8"
+)
+
+type EventIdFormat int
+
+const (
+	// $opaque_id:domain, with the domain of the sender
+	EventIdFormatServerName EventIdFormat = iota
+)
+
+// The behaviours that differ between room versions. Rules are only ever added as new versions,
+// so that existing rooms keep the behaviour they were created with
+type RoomVersion struct {
+	Id string
+	// Whether the knock join rule and knock memberships are allowed
+	KnockingAllowed bool
+	// Whether the restricted join rule is allowed
+	RestrictedJoinsAllowed bool
+	// The content keys that are kept when an event is redacted, the rest of the content is removed
+	RedactionKeptKeys map[string][]string
+	EventIdFormat     EventIdFormat
+}
+
+func (v *RoomVersion) NewEventId(sender ct.UserId) ct.EventId {
+	switch v.EventIdFormat {
+	case EventIdFormatServerName:
+		return ct.DeriveEventId(utils.RandomString(16), ct.Id(sender))
+	}
+	panic("unknown event id format in room version " + v.Id)
+}
+
+// Whether the join rule may be used in rooms of this version
+func (v *RoomVersion) JoinRuleAllowed(joinRule JoinRule) bool {
+	switch joinRule {
+	case JoinRuleKnock:
+		return v.KnockingAllowed
+	case JoinRuleRestricted:
+		return v.RestrictedJoinsAllowed
+	}
+	return true
+}
+
+// Only the versions whose differences matter to this server are registered
+var roomVersions = map[string]*RoomVersion{
+	"1": &RoomVersion{
+		Id: "1",
+		RedactionKeptKeys: map[string][]string{
+			EventTypeMembership:        {"membership"},
+			EventTypeCreate:            {"creator"},
+			EventTypeJoinRules:         {"join_rule"},
+			EventTypeAliases:           {"aliases"},
+			EventTypeHistoryVisibility: {"history_visibility"},
+			EventTypePowerLevels: {
+				"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default",
+			},
+		},
+		EventIdFormat: EventIdFormatServerName,
+	},
+	"7": &RoomVersion{
+		Id:              "7",
+		KnockingAllowed: true,
+		// the aliases are no longer kept since version 6
+		RedactionKeptKeys: map[string][]string{
+			EventTypeMembership:        {"membership"},
+			EventTypeCreate:            {"creator"},
+			EventTypeJoinRules:         {"join_rule"},
+			EventTypeHistoryVisibility: {"history_visibility"},
+			EventTypePowerLevels: {
+				"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default",
+			},
+		},
+		EventIdFormat: EventIdFormatServerName,
+	},
+	"8": &RoomVersion{
+		Id:                     "8",
+		KnockingAllowed:        true,
+		RestrictedJoinsAllowed: true,
+		RedactionKeptKeys: map[string][]string{
+			EventTypeMembership:        {"membership"},
+			EventTypeCreate:            {"creator"},
+			EventTypeJoinRules:         {"join_rule", "allow"},
+			EventTypeHistoryVisibility: {"history_visibility"},
+			EventTypePowerLevels: {
+				"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default",
+			},
+		},
+		EventIdFormat: EventIdFormatServerName,
+	},
+}
+
+func LookupRoomVersion(id string) (*RoomVersion, Error) {
+	version, ok := roomVersions[id]
+	if !ok {
+		return nil, UnsupportedRoomVersionError("unsupported room version: " + id)
+	}
+	return version, nil
+}
+
+// The ids of all supported room versions, in ascending order
+func RoomVersionIds() []string {
+	ids := make([]string, 0, len(roomVersions))
+	for id := range roomVersions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,117 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func TestAdminRoomModeration(t *testing.T) {
+	s := setup()
+	admin := ct.NewUserId("admin", "matrix.org")
+	creator := ct.NewUserId("creator", "matrix.org")
+	member := ct.NewUserId("member", "matrix.org")
+	if err := s.user.CreateAdmin(admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateUser(member); err != nil {
+		t.Fatal(err)
+	}
+	aliasName := "abandoned"
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, Alias: &aliasName}
+	room, alias, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, member, join, member.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.room.AdminState(room, creator); err == nil {
+		t.Fatal("expected M_FORBIDDEN when reading state as non-admin")
+	}
+	state, err := s.room.AdminState(room, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) == 0 {
+		t.Error("expected admin to see the room state")
+	}
+	members, err := s.room.AdminMembers(room, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Error("expected 2 members, got ", members)
+	}
+
+	if _, err := s.room.AdminJoin(room, admin); err == nil {
+		t.Fatal("expected M_FORBIDDEN when joining a room that isn't abandoned")
+	}
+	leave := &types.MembershipEventContent{Membership: types.MembershipLeaving}
+	if _, err := s.room.SetState(room, creator, leave, creator.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.AdminJoin(room, admin); err != nil {
+		t.Fatal("expected admin to be able to join abandoned room, got ", err)
+	}
+	name := &types.NameEventContent{Name: "rescued"}
+	if _, err := s.room.SetState(room, admin, name, ""); err != nil {
+		t.Error("expected admin to be able to set room name after joining, got ", err)
+	}
+
+	if err := s.room.PurgeRoom(room, member); err == nil {
+		t.Fatal("expected M_FORBIDDEN when purging as non-admin")
+	}
+	if err := s.room.PurgeRoom(room, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.RoomExists(room, admin); err == nil {
+		t.Error("expected room to be removed")
+	}
+	if _, err := s.room.LookupAlias(*alias); err == nil {
+		t.Error("expected room alias to be removed")
+	}
+	rooms, err := s.room.JoinedRooms(member, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 0 {
+		t.Error("expected member to be kicked from purged room, got ", rooms)
+	}
+
+	// the admin doesn't need to be in the room or have any power in it
+	other, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.PurgeRoom(other, admin); err != nil {
+		t.Fatal("expected admin to be able to purge a room they are not in, got ", err)
+	}
+	rooms, err = s.room.JoinedRooms(creator, creator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 0 {
+		t.Error("expected creator to be kicked from purged room, got ", rooms)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func createRoomFromJson(t *testing.T, s services, creator ct.UserId, body string) (ct.RoomId, types.Error) {
+	var desc types.RoomDescription
+	if err := json.Unmarshal([]byte(body), &desc); err != nil {
+		t.Fatal(err)
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	return room, err
+}
+
+func roomState(t *testing.T, s services, room ct.RoomId, user ct.UserId, eventType, stateKey string) *types.State {
+	state, err := s.room.State(room, user, eventType, stateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil {
+		t.Fatal("expected state ", eventType, " to be set")
+	}
+	return state
+}
+
+func TestRoomPresets(t *testing.T) {
+	cases := []struct {
+		body              string
+		joinRule          types.JoinRule
+		historyVisibility types.HistoryVisibility
+		guestAccess       types.GuestAccess
+	}{
+		{`{}`, types.JoinRuleInvite, types.HistoryVisibilityShared, types.GuestAccessCanJoin},
+		{`{"visibility": "public"}`, types.JoinRulePublic, types.HistoryVisibilityShared, types.GuestAccessForbidden},
+		{`{"preset": "private_chat"}`, types.JoinRuleInvite, types.HistoryVisibilityShared, types.GuestAccessCanJoin},
+		{`{"preset": "trusted_private_chat"}`, types.JoinRuleInvite, types.HistoryVisibilityShared, types.GuestAccessCanJoin},
+		{`{"preset": "public_chat"}`, types.JoinRulePublic, types.HistoryVisibilityShared, types.GuestAccessForbidden},
+		{`{"visibility": "public", "preset": "private_chat"}`, types.JoinRuleInvite, types.HistoryVisibilityShared, types.GuestAccessCanJoin},
+	}
+	for _, c := range cases {
+		s := setup()
+		creator := ct.NewUserId("creator", "matrix.org")
+		if err := s.user.CreateUser(creator); err != nil {
+			t.Fatal(err)
+		}
+		room, err := createRoomFromJson(t, s, creator, c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		joinRules := roomState(t, s, room, creator, types.EventTypeJoinRules, "").Content.(*types.JoinRulesEventContent)
+		if joinRules.JoinRule != c.joinRule {
+			t.Errorf("expected join rule of %s to be %s, got %s", c.body, c.joinRule, joinRules.JoinRule)
+		}
+		historyVisibility := roomState(t, s, room, creator, types.EventTypeHistoryVisibility, "").Content.(*types.HistoryVisibilityEventContent)
+		if historyVisibility.HistoryVisibility != c.historyVisibility {
+			t.Errorf("expected history visibility of %s to be %s, got %s", c.body, c.historyVisibility, historyVisibility.HistoryVisibility)
+		}
+		guestAccess := roomState(t, s, room, creator, types.EventTypeGuestAccess, "").Content.(*types.GuestAccessEventContent)
+		if guestAccess.GuestAccess != c.guestAccess {
+			t.Errorf("expected guest access of %s to be %s, got %s", c.body, c.guestAccess, guestAccess.GuestAccess)
+		}
+	}
+}
+
+func TestCreateRoomOptions(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	friend := ct.NewUserId("friend", "matrix.org")
+	for _, user := range []ct.UserId{creator, friend} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, err := createRoomFromJson(t, s, creator, `{
+		"preset": "trusted_private_chat",
+		"invite": ["@friend:matrix.org"],
+		"is_direct": true,
+		"topic": "from description",
+		"initial_state": [
+			{"type": "m.room.topic", "content": {"topic": "from initial state"}},
+			{"type": "m.room.history_visibility", "content": {"history_visibility": "joined"}},
+			{"type": "org.example.custom", "state_key": "key", "content": {"value": 1}}
+		],
+		"power_level_content_override": {"ban": 10, "events": {"m.room.topic": 75}},
+		"creation_content": {"m.federate": false}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := roomState(t, s, room, creator, types.EventTypeTopic, "").Content.(*types.TopicEventContent)
+	if topic.Topic != "from description" {
+		t.Error("expected topic of the description to take precedence, got ", topic.Topic)
+	}
+	historyVisibility := roomState(t, s, room, creator, types.EventTypeHistoryVisibility, "").Content.(*types.HistoryVisibilityEventContent)
+	if historyVisibility.HistoryVisibility != types.HistoryVisibilityJoined {
+		t.Error("expected initial state to take precedence over the preset, got ", historyVisibility.HistoryVisibility)
+	}
+	custom := roomState(t, s, room, creator, "org.example.custom", "key").Content.(*types.GenericContent)
+	if custom.Content["value"] != float64(1) {
+		t.Error("expected custom initial state to be set, got ", custom.Content)
+	}
+	powerLevels := roomState(t, s, room, creator, types.EventTypePowerLevels, "").Content.(*types.PowerLevelsEventContent)
+	if powerLevels.Ban != 10 || powerLevels.Kick != 50 {
+		t.Error("expected only overridden power levels to change, got ban ", powerLevels.Ban, " and kick ", powerLevels.Kick)
+	}
+	if len(powerLevels.Events) != 1 || powerLevels.Events[types.EventTypeTopic] != 75 {
+		t.Error("expected event power levels to be replaced, got ", powerLevels.Events)
+	}
+	if powerLevels.Users[friend.String()] != 100 {
+		t.Error("expected invitee of trusted private chat to have the power level of the creator, got ", powerLevels.Users)
+	}
+	create := roomState(t, s, room, creator, types.EventTypeCreate, "").Content.(*types.CreateEventContent)
+	if create.Creator != creator || create.Federate == nil || *create.Federate {
+		t.Error("expected creation content to be included in the create event, got ", create)
+	}
+	invite := roomState(t, s, room, creator, types.EventTypeMembership, friend.String()).Content.(*types.MembershipEventContent)
+	if invite.Membership != types.MembershipInvited || !invite.IsDirect {
+		t.Error("expected direct invite, got ", invite)
+	}
+	sync, err := s.sync.FullSync(friend, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipInvited {
+		t.Error("expected invite to be included in the sync of the invitee, got ", sync.Rooms)
+	}
+
+	aliased, err := createRoomFromJson(t, s, creator, `{
+		"room_alias_name": "own",
+		"initial_state": [{"type": "m.room.canonical_alias", "content": {"alias": "#own:matrix.org"}}]
+	}`)
+	if err != nil {
+		t.Fatal("expected canonical alias of the alias of the new room to be allowed, got ", err)
+	}
+	canonicalAlias := roomState(t, s, aliased, creator, types.EventTypeCanonicalAlias, "").Content.(*types.CanonicalAliasEventContent)
+	if canonicalAlias.Alias == nil || canonicalAlias.Alias.String() != "#own:matrix.org" {
+		t.Error("expected canonical alias to be set, got ", canonicalAlias.Alias)
+	}
+
+	for _, body := range []string{
+		`{"initial_state": [{"type": "m.room.member", "state_key": "@friend:matrix.org", "content": {"membership": "join"}}]}`,
+		`{"initial_state": [{"type": "m.room.power_levels", "content": {}}]}`,
+		`{"power_level_content_override": []}`,
+		`{"initial_state": [{"type": "m.room.canonical_alias", "content": {"alias": "#own:matrix.org"}}]}`,
+		`{"initial_state": [{"type": "m.room.name", "state_key": "key", "content": {"name": "name"}}]}`,
+		`{"initial_state": [{"type": "org.example.custom", "state_key": "@friend:matrix.org", "content": {}}]}`,
+		`{"initial_state": [{"type": "m.room.join_rules", "content": {"join_rule": "restricted", "allow": [{"type": "m.unknown"}]}}]}`,
+	} {
+		if _, err := createRoomFromJson(t, s, creator, body); err == nil {
+			t.Error("expected room creation to be rejected: ", body)
+		}
+	}
+}
+
+func TestCreateRoomRollback(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	invitee := ct.NewUserId("invitee", "matrix.org")
+	for _, user := range []ct.UserId{creator, invitee} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := createRoomFromJson(t, s, creator, `{"room_alias_name": "taken"}`); err != nil {
+		t.Fatal(err)
+	}
+	checkRooms := func() {
+		rooms, err := s.room.JoinedRooms(creator, creator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 {
+			t.Fatal("expected failed room creation to be rolled back, got rooms ", rooms)
+		}
+	}
+
+	if _, err := createRoomFromJson(t, s, creator, `{"room_alias_name": "taken"}`); err == nil {
+		t.Fatal("expected room creation with an alias in use to fail")
+	}
+	checkRooms()
+	if _, err := s.room.LookupAlias(ct.NewAlias("taken", "matrix.org")); err != nil {
+		t.Fatal("expected alias of existing room to be kept, got ", err)
+	}
+
+	// fails after the alias and all state has been added, when inviting the creator
+	body := `{"room_alias_name": "fresh", "name": "fresh", "invite": ["@invitee:matrix.org", "@creator:matrix.org"]}`
+	if _, err := createRoomFromJson(t, s, creator, body); err == nil {
+		t.Fatal("expected room creation with an invalid invite to fail")
+	}
+	checkRooms()
+	if _, err := s.room.LookupAlias(ct.NewAlias("fresh", "matrix.org")); err == nil {
+		t.Error("expected alias of failed room creation to be removed")
+	}
+	sync, err := s.sync.FullSync(invitee, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 0 {
+		t.Error("expected invites of failed room creation to be removed, got ", sync.Rooms)
+	}
+	if _, err := createRoomFromJson(t, s, creator, `{"room_alias_name": "fresh"}`); err != nil {
+		t.Error("expected alias of failed room creation to be available, got ", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func TestCanonicalAliasAndAvatar(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	member := ct.NewUserId("member", "matrix.org")
+	for _, user := range []ct.UserId{creator, member} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, err := createRoomFromJson(t, s, creator, `{"visibility": "public", "room_alias_name": "main", "name": "Main"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := createRoomFromJson(t, s, creator, `{"visibility": "public", "room_alias_name": "other"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createRoomFromJson(t, s, creator, `{"room_alias_name": "hidden"}`); err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, member, member, types.MembershipMember)
+
+	main := ct.NewAlias("main", "matrix.org")
+	missing := ct.NewAlias("missing", "matrix.org")
+	otherAlias := ct.NewAlias("other", "matrix.org")
+	for _, content := range []*types.CanonicalAliasEventContent{
+		{Alias: &missing},
+		{Alias: &otherAlias},
+		{Alias: &main, AltAliases: []ct.Alias{otherAlias}},
+	} {
+		if _, err := s.room.SetState(room, creator, content, ""); err == nil {
+			t.Error("expected canonical alias that doesn't point to the room to be rejected: ", content)
+		}
+	}
+	if _, err := s.room.SetState(room, creator, &types.CanonicalAliasEventContent{Alias: &main}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, creator, &types.AvatarEventContent{Url: "mxc://matrix.org/avatar"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, member, &types.AvatarEventContent{Url: "mxc://matrix.org/other"}, ""); err == nil {
+		t.Error("expected avatar change without power to be rejected")
+	}
+
+	rooms, err := s.room.PublicRooms(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].RoomId != room || rooms[1].RoomId != other {
+		t.Fatal("expected public rooms to be listed largest first, got ", rooms)
+	}
+	listed := rooms[0]
+	if listed.Name == nil || *listed.Name != "Main" || listed.NumJoinedMembers != 2 {
+		t.Error("expected name and member count in directory listing, got ", listed)
+	}
+	if listed.CanonicalAlias == nil || *listed.CanonicalAlias != main || listed.AvatarUrl != "mxc://matrix.org/avatar" {
+		t.Error("expected canonical alias and avatar in directory listing, got ", listed)
+	}
+
+	sync, err := s.sync.FullSync(member, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 {
+		t.Fatal("expected one room in sync, got ", sync.Rooms)
+	}
+	summary := sync.Rooms[0]
+	if summary.CanonicalAlias == nil || *summary.CanonicalAlias != main || summary.AvatarUrl != "mxc://matrix.org/avatar" {
+		t.Error("expected canonical alias and avatar in room summary, got ", summary.CanonicalAlias, summary.AvatarUrl)
+	}
+
+	replacement, err := s.room.UpgradeRoom(other, creator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms, err = s.room.PublicRooms(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].RoomId != room || rooms[1].RoomId != replacement {
+		t.Error("expected replaced room to be left out of the directory, got ", rooms)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func TestGuestAccess(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	guest := ct.NewUserId("_guest_test", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateGuest(guest); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.room.CreateRoom("matrix.org", guest, &types.RoomDescription{}); err == nil {
+		t.Fatal("expected guests to be unable to create rooms")
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	join := &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, guest, join, guest.String()); err == nil {
+		t.Fatal("expected guest to be unable to join without guest access")
+	}
+	message := types.NewGenericContent(map[string]interface{}{"body": "hi"}, "m.room.message")
+	if _, err := s.room.AddMessage(room, guest, message, nil); err == nil {
+		t.Fatal("expected guest to be unable to send without guest access")
+	}
+
+	guestAccess := &types.GuestAccessEventContent{GuestAccess: types.GuestAccessCanJoin}
+	if _, err := s.room.SetState(room, creator, guestAccess, ""); err != nil {
+		t.Fatal(err)
+	}
+	join = &types.MembershipEventContent{Membership: types.MembershipMember}
+	if _, err := s.room.SetState(room, guest, join, guest.String()); err != nil {
+		t.Fatal("expected guest to be able to join, got ", err)
+	}
+	if _, err := s.room.AddMessage(room, guest, message, nil); err != nil {
+		t.Fatal("expected guest to be able to send, got ", err)
+	}
+	if _, err := s.room.State(room, guest, types.EventTypeGuestAccess, ""); err != nil {
+		t.Fatal("expected guest to be able to read state, got ", err)
+	}
+	topic := &types.TopicEventContent{Topic: "guest topic"}
+	if _, err := s.room.SetState(room, guest, topic, ""); err == nil {
+		t.Fatal("expected guest to be unable to set state")
+	}
+
+	guestAccess = &types.GuestAccessEventContent{GuestAccess: types.GuestAccessForbidden}
+	if _, err := s.room.SetState(room, creator, guestAccess, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.AddMessage(room, guest, message, nil); err == nil {
+		t.Fatal("expected guest to be unable to send after guest access was revoked")
+	}
+}
+
+func TestGuestUpgrade(t *testing.T) {
+	s := setup()
+	guest := ct.NewUserId("_guest_test", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	if err := s.user.CreateGuest(guest); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.UpgradeGuest(user, user, "secret"); err == nil {
+		t.Fatal("expected upgrade of a full user to fail")
+	}
+	if err := s.user.UpgradeGuest(guest, user, "secret"); err == nil {
+		t.Fatal("expected upgrade of another user to fail")
+	}
+	if err := s.user.UpgradeGuest(guest, guest, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	isGuest, err := s.user.IsGuest(guest, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isGuest {
+		t.Fatal("expected upgraded user to no longer be a guest")
+	}
+	verified, err := s.user.VerifyPassword(guest, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Fatal("expected upgraded user to be able to log in")
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+const (
+	none   = types.MembershipNone
+	invite = types.MembershipInvited
+	join   = types.MembershipMember
+	knock  = types.MembershipKnocking
+	leave  = types.MembershipLeaving
+	ban    = types.MembershipBanned
+)
+
+type membershipRoom struct {
+	s        services
+	room     ct.RoomId
+	creator  ct.UserId
+	peer     ct.UserId
+	outsider ct.UserId
+	target   ct.UserId
+}
+
+// Sets up a room with a creator, a peer, an outsider that has full power but isn't
+// in the room, and a target user that doesn't have any membership yet
+func setupMembershipRoom(t *testing.T, peerPowerLevel, targetPowerLevel int) membershipRoom {
+	s := setup()
+	r := membershipRoom{
+		s:        s,
+		creator:  ct.NewUserId("creator", "matrix.org"),
+		peer:     ct.NewUserId("peer", "matrix.org"),
+		outsider: ct.NewUserId("outsider", "matrix.org"),
+		target:   ct.NewUserId("target", "matrix.org"),
+	}
+	for _, user := range []ct.UserId{r.creator, r.peer, r.outsider, r.target} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", r.creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.room = room
+	setMembership(t, s, room, r.peer, r.peer, join)
+	powerLevels := types.DefaultPowerLevels(r.creator)
+	powerLevels.Users[r.outsider.String()] = 100
+	powerLevels.Users[r.peer.String()] = peerPowerLevel
+	powerLevels.Users[r.target.String()] = targetPowerLevel
+	if _, err := s.room.SetState(room, r.creator, powerLevels, ""); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (r membershipRoom) setJoinRule(t *testing.T, joinRule types.JoinRule) {
+	content := &types.JoinRulesEventContent{JoinRule: joinRule}
+	if _, err := r.s.room.SetState(r.room, r.creator, content, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Moves the target user to the given membership
+func (r membershipRoom) prepare(t *testing.T, membership types.Membership) {
+	switch membership {
+	case invite:
+		r.setJoinRule(t, types.JoinRuleInvite)
+		setMembership(t, r.s, r.room, r.creator, r.target, invite)
+	case join:
+		r.setJoinRule(t, types.JoinRulePublic)
+		setMembership(t, r.s, r.room, r.target, r.target, join)
+	case knock:
+		r.setJoinRule(t, types.JoinRuleKnock)
+		setMembership(t, r.s, r.room, r.target, r.target, knock)
+	case leave:
+		r.setJoinRule(t, types.JoinRulePublic)
+		setMembership(t, r.s, r.room, r.target, r.target, join)
+		setMembership(t, r.s, r.room, r.target, r.target, leave)
+	case ban:
+		setMembership(t, r.s, r.room, r.creator, r.target, ban)
+	}
+}
+
+func (r membershipRoom) membership(t *testing.T) types.Membership {
+	state, err := r.s.room.State(r.room, r.creator, types.EventTypeMembership, r.target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil {
+		return none
+	}
+	return state.Content.(*types.MembershipEventContent).Membership
+}
+
+// Whether the transition is allowed when made by the target itself, the room creator,
+// a peer without any power, and an outsider with full power
+var membershipTransitions = []struct {
+	from, to                      types.Membership
+	joinRule                      types.JoinRule
+	self, creator, peer, outsider bool
+}{
+	{none, invite, types.JoinRuleInvite, false, true, true, false},
+	{none, invite, types.JoinRulePublic, false, true, true, false},
+	{none, invite, types.JoinRuleKnock, false, true, true, false},
+	{none, invite, types.JoinRulePrivate, false, true, true, false},
+	{none, join, types.JoinRulePublic, true, false, false, false},
+	{none, join, types.JoinRuleInvite, false, false, false, false},
+	{none, join, types.JoinRulePrivate, false, false, false, false},
+	{none, join, types.JoinRuleKnock, false, false, false, false},
+	{none, join, types.JoinRuleRestricted, false, false, false, false},
+	{none, knock, types.JoinRuleKnock, true, false, false, false},
+	{none, knock, types.JoinRulePublic, false, false, false, false},
+	{none, knock, types.JoinRulePrivate, false, false, false, false},
+	{none, leave, types.JoinRulePublic, false, false, false, false},
+	{none, ban, types.JoinRulePublic, false, true, false, false},
+
+	{invite, none, types.JoinRuleInvite, false, false, false, false},
+	{invite, join, types.JoinRuleInvite, true, false, false, false},
+	{invite, join, types.JoinRulePrivate, true, false, false, false},
+	{invite, knock, types.JoinRuleKnock, false, false, false, false},
+	{invite, leave, types.JoinRuleInvite, true, true, false, false},
+	{invite, ban, types.JoinRuleInvite, false, true, false, false},
+
+	{join, none, types.JoinRulePublic, false, false, false, false},
+	{join, invite, types.JoinRuleInvite, false, false, false, false},
+	{join, knock, types.JoinRuleKnock, false, false, false, false},
+	{join, leave, types.JoinRulePublic, true, true, false, false},
+	{join, ban, types.JoinRulePublic, false, true, false, false},
+
+	{knock, none, types.JoinRuleKnock, false, false, false, false},
+	{knock, invite, types.JoinRuleKnock, false, true, true, false},
+	{knock, join, types.JoinRuleKnock, false, false, false, false},
+	{knock, join, types.JoinRulePublic, true, false, false, false},
+	{knock, leave, types.JoinRuleKnock, true, true, false, false},
+	{knock, ban, types.JoinRuleKnock, false, true, false, false},
+
+	{leave, none, types.JoinRulePublic, false, false, false, false},
+	{leave, invite, types.JoinRuleInvite, false, true, true, false},
+	{leave, join, types.JoinRulePublic, true, false, false, false},
+	{leave, join, types.JoinRuleInvite, false, false, false, false},
+	{leave, knock, types.JoinRuleKnock, true, false, false, false},
+	{leave, ban, types.JoinRulePublic, false, true, false, false},
+
+	{ban, none, types.JoinRulePublic, false, true, false, false},
+	{ban, invite, types.JoinRuleInvite, false, false, false, false},
+	{ban, join, types.JoinRulePublic, false, false, false, false},
+	{ban, knock, types.JoinRuleKnock, false, false, false, false},
+	{ban, leave, types.JoinRulePublic, false, false, false, false},
+}
+
+func TestMembershipTransitions(t *testing.T) {
+	for _, transition := range membershipTransitions {
+		callers := []struct {
+			name    string
+			caller  func(membershipRoom) ct.UserId
+			allowed bool
+		}{
+			{"self", func(r membershipRoom) ct.UserId { return r.target }, transition.self},
+			{"creator", func(r membershipRoom) ct.UserId { return r.creator }, transition.creator},
+			{"peer", func(r membershipRoom) ct.UserId { return r.peer }, transition.peer},
+			{"outsider", func(r membershipRoom) ct.UserId { return r.outsider }, transition.outsider},
+		}
+		for _, c := range callers {
+			r := setupMembershipRoom(t, 0, 0)
+			r.prepare(t, transition.from)
+			r.setJoinRule(t, transition.joinRule)
+			caller := c.caller(r)
+			content := &types.MembershipEventContent{Membership: transition.to}
+			_, err := r.s.room.SetState(r.room, caller, content, r.target.String())
+			if c.allowed && err != nil {
+				t.Errorf("expected %s to be able to change membership from %q to %q in %s room, got %s",
+					c.name, transition.from, transition.to, transition.joinRule, err)
+			}
+			if !c.allowed && err == nil {
+				t.Errorf("expected %s not to be able to change membership from %q to %q in %s room",
+					c.name, transition.from, transition.to, transition.joinRule)
+			}
+			expected := transition.from
+			if c.allowed {
+				expected = transition.to
+			}
+			if membership := r.membership(t); membership != expected {
+				t.Errorf("expected membership to be %q after %s changed it from %q to %q, was %q",
+					expected, c.name, transition.from, transition.to, membership)
+			}
+		}
+	}
+}
+
+// Kicks and bans require the caller to have both the power level of the action and
+// a higher power level than the target
+var membershipPowerLevels = []struct {
+	to                          types.Membership
+	peerPowerLevel, targetLevel int
+	allowed                     bool
+}{
+	{leave, 49, 0, false},
+	{leave, 50, 0, true},
+	{leave, 50, 50, false},
+	{leave, 60, 50, true},
+	{leave, 60, 100, false},
+	{ban, 49, 0, false},
+	{ban, 50, 0, true},
+	{ban, 50, 50, false},
+	{ban, 60, 50, true},
+	{ban, 60, 100, false},
+}
+
+func TestMembershipPowerLevels(t *testing.T) {
+	for _, c := range membershipPowerLevels {
+		r := setupMembershipRoom(t, c.peerPowerLevel, c.targetLevel)
+		r.prepare(t, join)
+		content := &types.MembershipEventContent{Membership: c.to}
+		_, err := r.s.room.SetState(r.room, r.peer, content, r.target.String())
+		if c.allowed && err != nil {
+			t.Errorf("expected peer with power level %d to be able to change membership of user with power level %d to %s, got %s",
+				c.peerPowerLevel, c.targetLevel, c.to, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("expected peer with power level %d not to be able to change membership of user with power level %d to %s",
+				c.peerPowerLevel, c.targetLevel, c.to)
+		}
+	}
+}
+
+func TestRestrictedJoinRule(t *testing.T) {
+	r := setupMembershipRoom(t, 0, 0)
+	desc := types.RoomDescription{Visibility: types.VisibilityPrivate}
+	space, _, err := r.s.room.CreateRoom("matrix.org", r.creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a room in the allow list that has been purged doesn't prevent joins through the other rooms
+	gone, _, err := r.s.room.CreateRoom("matrix.org", r.creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, r.s, gone, r.creator, r.creator, leave)
+	if err := r.s.room.ForgetRoom(gone, r.creator); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.s.room.RoomExists(gone, r.creator); err == nil {
+		t.Fatal("expected forgotten room to be purged")
+	}
+	var content types.JoinRulesEventContent
+	allow := `{"join_rule": "restricted", "allow": [` +
+		`{"type": "m.room_membership", "room_id": "` + gone.String() + `"}, ` +
+		`{"type": "m.room_membership", "room_id": "` + space.String() + `"}]}`
+	if err := json.Unmarshal([]byte(allow), &content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.s.room.SetState(r.room, r.creator, &content, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	joinContent := &types.MembershipEventContent{Membership: join}
+	if _, err := r.s.room.SetState(r.room, r.target, joinContent, r.target.String()); err == nil {
+		t.Fatal("expected join to be rejected when not a member of any allowed room")
+	}
+	setMembership(t, r.s, space, r.creator, r.target, invite)
+	if _, err := r.s.room.SetState(r.room, r.target, joinContent, r.target.String()); err == nil {
+		t.Fatal("expected join to be rejected when only invited to an allowed room")
+	}
+	setMembership(t, r.s, space, r.target, r.target, join)
+	if _, err := r.s.room.SetState(r.room, r.target, joinContent, r.target.String()); err != nil {
+		t.Fatal("expected members of an allowed room to be able to join, got ", err)
+	}
+
+	invalid := &types.JoinRulesEventContent{
+		JoinRule: types.JoinRuleRestricted,
+		Allow:    []types.JoinRuleCondition{{Type: "m.unknown", RoomId: space}},
+	}
+	if _, err := r.s.room.SetState(r.room, r.creator, invalid, ""); err == nil {
+		t.Error("expected unknown join rule conditions to be rejected")
+	}
+}
+
+func TestPendingRooms(t *testing.T) {
+	r := setupMembershipRoom(t, 0, 0)
+	desc := types.RoomDescription{Visibility: types.VisibilityPrivate}
+	invited, _, err := r.s.room.CreateRoom("matrix.org", r.creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, r.s, invited, r.creator, r.target, invite)
+	r.prepare(t, knock)
+
+	if _, err := r.s.room.PendingRooms(r.target, r.creator); err == nil {
+		t.Fatal("expected listing the pending rooms of another user to fail")
+	}
+	rooms, err := r.s.room.PendingRooms(r.target, r.target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[ct.RoomId]bool{}
+	for _, room := range rooms {
+		found[room] = true
+	}
+	if len(rooms) != 2 || !found[invited] || !found[r.room] {
+		t.Fatal("expected invited and knocked rooms to be pending, got ", rooms)
+	}
+
+	setMembership(t, r.s, invited, r.target, r.target, join)
+	setMembership(t, r.s, r.room, r.target, r.target, leave)
+	rooms, err = r.s.room.PendingRooms(r.target, r.target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 0 {
+		t.Error("expected no pending rooms after joining and retracting the knock, got ", rooms)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func copyPowerLevels(powerLevels *types.PowerLevelsEventContent) *types.PowerLevelsEventContent {
+	result := *powerLevels
+	result.Users = types.UserPowerLevelMap{}
+	for user, level := range powerLevels.Users {
+		result.Users[user] = level
+	}
+	result.Events = map[string]int{}
+	for eventType, level := range powerLevels.Events {
+		result.Events[eventType] = level
+	}
+	return &result
+}
+
+func TestPowerLevelChanges(t *testing.T) {
+	creator := ct.NewUserId("creator", "matrix.org")
+	mod := ct.NewUserId("mod", "matrix.org")
+	peer := ct.NewUserId("peer", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+
+	cases := []struct {
+		name    string
+		change  func(*types.PowerLevelsEventContent)
+		allowed bool
+	}{
+		{"promote user below own level", func(pl *types.PowerLevelsEventContent) { pl.Users[user.String()] = 49 }, true},
+		{"promote user to own level", func(pl *types.PowerLevelsEventContent) { pl.Users[user.String()] = 50 }, true},
+		{"promote user above own level", func(pl *types.PowerLevelsEventContent) { pl.Users[user.String()] = 51 }, false},
+		{"demote user below own level", func(pl *types.PowerLevelsEventContent) { pl.Users[user.String()] = 0 }, true},
+		{"demote peer of equal level", func(pl *types.PowerLevelsEventContent) { pl.Users[peer.String()] = 0 }, false},
+		{"remove peer of equal level", func(pl *types.PowerLevelsEventContent) { delete(pl.Users, peer.String()) }, false},
+		{"demote creator", func(pl *types.PowerLevelsEventContent) { pl.Users[creator.String()] = 0 }, false},
+		{"demote self", func(pl *types.PowerLevelsEventContent) { pl.Users[mod.String()] = 10 }, true},
+		{"promote self", func(pl *types.PowerLevelsEventContent) { pl.Users[mod.String()] = 60 }, false},
+		{"lower ban level", func(pl *types.PowerLevelsEventContent) { pl.Ban = 40 }, true},
+		{"raise ban level above own level", func(pl *types.PowerLevelsEventContent) { pl.Ban = 60 }, false},
+		{"raise users default above own level", func(pl *types.PowerLevelsEventContent) { pl.UserDefault = 60 }, false},
+		{"lower event level above own level", func(pl *types.PowerLevelsEventContent) { pl.Events[types.EventTypeName] = 50 }, false},
+		{"remove event level above own level", func(pl *types.PowerLevelsEventContent) { delete(pl.Events, types.EventTypeName) }, false},
+		{"add event level at own level", func(pl *types.PowerLevelsEventContent) { pl.Events["m.room.topic"] = 50 }, true},
+		{"add event level above own level", func(pl *types.PowerLevelsEventContent) { pl.Events["m.room.topic"] = 51 }, false},
+		{"add empty event type", func(pl *types.PowerLevelsEventContent) { pl.Events[""] = 0 }, false},
+		{"add invalid user id", func(pl *types.PowerLevelsEventContent) { pl.Users["mod"] = 0 }, false},
+	}
+
+	for _, c := range cases {
+		s := setup()
+		for _, u := range []ct.UserId{creator, mod, peer, user} {
+			if err := s.user.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+		room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range []ct.UserId{mod, peer, user} {
+			setMembership(t, s, room, u, u, types.MembershipMember)
+		}
+		initial := types.DefaultPowerLevels(creator)
+		initial.Users[mod.String()] = 50
+		initial.Users[peer.String()] = 50
+		initial.Users[user.String()] = 10
+		initial.Events[types.EventTypePowerLevels] = 50
+		if _, err := s.room.SetState(room, creator, initial, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		updated := copyPowerLevels(initial)
+		c.change(updated)
+		_, err = s.room.SetState(room, mod, updated, "")
+		if c.allowed && err != nil {
+			t.Errorf("expected to be allowed to %s, got %s", c.name, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("expected not to be allowed to %s", c.name)
+		}
+	}
+}
+
+func TestPowerLevelsJson(t *testing.T) {
+	var content types.PowerLevelsEventContent
+	err := json.Unmarshal([]byte(`{"ban": 50, "users": {"@user:matrix.org": 10}}`), &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Users["@user:matrix.org"] != 10 {
+		t.Error("expected user power level to be 10, got ", content.Users)
+	}
+	err = json.Unmarshal([]byte(`{"users": {"user": 10}}`), &content)
+	if err == nil {
+		t.Error("expected invalid user id in power levels to be rejected")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	cd "github.com/matrix-org/bullettime/core/db"
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/interfaces"
+	"github.com/matrix-org/bullettime/matrix/service"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func setupRegistration(t *testing.T, config types.RegistrationConfig) interfaces.RegistrationService {
+	tokenStore, err := cd.NewRegistrationTokenDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registration, err := service.NewRegistrationService(config, tokenStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registration
+}
+
+func TestLocalpartValidation(t *testing.T) {
+	config := types.DefaultRegistrationConfig()
+	config.MaxLocalpartLength = 8
+	config.ReservedLocalparts = []string{"admin"}
+	registration := setupRegistration(t, config)
+
+	valid := []string{"alice", "a.b_c=d", "x-y/z", "12345678"}
+	for _, localpart := range valid {
+		if err := registration.ValidateLocalpart(localpart); err != nil {
+			t.Error("expected '"+localpart+"' to be valid, got ", err)
+		}
+	}
+	invalid := []string{"", "Alice", "a:b", "a b", "123456789", "admin", "_bridge"}
+	for _, localpart := range invalid {
+		if err := registration.ValidateLocalpart(localpart); err == nil {
+			t.Error("expected '" + localpart + "' to be invalid")
+		} else if err.Code() != "M_INVALID_USERNAME" {
+			t.Error("expected M_INVALID_USERNAME error code but got ", err.Code())
+		}
+	}
+}
+
+func TestRegistrationModes(t *testing.T) {
+	config := types.DefaultRegistrationConfig()
+	flows, err := setupRegistration(t, config).Flows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].Stages[0] != types.LoginTypeDummy {
+		t.Error("expected open registration to use the dummy stage, got ", flows)
+	}
+	config.Mode = types.RegistrationModeClosed
+	if _, err := setupRegistration(t, config).Flows(); err == nil {
+		t.Error("expected closed registration to be forbidden")
+	}
+	config.Mode = types.RegistrationModeSharedSecret
+	tokenStore, _ := cd.NewRegistrationTokenDb()
+	if _, err := service.NewRegistrationService(config, tokenStore); err == nil {
+		t.Error("expected shared secret mode to require a secret")
+	}
+}
+
+func TestRegistrationTokens(t *testing.T) {
+	config := types.DefaultRegistrationConfig()
+	config.Mode = types.RegistrationModeToken
+	registration := setupRegistration(t, config)
+
+	uses := uint(2)
+	limited, err := registration.CreateToken(types.RegistrationToken{UsesAllowed: &uses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited.Token == "" {
+		t.Fatal("expected a token to be generated")
+	}
+	for i := 0; i < 3; i++ {
+		if err := registration.ValidateAuthToken(limited.Token); err != nil {
+			t.Fatal("expected validation not to use the token, got ", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := registration.UseAuthToken(limited.Token); err != nil {
+			t.Fatal("expected token to be usable, got ", err)
+		}
+	}
+	if err := registration.ValidateAuthToken(limited.Token); err == nil {
+		t.Error("expected token to be used up")
+	}
+	if err := registration.UseAuthToken(limited.Token); err == nil {
+		t.Error("expected use of a used up token to fail")
+	}
+
+	expiry := ct.Timestamp{Time: time.Now().Add(-time.Second)}
+	expired, err := registration.CreateToken(types.RegistrationToken{Token: "expired", ExpiryTime: &expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registration.ValidateAuthToken(expired.Token); err == nil {
+		t.Error("expected token to be expired")
+	}
+	if _, err := registration.CreateToken(types.RegistrationToken{Token: "expired"}); err == nil {
+		t.Error("expected duplicate token to be rejected")
+	}
+	if _, err := registration.CreateToken(types.RegistrationToken{Token: "in valid"}); err == nil {
+		t.Error("expected invalid token to be rejected")
+	}
+	if err := registration.DeleteToken("expired"); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := registration.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Completed != 2 {
+		t.Error("expected a single used up token, got ", tokens)
+	}
+}
+
+func TestSharedSecretRegistration(t *testing.T) {
+	config := types.DefaultRegistrationConfig()
+	config.Mode = types.RegistrationModeSharedSecret
+	config.SharedSecret = "secret"
+	registration := setupRegistration(t, config)
+
+	nonce, err := registration.NewSharedSecretNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(nonce + "\x00alice\x00password\x00notadmin"))
+	hexMac := hex.EncodeToString(mac.Sum(nil))
+
+	if err := registration.VerifySharedSecret(nonce, "bob", "password", false, hexMac); err == nil {
+		t.Error("expected mac for another user to be rejected")
+	}
+	if err := registration.VerifySharedSecret(nonce, "alice", "password", false, hexMac); err == nil {
+		t.Error("expected nonce to be single use")
+	}
+	nonce, err = registration.NewSharedSecretNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac.Reset()
+	mac.Write([]byte(nonce + "\x00alice\x00password\x00notadmin"))
+	hexMac = hex.EncodeToString(mac.Sum(nil))
+	if err := registration.VerifySharedSecret(nonce, "alice", "password", true, hexMac); err == nil {
+		t.Error("expected mac to cover the admin flag")
+	}
+	nonce, err = registration.NewSharedSecretNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac.Reset()
+	mac.Write([]byte(nonce + "\x00alice\x00password\x00notadmin"))
+	hexMac = hex.EncodeToString(mac.Sum(nil))
+	if err := registration.VerifySharedSecret(nonce, "alice", "password", false, hexMac); err != nil {
+		t.Error("expected shared secret registration to be verified, got ", err)
+	}
+}
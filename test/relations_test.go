@@ -0,0 +1,228 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+const reactionEventType = "m.reaction"
+
+func sendRelation(
+	t *testing.T,
+	s services,
+	room ct.RoomId,
+	user ct.UserId,
+	eventType string,
+	relatesTo map[string]interface{},
+) *types.Message {
+	content := types.NewGenericContent(map[string]interface{}{"m.relates_to": relatesTo}, eventType)
+	message, err := s.room.AddMessage(room, user, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func findEvent(events []types.Event, eventId ct.EventId) *types.Message {
+	for _, event := range events {
+		if message, ok := event.(*types.Message); ok && message.EventId == eventId {
+			return message
+		}
+	}
+	return nil
+}
+
+func checkAggregation(t *testing.T, source string, event *types.Message, replace ct.EventId, annotations ...types.AnnotationCount) {
+	if event == nil {
+		t.Fatal(source, ": parent event not found")
+	}
+	if event.Unsigned == nil || event.Unsigned.Relations == nil {
+		t.Fatal(source, ": expected aggregated relations, got ", event.Unsigned)
+	}
+	relations := event.Unsigned.Relations
+	if relations.Replace == nil || relations.Replace.GetEventKey() != ct.Id(replace) {
+		t.Error(source, ": expected latest edit to be ", replace, " got ", relations.Replace)
+	}
+	if relations.Annotation == nil || len(relations.Annotation.Chunk) != len(annotations) {
+		t.Fatal(source, ": expected annotations ", annotations, " got ", relations.Annotation)
+	}
+	for i, annotation := range annotations {
+		if relations.Annotation.Chunk[i] != annotation {
+			t.Error(source, ": expected annotations ", annotations, " got ", relations.Annotation.Chunk)
+		}
+	}
+}
+
+func TestRelationAggregations(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user1 := ct.NewUserId("user1", "matrix.org")
+	user2 := ct.NewUserId("user2", "matrix.org")
+	for _, user := range []ct.UserId{creator, user1, user2} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user1, user1, types.MembershipMember)
+	setMembership(t, s, room, user2, user2, types.MembershipMember)
+
+	content := types.NewGenericContent(map[string]interface{}{"body": "hello"}, messageEventType)
+	parent, err := s.room.AddMessage(room, creator, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotation := func(key string) map[string]interface{} {
+		return map[string]interface{}{"rel_type": types.RelationAnnotation, "event_id": parent.EventId.String(), "key": key}
+	}
+	replace := map[string]interface{}{"rel_type": types.RelationReplace, "event_id": parent.EventId.String()}
+
+	sendRelation(t, s, room, user1, reactionEventType, annotation("👍"))
+	sendRelation(t, s, room, user2, reactionEventType, annotation("❤"))
+	sendRelation(t, s, room, user2, reactionEventType, annotation("👍"))
+	sendRelation(t, s, room, user1, reactionEventType, annotation("👍"))
+	sendRelation(t, s, room, creator, messageEventType, replace)
+	edit := sendRelation(t, s, room, creator, messageEventType, replace)
+	sendRelation(t, s, room, user1, messageEventType, replace)
+	sendRelation(t, s, room, creator, reactionEventType, replace)
+
+	thumbsUp := types.AnnotationCount{EventType: reactionEventType, Key: "👍", Count: 2}
+	heart := types.AnnotationCount{EventType: reactionEventType, Key: "❤", Count: 1}
+
+	to := types.NewStreamToken(0, 0, 0)
+	messages, err := s.event.Messages(user1, "", room, nil, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAggregation(t, "messages", findEvent(messages.Events, parent.EventId), edit.EventId, thumbsUp, heart)
+
+	events, err := s.event.Range(user1, "", nil, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAggregation(t, "events", findEvent(events.Events, parent.EventId), edit.EventId, thumbsUp, heart)
+
+	sync, err := s.sync.FullSync(user2, "", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 {
+		t.Fatal("expected one room in the initial sync, got ", sync.Rooms)
+	}
+	checkAggregation(t, "initial sync", findEvent(sync.Rooms[0].Messages.Events, parent.EventId), edit.EventId, thumbsUp, heart)
+
+	event, err := s.event.Event(user2, "", parent.EventId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAggregation(t, "event", event.(*types.Message), edit.EventId, thumbsUp, heart)
+
+	if parent.Unsigned != nil {
+		t.Error("expected the stored event to be left without unsigned data, got ", parent.Unsigned)
+	}
+}
+
+func TestRelationsPagination(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRoom, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := types.NewGenericContent(map[string]interface{}{"body": "hello"}, messageEventType)
+	parent, err := s.room.AddMessage(room, creator, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relation := func(relType, key string) map[string]interface{} {
+		return map[string]interface{}{"rel_type": relType, "event_id": parent.EventId.String(), "key": key}
+	}
+	sent := []ct.EventId{}
+	for _, key := range []string{"a", "b", "c"} {
+		sent = append(sent, sendRelation(t, s, room, creator, reactionEventType, relation(types.RelationAnnotation, key)).EventId)
+	}
+	sent = append(sent, sendRelation(t, s, room, creator, messageEventType, relation(types.RelationReference, "")).EventId)
+	sent = append(sent, sendRelation(t, s, room, creator, messageEventType, relation(types.RelationReplace, "")).EventId)
+	// relations from other rooms are ignored
+	sendRelation(t, s, otherRoom, creator, reactionEventType, relation(types.RelationAnnotation, "d"))
+
+	var from *types.StreamToken
+	received := []ct.EventId{}
+	for pages := 0; ; pages += 1 {
+		if pages > len(sent) {
+			t.Fatal("pagination did not end")
+		}
+		chunk, err := s.event.Relations(creator, "", room, parent.EventId, "", "", from, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range chunk.Events {
+			received = append(received, ct.EventId(event.GetEventKey()))
+		}
+		if chunk.NextBatch == nil {
+			break
+		}
+		from = chunk.NextBatch
+	}
+	if len(received) != len(sent) {
+		t.Fatal("expected relations ", sent, " got ", received)
+	}
+	for i, eventId := range received {
+		if eventId != sent[len(sent)-1-i] {
+			t.Fatal("expected relations newest first ", sent, " got ", received)
+		}
+	}
+
+	annotations, err := s.event.Relations(creator, "", room, parent.EventId, types.RelationAnnotation, "", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations.Events) != 3 || annotations.NextBatch != nil {
+		t.Error("expected three annotations and no next batch, got ", annotations)
+	}
+	references, err := s.event.Relations(creator, "", room, parent.EventId, types.RelationReference, reactionEventType, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(references.Events) != 0 {
+		t.Error("expected no references of the type ", reactionEventType, ", got ", references.Events)
+	}
+	if _, err := s.event.Relations(creator, "", otherRoom, parent.EventId, "", "", nil, 10); err == nil {
+		t.Error("expected relations of an event in another room to be rejected")
+	}
+
+	malformed := types.NewGenericContent(map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": types.RelationAnnotation, "event_id": parent.EventId.String()},
+	}, reactionEventType)
+	if _, err := s.room.AddMessage(room, creator, malformed, nil); err == nil {
+		t.Error("expected annotation without a key to be rejected")
+	}
+}
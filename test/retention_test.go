@@ -0,0 +1,223 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+const messageEventType = "m.room.message"
+
+func sendMessages(t *testing.T, s services, room ct.RoomId, user ct.UserId, bodies ...string) {
+	for _, body := range bodies {
+		content := types.NewGenericContent(map[string]interface{}{"body": body}, messageEventType)
+		if _, err := s.room.AddMessage(room, user, content, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns the bodies of the messages in the room, newest first
+func roomHistory(t *testing.T, s services, room ct.RoomId, user ct.UserId) ([]string, *types.EventStreamRange) {
+	to := types.NewStreamToken(0, 0, 0)
+	messages, err := s.event.Messages(user, "", room, nil, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := []string{}
+	for _, event := range messages.Events {
+		if message, ok := event.(*types.Message); ok && message.EventType == messageEventType {
+			content := message.Content.(*types.GenericContent)
+			bodies = append(bodies, content.Content["body"].(string))
+		}
+	}
+	return bodies, messages
+}
+
+// Fails if the current state event of the given type can't be looked up by id anymore
+func checkStateEvent(t *testing.T, s services, room ct.RoomId, user ct.UserId, eventType string) {
+	state, err := s.room.State(room, user, eventType, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.event.Event(user, "", state.EventId); err != nil {
+		t.Error("expected current state event "+eventType+" to be kept, got ", err)
+	}
+}
+
+func TestRetentionMaxCount(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxCount := uint(2)
+	retention := &types.RetentionEventContent{MaxCount: &maxCount}
+	if _, err := s.room.SetState(room, creator, retention, ""); err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "m1", "m2", "m3", "m4", "m5")
+
+	if err := s.retention.EnforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	bodies, messages := roomHistory(t, s, room, creator)
+	if len(bodies) != 2 || bodies[0] != "m5" || bodies[1] != "m4" {
+		t.Error("expected only the two newest messages to be kept, got ", bodies)
+	}
+	checkStateEvent(t, s, room, creator, types.EventTypeCreate)
+	checkStateEvent(t, s, room, creator, types.EventTypeRetention)
+	if messages.HistoryStart == nil {
+		t.Fatal("expected messages to report where history starts")
+	}
+	to := types.NewStreamToken(0, 0, 0)
+	older, err := s.event.Messages(creator, "", room, messages.HistoryStart, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(older.Events) != 0 {
+		t.Error("expected no events before the start of history, got ", older.Events)
+	}
+}
+
+func TestRetentionMultipleRooms(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	rooms := make([]ct.RoomId, 3)
+	for i := range rooms {
+		room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rooms[i] = room
+	}
+	for i, maxCount := range []uint{1, 3} {
+		maxCount := maxCount
+		retention := &types.RetentionEventContent{MaxCount: &maxCount}
+		if _, err := s.room.SetState(rooms[i], creator, retention, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range []string{"m1", "m2", "m3", "m4"} {
+		for _, room := range rooms {
+			sendMessages(t, s, room, creator, body)
+		}
+	}
+
+	if err := s.retention.EnforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{1, 3, 4} {
+		if bodies, _ := roomHistory(t, s, rooms[i], creator); len(bodies) != expected {
+			t.Errorf("expected %d messages to be kept in room %d, got %v", expected, i, bodies)
+		}
+	}
+	sendMessages(t, s, rooms[0], creator, "m5")
+	if err := s.retention.EnforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := roomHistory(t, s, rooms[0], creator); len(bodies) != 1 || bodies[0] != "m5" {
+		t.Error("expected only the newest message to be kept, got ", bodies)
+	}
+	if bodies, _ := roomHistory(t, s, rooms[1], creator); len(bodies) != 3 || bodies[2] != "m2" {
+		t.Error("expected the three newest messages to be kept, got ", bodies)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "m1", "m2")
+	if err := s.retention.EnforceRetention(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := roomHistory(t, s, room, creator); len(bodies) != 2 {
+		t.Fatal("expected history to be kept without a retention policy, got ", bodies)
+	}
+
+	maxLifetime := uint64(time.Minute / time.Millisecond)
+	retention := &types.RetentionEventContent{MaxLifetime: &maxLifetime}
+	if _, err := s.room.SetState(room, creator, retention, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.retention.EnforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := roomHistory(t, s, room, creator); len(bodies) != 2 {
+		t.Fatal("expected recent messages to be kept, got ", bodies)
+	}
+	if err := s.retention.EnforceRetention(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if bodies, _ := roomHistory(t, s, room, creator); len(bodies) != 0 {
+		t.Error("expected old messages to be purged, got ", bodies)
+	}
+	checkStateEvent(t, s, room, creator, types.EventTypePowerLevels)
+}
+
+func TestAdminPurgeHistory(t *testing.T) {
+	s := setup()
+	admin := ct.NewUserId("admin", "matrix.org")
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateAdmin(admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "m1", "m2")
+	sync, err := s.sync.FullSync(creator, "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := sync.End
+	sendMessages(t, s, room, creator, "m3")
+
+	if err := s.retention.PurgeHistory(room, creator, before); err == nil {
+		t.Fatal("expected M_FORBIDDEN when purging as non-admin")
+	}
+	if err := s.retention.PurgeHistory(room, admin, before); err != nil {
+		t.Fatal(err)
+	}
+	bodies, messages := roomHistory(t, s, room, creator)
+	if len(bodies) != 1 || bodies[0] != "m3" {
+		t.Error("expected only messages after the token to be kept, got ", bodies)
+	}
+	if messages.HistoryStart == nil || *messages.HistoryStart != before {
+		t.Error("expected history to start at ", before, " got ", messages.HistoryStart)
+	}
+}
@@ -28,13 +28,15 @@ import (
 )
 
 type services struct {
-	room     interfaces.RoomService
-	user     interfaces.UserService
-	profile  interfaces.ProfileService
-	presence interfaces.PresenceService
-	token    interfaces.TokenService
-	event    interfaces.EventService
-	sync     interfaces.SyncService
+	room      interfaces.RoomService
+	user      interfaces.UserService
+	profile   interfaces.ProfileService
+	presence  interfaces.PresenceService
+	token     interfaces.TokenService
+	event     interfaces.EventService
+	sync      interfaces.SyncService
+	auth      interfaces.InteractiveAuthService
+	retention interfaces.RetentionService
 }
 
 func setup() services {
@@ -91,6 +93,10 @@ func setup() services {
 		presenceStream,
 		typingStream,
 		typingStream,
+		userStore,
+		userStore,
+		messageStream,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
@@ -113,7 +119,7 @@ func setup() services {
 	if err != nil {
 		panic(err)
 	}
-	tokenService, err := service.CreateTokenService()
+	tokenService, err := service.CreateTokenService(userStore)
 	if err != nil {
 		panic(err)
 	}
@@ -124,6 +130,9 @@ func setup() services {
 		streamMux,
 		messageStream,
 		memberStore,
+		messageStream,
+		messageStream,
+		messageStream,
 	)
 	if err != nil {
 		panic(err)
@@ -134,6 +143,28 @@ func setup() services {
 		typingStream,
 		roomStore,
 		memberStore,
+		messageStream,
+		presenceStream,
+		messageStream,
+	)
+	if err != nil {
+		panic(err)
+	}
+	authService, err := service.NewInteractiveAuthService(
+		service.NewPasswordAuthStage(userService),
+		service.NewDummyAuthStage(),
+		service.NewTokenAuthStage(types.LoginTypeToken, staticTokenValidator("letmein")),
+	)
+	if err != nil {
+		panic(err)
+	}
+	retentionService, err := service.NewRetentionService(
+		types.RetentionPolicy{},
+		roomStore,
+		messageStream,
+		messageStream,
+		messageStream,
+		userStore,
 	)
 	if err != nil {
 		panic(err)
@@ -146,7 +177,18 @@ func setup() services {
 		tokenService,
 		eventService,
 		syncService,
+		authService,
+		retentionService,
+	}
+}
+
+type staticTokenValidator string
+
+func (v staticTokenValidator) ValidateAuthToken(token string) types.Error {
+	if token != string(v) {
+		return types.ForbiddenError("invalid token")
 	}
+	return nil
 }
 
 func TestUserCreation(t *testing.T) {
@@ -173,3 +215,241 @@ func TestUserCreation(t *testing.T) {
 		t.Error("expected empty status message")
 	}
 }
+
+func TestTokenRevocation(t *testing.T) {
+	s := setup()
+	userId := ct.NewUserId("test", "matrix.org")
+	if err := s.user.CreateUser(userId); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.token.NewAccessToken(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.token.NewAccessToken(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(first.String()); err != nil {
+		t.Fatal("expected first token to be valid, got ", err)
+	}
+	if err := s.token.RevokeAllAccessTokens(userId, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(first.String()); err == nil {
+		t.Fatal("expected first token to be revoked")
+	}
+	if _, err := s.token.ParseAccessToken(second.String()); err != nil {
+		t.Fatal("expected second token to still be valid, got ", err)
+	}
+	if err := s.token.RevokeAccessToken(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.token.ParseAccessToken(second.String()); err == nil {
+		t.Fatal("expected second token to be revoked")
+	}
+}
+
+func TestUserDeactivation(t *testing.T) {
+	s := setup()
+	userId := ct.NewUserId("test", "matrix.org")
+	if err := s.user.CreateUser(userId); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.SetPassword(userId, userId, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := s.user.VerifyPassword(userId, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Fatal("expected password to be verified")
+	}
+	other := ct.NewUserId("other", "matrix.org")
+	if err := s.user.Deactivate(userId, other); err == nil {
+		t.Fatal("expected M_FORBIDDEN when deactivating another user")
+	}
+	if err := s.user.Deactivate(userId, userId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.user.VerifyPassword(userId, "secret"); err == nil {
+		t.Fatal("expected login of deactivated user to fail")
+	} else if err.Code() != "M_FORBIDDEN" {
+		t.Error("expected M_FORBIDDEN error code but got ", err.Code())
+	}
+	if err := s.user.CreateUser(userId); err == nil {
+		t.Fatal("expected deactivated user id to stay in use")
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	s := setup()
+	admin := ct.NewUserId("admin", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	if err := s.user.CreateAdmin(admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.user.Users(user); err == nil {
+		t.Fatal("expected M_FORBIDDEN when listing users as non-admin")
+	}
+	users, err := s.user.Users(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatal("expected 2 users, got ", users)
+	}
+	token, err := s.token.NewAccessToken(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := s.token.ParseAccessToken(token.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.IsAdmin() {
+		t.Error("expected admin token to be flagged as admin")
+	}
+	if err := s.user.SetAdmin(admin, user, false); err == nil {
+		t.Error("expected M_FORBIDDEN when demoting as non-admin")
+	}
+	if err := s.user.SetAdmin(admin, admin, false); err == nil {
+		t.Error("expected M_FORBIDDEN when admin demotes themselves")
+	}
+	if err := s.user.SetAdmin(user, admin, true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.user.UserInfo(user, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Admin || info.Guest || info.Deactivated {
+		t.Error("expected promoted user info, got ", info)
+	}
+	if err := s.user.SetAdmin(admin, user, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.user.Users(admin); err == nil {
+		t.Error("expected M_FORBIDDEN when listing users after being demoted")
+	}
+}
+
+func TestInteractiveAuth(t *testing.T) {
+	s := setup()
+	userId := ct.NewUserId("test", "matrix.org")
+	if err := s.user.CreateUser(userId); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.user.SetPassword(userId, userId, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	flows := []types.AuthFlow{
+		{Stages: []types.LoginType{types.LoginTypeDummy, types.LoginTypeToken}},
+		{Stages: []types.LoginType{types.LoginTypePassword}},
+	}
+
+	err := s.auth.Authenticate("test", flows, &userId, nil)
+	authErr, ok := err.(*types.AuthRequiredError)
+	if !ok {
+		t.Fatal("expected auth required error, got ", err)
+	}
+	if authErr.Status() != 401 || authErr.Session == "" || len(authErr.Flows) != 2 {
+		t.Fatal("invalid auth required error: ", authErr)
+	}
+	session := authErr.Session
+
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:    types.LoginTypeToken,
+		Session: session,
+		Token:   "letmein",
+	})
+	if authErr, ok := err.(*types.AuthRequiredError); !ok || len(authErr.Completed) != 0 {
+		t.Fatal("expected out of order stage to be rejected, got ", err)
+	}
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:    types.LoginTypeDummy,
+		Session: session,
+	})
+	if authErr, ok := err.(*types.AuthRequiredError); !ok || len(authErr.Completed) != 1 {
+		t.Fatal("expected dummy stage to be completed, got ", err)
+	}
+	err = s.auth.Authenticate("other", flows, &userId, &types.AuthDict{
+		Type:    types.LoginTypeToken,
+		Session: session,
+		Token:   "letmein",
+	})
+	if err == nil || err.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected session to be bound to operation, got ", err)
+	}
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:    types.LoginTypeToken,
+		Session: session,
+		Token:   "wrong",
+	})
+	if authErr, ok := err.(*types.AuthRequiredError); !ok || authErr.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected invalid token to be rejected, got ", err)
+	}
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:    types.LoginTypeToken,
+		Session: session,
+		Token:   "letmein",
+	})
+	if err != nil {
+		t.Fatal("expected flow to be completed, got ", err)
+	}
+
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:     types.LoginTypePassword,
+		Password: "wrong",
+	})
+	if authErr, ok := err.(*types.AuthRequiredError); !ok || authErr.Code() != "M_FORBIDDEN" {
+		t.Fatal("expected invalid password to be rejected, got ", err)
+	}
+	err = s.auth.Authenticate("test", flows, &userId, &types.AuthDict{
+		Type:     types.LoginTypePassword,
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal("expected password flow to be completed, got ", err)
+	}
+	err = s.auth.Authenticate("test", flows, nil, &types.AuthDict{
+		Type:     types.LoginTypePassword,
+		Password: "secret",
+	})
+	if err == nil {
+		t.Fatal("expected password stage to require an authenticated user")
+	}
+}
+
+func TestInteractiveAuthSessionLimit(t *testing.T) {
+	s := setup()
+	flows := []types.AuthFlow{{Stages: []types.LoginType{types.LoginTypeDummy, types.LoginTypeDummy}}}
+	var first string
+	for i := 0; ; i++ {
+		err := s.auth.Authenticate("test", flows, nil, nil)
+		authErr, ok := err.(*types.AuthRequiredError)
+		if !ok {
+			if err == nil || err.Code() != "M_LIMIT_EXCEEDED" {
+				t.Fatal("expected the number of sessions to be limited, got ", err)
+			}
+			if i < 100 {
+				t.Fatal("expected more sessions to be allowed, got ", i)
+			}
+			break
+		}
+		if i == 0 {
+			first = authErr.Session
+		}
+		if i > 100000 {
+			t.Fatal("expected the number of sessions to be limited")
+		}
+	}
+	err := s.auth.Authenticate("test", flows, nil, &types.AuthDict{Type: types.LoginTypeDummy, Session: first})
+	if authErr, ok := err.(*types.AuthRequiredError); !ok || len(authErr.Completed) != 1 {
+		t.Error("expected existing sessions to continue at the limit, got ", err)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func messageBodies(events []types.Event) []string {
+	bodies := []string{}
+	for _, event := range events {
+		if message, ok := event.(*types.Message); ok && message.EventType == messageEventType {
+			bodies = append(bodies, message.Content.(*types.GenericContent).Content["body"].(string))
+		}
+	}
+	return bodies
+}
+
+func TestArchivedRooms(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	for _, u := range []ct.UserId{creator, user} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := "before"
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, Name: &name}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user, user, types.MembershipMember)
+	sendMessages(t, s, room, creator, "m1")
+	setMembership(t, s, room, user, user, types.MembershipLeaving)
+	sendMessages(t, s, room, creator, "m2")
+	if _, err := s.room.SetState(room, creator, &types.NameEventContent{Name: "after"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sync, err := s.sync.FullSync(user, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 0 {
+		t.Fatal("expected archived rooms to be omitted, got ", sync.Rooms)
+	}
+	sync, err = s.sync.FullSync(user, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 {
+		t.Fatal("expected archived room to be included, got ", sync.Rooms)
+	}
+	summary := sync.Rooms[0]
+	if summary.RoomId != room || summary.Membership != types.MembershipLeaving {
+		t.Error("expected archived room with membership leave, got ", summary.RoomId, summary.Membership)
+	}
+	if bodies := messageBodies(summary.Messages.Events); len(bodies) != 1 || bodies[0] != "m1" {
+		t.Error("expected history up to the leave, got ", bodies)
+	}
+	leaveFound := false
+	for _, event := range summary.Messages.Events {
+		// newest first
+		if state, ok := event.(*types.State); ok && state.StateKey == user.String() {
+			leaveFound = state.Content.(*types.MembershipEventContent).Membership == types.MembershipLeaving
+			break
+		}
+	}
+	if !leaveFound {
+		t.Error("expected the leave event to be the last membership event in the history")
+	}
+	for _, state := range summary.State {
+		if content, ok := state.Content.(*types.NameEventContent); ok && content.Name != "before" {
+			t.Error("expected state as of the leave, got name ", content.Name)
+		}
+	}
+
+	setMembership(t, s, room, user, user, types.MembershipMember)
+	sync, err = s.sync.FullSync(user, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipMember {
+		t.Fatal("expected rejoined room to be listed once as joined, got ", sync.Rooms)
+	}
+
+	setMembership(t, s, room, creator, user, types.MembershipLeaving)
+	setMembership(t, s, room, creator, user, types.MembershipInvited)
+	sync, err = s.sync.FullSync(user, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipInvited {
+		t.Fatal("expected re-invited room to be listed once as invited, got ", sync.Rooms)
+	}
+	setMembership(t, s, room, user, user, types.MembershipLeaving)
+	sync, err = s.sync.FullSync(user, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipLeaving {
+		t.Fatal("expected room to be archived again after rejecting the invite, got ", sync.Rooms)
+	}
+}
+
+func TestInvitedRooms(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	for _, u := range []ct.UserId{creator, user} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := "secret"
+	desc := types.RoomDescription{Visibility: types.VisibilityPrivate, Name: &name}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "m1")
+	setMembership(t, s, room, creator, user, types.MembershipInvited)
+
+	sync, err := s.sync.FullSync(user, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 {
+		t.Fatal("expected invited room to be included, got ", sync.Rooms)
+	}
+	summary := sync.Rooms[0]
+	if summary.RoomId != room || summary.Membership != types.MembershipInvited {
+		t.Error("expected invited room, got ", summary.RoomId, summary.Membership)
+	}
+	if summary.Inviter == nil || *summary.Inviter != creator {
+		t.Error("expected inviter to be ", creator, " got ", summary.Inviter)
+	}
+	if len(summary.Messages.Events) != 0 || len(summary.State) != 0 {
+		t.Error("expected no history or state for invited room, got ", summary.Messages.Events, summary.State)
+	}
+	nameFound, joinRuleFound := false, false
+	for _, state := range summary.InviteState {
+		switch content := state.Content.(type) {
+		case *types.NameEventContent:
+			nameFound = content.Name == name
+		case *types.JoinRulesEventContent:
+			joinRuleFound = content.JoinRule == types.JoinRuleInvite
+		case *types.MembershipEventContent:
+		default:
+			t.Error("unexpected invite state ", state.EventType)
+		}
+	}
+	if !nameFound || !joinRuleFound {
+		t.Error("expected name and join rule in invite state, got ", summary.InviteState)
+	}
+
+	setMembership(t, s, room, user, user, types.MembershipMember)
+	sync, err = s.sync.FullSync(user, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipMember || sync.Rooms[0].Inviter != nil {
+		t.Fatal("expected joined room to be listed once as joined, got ", sync.Rooms)
+	}
+
+	desc = types.RoomDescription{Visibility: types.VisibilityPrivate, Invited: []ct.UserId{user}}
+	invitedAtCreation, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync, err = s.sync.FullSync(user, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, summary := range sync.Rooms {
+		if summary.RoomId == invitedAtCreation {
+			found = summary.Membership == types.MembershipInvited && summary.Inviter != nil && *summary.Inviter == creator
+		}
+	}
+	if !found {
+		t.Error("expected room with invite from room creation to be included as invited, got ", sync.Rooms)
+	}
+}
+
+func TestForgetRoom(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	stranger := ct.NewUserId("stranger", "matrix.org")
+	for _, u := range []ct.UserId{creator, user, stranger} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user, user, types.MembershipMember)
+	sendMessages(t, s, room, creator, "m1")
+
+	if err := s.room.ForgetRoom(room, user); err == nil {
+		t.Fatal("expected forgetting a joined room to fail")
+	}
+	if err := s.room.ForgetRoom(room, stranger); err == nil {
+		t.Fatal("expected forgetting a room that was never joined to fail")
+	}
+	setMembership(t, s, room, user, user, types.MembershipLeaving)
+	if err := s.room.ForgetRoom(room, user); err != nil {
+		t.Fatal(err)
+	}
+	sync, err := s.sync.FullSync(user, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 0 {
+		t.Error("expected forgotten room to be omitted from archived rooms, got ", sync.Rooms)
+	}
+	if _, err := s.event.Messages(user, "", room, nil, nil, 10, nil); err == nil {
+		t.Error("expected history of forgotten room to be inaccessible")
+	}
+	if _, err := s.sync.RoomSync(user, "", room, 10); err == nil {
+		t.Error("expected initial sync of forgotten room to be inaccessible")
+	}
+
+	setMembership(t, s, room, user, user, types.MembershipMember)
+	checkHistory(t, s, room, user, "m1")
+	setMembership(t, s, room, user, user, types.MembershipLeaving)
+	if err := s.room.ForgetRoom(room, user); err != nil {
+		t.Fatal(err)
+	}
+
+	setMembership(t, s, room, creator, creator, types.MembershipLeaving)
+	if err := s.room.RoomExists(room, creator); err != nil {
+		t.Fatal("expected room to be kept until all former members have forgotten it, got ", err)
+	}
+	if err := s.room.ForgetRoom(room, creator); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.RoomExists(room, creator); err == nil {
+		t.Error("expected room to be purged once all former members have forgotten it")
+	}
+}
+
+func TestForgetRoomWithPendingInvite(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	for _, u := range []ct.UserId{creator, user} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPrivate}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, creator, user, types.MembershipInvited)
+	setMembership(t, s, room, creator, creator, types.MembershipLeaving)
+	if err := s.room.ForgetRoom(room, creator); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.RoomExists(room, user); err != nil {
+		t.Fatal("expected room to be kept while an invite is pending, got ", err)
+	}
+	sync, err := s.sync.FullSync(user, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sync.Rooms) != 1 || sync.Rooms[0].Membership != types.MembershipInvited {
+		t.Fatal("expected pending invite to be included, got ", sync.Rooms)
+	}
+
+	setMembership(t, s, room, user, user, types.MembershipLeaving)
+	if err := s.room.ForgetRoom(room, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.room.RoomExists(room, user); err == nil {
+		t.Error("expected room to be purged once the invite was rejected and forgotten")
+	}
+	if _, err := s.sync.FullSync(user, "", 10, true); err != nil {
+		t.Error("expected sync to succeed after the room was purged, got ", err)
+	}
+}
+
+func TestRoomSummaryNames(t *testing.T) {
+	s := setup()
+	users := []ct.UserId{}
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		user := ct.NewUserId(name, "matrix.org")
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		displayName := strings.ToUpper(name[:1]) + name[1:]
+		if _, err := s.profile.UpdateProfile(user, user, &displayName, nil); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	alice, bob, carol := users[0], users[1], users[2]
+	summaryOf := func(user ct.UserId) types.RoomSummary {
+		sync, err := s.sync.FullSync(user, "", 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sync.Rooms) != 1 {
+			t.Fatal("expected one room, got ", sync.Rooms)
+		}
+		return sync.Rooms[0]
+	}
+	checkName := func(user ct.UserId, expected string) {
+		if name := summaryOf(user).Name; name != expected {
+			t.Errorf("expected room name for %s to be %q, got %q", user, expected, name)
+		}
+	}
+
+	aliasName := "named"
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, Alias: &aliasName}
+	room, alias, err := s.room.CreateRoom("matrix.org", alice, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkName(alice, "Empty room")
+	setMembership(t, s, room, bob, bob, types.MembershipMember)
+	checkName(alice, "Bob")
+	checkName(bob, "Alice")
+	setMembership(t, s, room, alice, carol, types.MembershipInvited)
+	checkName(alice, "Bob and Carol")
+	checkName(carol, "Alice and Bob")
+	for _, user := range users[3:] {
+		setMembership(t, s, room, user, user, types.MembershipMember)
+	}
+	checkName(alice, "Bob, Dave, Erin, Frank, Grace and 2 others")
+
+	heidi := users[7]
+	setMembership(t, s, room, heidi, heidi, types.MembershipLeaving)
+	checkName(alice, "Bob, Dave, Erin, Frank, Grace and 1 other")
+	archived, err := s.sync.FullSync(heidi, "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived.Rooms) != 1 || archived.Rooms[0].Name != "Alice, Bob, Dave, Erin, Frank and 2 others" {
+		t.Error("expected name of archived room to count all remaining members, got ", archived.Rooms)
+	}
+	setMembership(t, s, room, heidi, heidi, types.MembershipMember)
+
+	summary := summaryOf(alice).Summary
+	if summary.JoinedMemberCount != 7 || summary.InvitedMemberCount != 1 {
+		t.Error("expected 7 joined and 1 invited members, got ", summary.JoinedMemberCount, summary.InvitedMemberCount)
+	}
+	if len(summary.Heroes) != 5 || summary.Heroes[0] != bob || summary.Heroes[4] != users[6] {
+		t.Error("expected the first joined members to be heroes, got ", summary.Heroes)
+	}
+	// profile changes update the membership events, but not the order of the heroes
+	time.Sleep(2 * time.Millisecond)
+	robert := "Robert"
+	if _, err := s.profile.UpdateProfile(bob, bob, &robert, nil); err != nil {
+		t.Fatal(err)
+	}
+	if heroes := summaryOf(alice).Summary.Heroes; len(heroes) != 5 || heroes[0] != bob || heroes[4] != users[6] {
+		t.Error("expected the order of the heroes to be kept after a profile change, got ", heroes)
+	}
+	checkName(alice, "Robert, Dave, Erin, Frank, Grace and 2 others")
+	if summary := summaryOf(carol); summary.Membership != types.MembershipInvited || summary.Summary.JoinedMemberCount != 7 {
+		t.Error("expected summary of invited room to include member counts, got ", summary.Summary)
+	}
+
+	if _, err := s.room.SetState(room, alice, &types.CanonicalAliasEventContent{Alias: alias}, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkName(bob, alias.String())
+	if _, err := s.room.SetState(room, alice, &types.NameEventContent{Name: "Named"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkName(bob, "Named")
+}
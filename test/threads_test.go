@@ -0,0 +1,156 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func sendThreadReply(t *testing.T, s services, room ct.RoomId, user ct.UserId, root ct.EventId, body string) *types.Message {
+	content := types.NewGenericContent(map[string]interface{}{
+		"body":         body,
+		"m.relates_to": map[string]interface{}{"rel_type": types.RelationThread, "event_id": root.String()},
+	}, messageEventType)
+	message, err := s.room.AddMessage(room, user, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func checkThreads(t *testing.T, chunk *types.RelationsChunk, expected ...ct.EventId) {
+	if len(chunk.Events) != len(expected) {
+		t.Fatal("expected threads ", expected, " got ", chunk.Events)
+	}
+	for i, event := range chunk.Events {
+		if event.GetEventKey() != ct.Id(expected[i]) {
+			t.Fatal("expected threads ", expected, " got ", chunk.Events)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user1 := ct.NewUserId("user1", "matrix.org")
+	user2 := ct.NewUserId("user2", "matrix.org")
+	for _, user := range []ct.UserId{creator, user1, user2} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user1, user1, types.MembershipMember)
+	setMembership(t, s, room, user2, user2, types.MembershipMember)
+
+	rootA, err := s.room.AddMessage(room, creator, types.NewGenericContent(map[string]interface{}{"body": "a"}, messageEventType), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootB, err := s.room.AddMessage(room, creator, types.NewGenericContent(map[string]interface{}{"body": "b"}, messageEventType), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1 := sendThreadReply(t, s, room, user1, rootA.EventId, "a1")
+	sendThreadReply(t, s, room, user2, rootB.EventId, "b1")
+	a2 := sendThreadReply(t, s, room, user2, rootA.EventId, "a2")
+	sendMessages(t, s, room, creator, "main")
+
+	threads, err := s.event.Threads(user1, "", room, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, threads, rootA.EventId, rootB.EventId)
+	summary := threads.Events[0].(*types.Message).Unsigned.Relations.Thread
+	if summary.Count != 2 || summary.LatestEvent.GetEventKey() != ct.Id(a2.EventId) || !summary.CurrentUserParticipated {
+		t.Errorf("expected two replies with a2 as the latest and user1 participating, got %#v", summary)
+	}
+	if threads.Events[1].(*types.Message).Unsigned.Relations.Thread.CurrentUserParticipated {
+		t.Error("expected user1 to not have participated in thread b")
+	}
+
+	first, err := s.event.Threads(user1, "", room, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, first, rootA.EventId)
+	if first.NextBatch == nil {
+		t.Fatal("expected a next batch of threads")
+	}
+	second, err := s.event.Threads(user1, "", room, first.NextBatch, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, second, rootB.EventId)
+	if second.NextBatch == nil {
+		t.Fatal("expected a next batch of threads after a full page")
+	}
+	third, err := s.event.Threads(user1, "", room, second.NextBatch, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, third)
+	if third.NextBatch != nil {
+		t.Error("expected no next batch after the last thread")
+	}
+
+	sendThreadReply(t, s, room, creator, rootB.EventId, "b2")
+	threads, err = s.event.Threads(user1, "", room, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, threads, rootB.EventId, rootA.EventId)
+
+	replies, err := s.event.Relations(user1, "", room, rootA.EventId, types.RelationThread, "", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, replies, a2.EventId)
+	replies, err = s.event.Relations(user1, "", room, rootA.EventId, types.RelationThread, "", replies.NextBatch, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkThreads(t, replies, a1.EventId)
+
+	to := types.NewStreamToken(0, 0, 0)
+	timeline, err := s.event.Messages(user1, "", room, nil, &to, 100, &types.RoomEventFilter{NotInThread: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := messageBodies(timeline.Events)
+	expected := []string{"main", "b", "a"}
+	if len(bodies) != len(expected) {
+		t.Fatal("expected main timeline ", expected, " got ", bodies)
+	}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Fatal("expected main timeline ", expected, " got ", bodies)
+		}
+	}
+	everything, err := s.event.Messages(user1, "", room, nil, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodies := messageBodies(everything.Events); len(bodies) != 7 {
+		t.Error("expected thread replies without a filter, got ", bodies)
+	}
+}
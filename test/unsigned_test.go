@@ -0,0 +1,218 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+// Returns the messages of the room as served to the session of the user, newest first
+func servedMessages(t *testing.T, s services, room ct.RoomId, user ct.UserId, session string) []types.Event {
+	to := types.NewStreamToken(0, 0, 0)
+	messages, err := s.event.Messages(user, session, room, nil, &to, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages.Events
+}
+
+func servedState(events []types.Event, eventId ct.EventId) *types.State {
+	for _, event := range events {
+		if state, ok := event.(*types.State); ok && state.EventId == eventId {
+			return state
+		}
+	}
+	return nil
+}
+
+func TestUnsignedData(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	for _, u := range []ct.UserId{creator, user} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user, user, types.MembershipMember)
+
+	sending, err := s.token.NewAccessToken(creator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDevice, err := s.token.NewAccessToken(creator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sending.SessionId() == otherDevice.SessionId() {
+		t.Fatal("expected access tokens to have different sessions")
+	}
+	content := types.NewGenericContent(map[string]interface{}{"body": "hello"}, messageEventType)
+	txn := &types.Transaction{SessionId: sending.SessionId(), Id: "txn1"}
+	message, err := s.room.AddMessage(room, creator, content, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.room.SetState(room, creator, &types.NameEventContent{Name: "first"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.room.SetState(room, creator, &types.NameEventContent{Name: "second"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := findEvent(servedMessages(t, s, room, creator, sending.SessionId()), message.EventId)
+	if echo == nil || echo.Unsigned == nil || echo.Unsigned.TransactionId != "txn1" || echo.Unsigned.Age < 0 {
+		t.Fatalf("expected the echo to the sender to carry the transaction id and age, got %#v", echo)
+	}
+	otherSession := findEvent(servedMessages(t, s, room, creator, otherDevice.SessionId()), message.EventId)
+	if otherSession == nil || otherSession.Unsigned == nil || otherSession.Unsigned.TransactionId != "" {
+		t.Fatalf("expected the transaction id to not be served to other sessions of the sender, got %#v", otherSession)
+	}
+	other := findEvent(servedMessages(t, s, room, user, sending.SessionId()), message.EventId)
+	if other == nil || other.Unsigned == nil || other.Unsigned.TransactionId != "" {
+		t.Fatalf("expected the transaction id to only be served to the sender, got %#v", other)
+	}
+	if message.Unsigned != nil {
+		t.Error("expected the stored event to be left without unsigned data, got ", message.Unsigned)
+	}
+
+	state := servedState(servedMessages(t, s, room, user, ""), second.EventId)
+	if state == nil || state.Unsigned == nil {
+		t.Fatal("expected the name change to be served with unsigned data")
+	}
+	prevContent, ok := state.Unsigned.PrevContent.(*types.NameEventContent)
+	if !ok || prevContent.Name != "first" {
+		t.Errorf("expected prev_content to be the first name, got %#v", state.Unsigned.PrevContent)
+	}
+	if state.Unsigned.PrevSender == nil || *state.Unsigned.PrevSender != creator {
+		t.Error("expected prev_sender to be ", creator, " got ", state.Unsigned.PrevSender)
+	}
+	if state.Unsigned.ReplacesState == nil || *state.Unsigned.ReplacesState != first.EventId {
+		t.Error("expected replaces_state to be ", first.EventId, " got ", state.Unsigned.ReplacesState)
+	}
+	bytes, jsonErr := json.Marshal(state)
+	if jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["prev_content"]; ok {
+		t.Error("expected prev_content to only be served in the unsigned data, got ", string(bytes))
+	}
+	if !strings.Contains(string(fields["unsigned"]), `"age":`) {
+		t.Error("expected the unsigned data to contain the age, got ", string(fields["unsigned"]))
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	user := ct.NewUserId("user", "matrix.org")
+	for _, u := range []ct.UserId{creator, user} {
+		if err := s.user.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, user, user, types.MembershipMember)
+
+	content := types.NewGenericContent(map[string]interface{}{"body": "by creator"}, messageEventType)
+	creatorMessage, err := s.room.AddMessage(room, creator, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = types.NewGenericContent(map[string]interface{}{"body": "by user"}, messageEventType)
+	userMessage, err := s.room.AddMessage(room, user, content, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reaction := sendRelation(t, s, room, user, reactionEventType, map[string]interface{}{
+		"rel_type": types.RelationAnnotation, "event_id": creatorMessage.EventId.String(), "key": "👍",
+	})
+
+	if _, err := s.room.Redact(room, user, creatorMessage.EventId, "", nil); err == nil {
+		t.Error("expected redaction of another user's event without the redact power level to be rejected")
+	}
+	if _, err := s.room.Redact(room, user, reaction.EventId, "oops", &types.Transaction{SessionId: "session", Id: "txn"}); err != nil {
+		t.Fatal(err)
+	}
+	redaction, err := s.room.Redact(room, creator, userMessage.EventId, "spam", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactionContent := types.NewGenericContent(map[string]interface{}{"redacts": userMessage.EventId.String()}, types.EventTypeRedaction)
+	if _, err := s.room.AddMessage(room, creator, redactionContent, nil); err == nil {
+		t.Error("expected redactions to only be sent through Redact")
+	}
+
+	served := servedMessages(t, s, room, user, "")
+	redacted := findEvent(served, userMessage.EventId)
+	if redacted == nil {
+		t.Fatal("expected the redacted event to still be served")
+	}
+	if body := redacted.Content.(*types.GenericContent).Content["body"]; body != nil {
+		t.Error("expected the content of the redacted event to be removed, got ", body)
+	}
+	because := redacted.Unsigned.RedactedBecause
+	if because == nil || because.GetEventKey() != ct.Id(redaction.EventId) {
+		t.Fatal("expected redacted_because to be ", redaction.EventId, " got ", because)
+	}
+	if reason := because.GetContent().(*types.RedactionEventContent).Reason; reason != "spam" {
+		t.Error("expected the redaction reason to be served, got ", reason)
+	}
+	if userMessage.Content.(*types.GenericContent).Content["body"] != "by user" {
+		t.Error("expected the original event to be left untouched")
+	}
+	if parent := findEvent(served, creatorMessage.EventId); parent.Unsigned.Relations != nil {
+		t.Error("expected redacted annotations to be left out of the aggregation, got ", parent.Unsigned.Relations)
+	}
+
+	name, err := s.room.SetState(room, creator, &types.NameEventContent{Name: "name"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.Redact(room, creator, name.EventId, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if current := roomState(t, s, room, creator, types.EventTypeName, ""); current.Content.(*types.NameEventContent).Name != "" {
+		t.Error("expected the name to be redacted from the room state, got ", current.Content)
+	}
+	powerLevels := roomState(t, s, room, creator, types.EventTypePowerLevels, "")
+	if _, err := s.room.Redact(room, creator, powerLevels.EventId, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	redactedLevels := roomState(t, s, room, creator, types.EventTypePowerLevels, "").Content.(*types.PowerLevelsEventContent)
+	if redactedLevels.Users[creator.String()] != 100 {
+		t.Error("expected the power levels of users to survive the redaction, got ", redactedLevels.Users)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func TestRoomUpgrade(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	member := ct.NewUserId("member", "matrix.org")
+	banned := ct.NewUserId("banned", "matrix.org")
+	for _, user := range []ct.UserId{creator, member, banned} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliasName := "main"
+	name := "Main"
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, Alias: &aliasName, Name: &name}
+	room, alias, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.SetState(room, creator, &types.CanonicalAliasEventContent{Alias: alias}, ""); err != nil {
+		t.Fatal(err)
+	}
+	setMembership(t, s, room, member, member, types.MembershipMember)
+	setMembership(t, s, room, creator, banned, types.MembershipBanned)
+
+	if _, err := s.room.UpgradeRoom(room, member, ""); err == nil {
+		t.Fatal("expected upgrade without power to be rejected")
+	}
+	replacement, err := s.room.UpgradeRoom(room, creator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.UpgradeRoom(room, creator, ""); err == nil {
+		t.Error("expected upgrade of a replaced room to be rejected")
+	}
+
+	aliasRoom, err := s.room.LookupAlias(*alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliasRoom != replacement {
+		t.Error("expected alias to be moved to the replacement room, points to ", aliasRoom)
+	}
+	create := roomState(t, s, replacement, creator, types.EventTypeCreate, "").Content.(*types.CreateEventContent)
+	if create.Predecessor == nil || create.Predecessor.RoomId != room || create.Creator != creator {
+		t.Error("expected replacement room to refer to its predecessor, got ", create)
+	}
+	copiedName := roomState(t, s, replacement, creator, types.EventTypeName, "").Content.(*types.NameEventContent)
+	if copiedName.Name != name {
+		t.Error("expected name to be copied, got ", copiedName.Name)
+	}
+	canonicalAlias := roomState(t, s, replacement, creator, types.EventTypeCanonicalAlias, "").Content.(*types.CanonicalAliasEventContent)
+	if canonicalAlias.Alias == nil || *canonicalAlias.Alias != *alias {
+		t.Error("expected canonical alias to be copied, got ", canonicalAlias.Alias)
+	}
+	ban := roomState(t, s, replacement, creator, types.EventTypeMembership, banned.String()).Content.(*types.MembershipEventContent)
+	if ban.Membership != types.MembershipBanned {
+		t.Error("expected bans to be copied, got ", ban.Membership)
+	}
+	if _, err := s.room.State(replacement, member, types.EventTypeName, ""); err == nil {
+		t.Error("expected members of the old room not to be joined to the replacement room")
+	}
+	setMembership(t, s, replacement, member, member, types.MembershipMember)
+
+	tombstone := roomState(t, s, room, creator, types.EventTypeTombstone, "").Content.(*types.TombstoneEventContent)
+	if tombstone.ReplacementRoom != replacement {
+		t.Error("expected tombstone to point to the replacement room, got ", tombstone.ReplacementRoom)
+	}
+	oldCanonicalAlias := roomState(t, s, room, creator, types.EventTypeCanonicalAlias, "").Content.(*types.CanonicalAliasEventContent)
+	if oldCanonicalAlias.Alias != nil {
+		t.Error("expected canonical alias of the old room to be removed, got ", oldCanonicalAlias.Alias)
+	}
+	message := types.NewGenericContent(map[string]interface{}{"body": "hello"}, messageEventType)
+	if _, err := s.room.AddMessage(room, member, message, nil); err == nil {
+		t.Error("expected old room to be locked for members without power")
+	}
+	if _, err := s.room.AddMessage(room, creator, message, nil); err != nil {
+		t.Error("expected moderators to be able to send messages in the old room, got ", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func createVersionedRoom(t *testing.T, s services, creator ct.UserId, version, alias string) ct.RoomId {
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, RoomVersion: version}
+	if alias != "" {
+		desc.Alias = &alias
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func roomVersionOf(t *testing.T, s services, room ct.RoomId, user ct.UserId) string {
+	return roomState(t, s, room, user, types.EventTypeCreate, "").Content.(*types.CreateEventContent).RoomVersion
+}
+
+func TestRoomVersions(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	defaultRoom := createVersionedRoom(t, s, creator, "", "")
+	if version := roomVersionOf(t, s, defaultRoom, creator); version != types.DefaultRoomVersion {
+		t.Error("expected new rooms to have the default version ", types.DefaultRoomVersion, " got ", version)
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic, RoomVersion: "999"}
+	if _, _, err := s.room.CreateRoom("matrix.org", creator, &desc); err == nil {
+		t.Error("expected creation of a room with an unsupported version to be rejected")
+	} else if err.Code() != "M_UNSUPPORTED_ROOM_VERSION" {
+		t.Error("expected M_UNSUPPORTED_ROOM_VERSION error code but got ", err.Code())
+	}
+
+	v1Room := createVersionedRoom(t, s, creator, "1", "")
+	if version := roomVersionOf(t, s, v1Room, creator); version != "1" {
+		t.Fatal("expected room version 1, got ", version)
+	}
+	for _, joinRule := range []types.JoinRule{types.JoinRuleKnock, types.JoinRuleRestricted} {
+		content := &types.JoinRulesEventContent{JoinRule: joinRule}
+		if _, err := s.room.SetState(v1Room, creator, content, ""); err == nil {
+			t.Errorf("expected join rule %s to be rejected in room version 1", joinRule)
+		}
+		if _, err := s.room.SetState(defaultRoom, creator, content, ""); err != nil {
+			t.Errorf("expected join rule %s to be allowed in the default room version, got %s", joinRule, err)
+		}
+	}
+	var initialState []types.InitialState
+	if err := json.Unmarshal([]byte(`[{"type": "m.room.join_rules", "content": {"join_rule": "knock"}}]`), &initialState); err != nil {
+		t.Fatal(err)
+	}
+	desc = types.RoomDescription{RoomVersion: "1", InitialState: initialState}
+	if _, _, err := s.room.CreateRoom("matrix.org", creator, &desc); err == nil {
+		t.Error("expected creation of a version 1 room with the knock join rule to be rejected")
+	}
+
+	create := roomState(t, s, v1Room, creator, types.EventTypeCreate, "")
+	if _, err := s.room.Redact(v1Room, creator, create.EventId, "", nil); err == nil {
+		t.Error("expected redaction of the create event to be rejected")
+	}
+
+	if _, err := s.room.UpgradeRoom(v1Room, creator, "999"); err == nil {
+		t.Error("expected upgrade to an unsupported version to be rejected")
+	}
+	upgraded, err := s.room.UpgradeRoom(v1Room, creator, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := roomVersionOf(t, s, upgraded, creator); version != "7" {
+		t.Error("expected upgraded room to have version 7, got ", version)
+	}
+}
+
+func TestRoomVersionRedactions(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	if err := s.user.CreateUser(creator); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		version     string
+		keepAliases bool
+	}{
+		{"1", true},
+		{"7", false},
+		{"8", false},
+	}
+	for _, c := range cases {
+		room := createVersionedRoom(t, s, creator, c.version, "room"+c.version)
+		aliases := roomState(t, s, room, creator, types.EventTypeAliases, "")
+		if _, err := s.room.Redact(room, creator, aliases.EventId, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		redacted := roomState(t, s, room, creator, types.EventTypeAliases, "").Content.(*types.AliasesEventContent)
+		if kept := len(redacted.Aliases) > 0; kept != c.keepAliases {
+			t.Errorf("expected aliases to be kept in room version %s: %v, got %v", c.version, c.keepAliases, redacted.Aliases)
+		}
+		served := servedState(servedMessages(t, s, room, creator, ""), aliases.EventId)
+		if served == nil {
+			t.Fatal("expected the redacted aliases to be served in room version ", c.version)
+		}
+		if kept := len(served.Content.(*types.AliasesEventContent).Aliases) > 0; kept != c.keepAliases {
+			t.Errorf("expected served aliases to be kept in room version %s: %v, got %v", c.version, c.keepAliases, served.Content)
+		}
+	}
+
+	room := createVersionedRoom(t, s, creator, "8", "")
+	other := createVersionedRoom(t, s, creator, "8", "")
+	allow := []types.JoinRuleCondition{{Type: types.JoinRuleConditionRoomMembership, RoomId: other}}
+	joinRules, err := s.room.SetState(room, creator, &types.JoinRulesEventContent{JoinRule: types.JoinRuleRestricted, Allow: allow}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.room.Redact(room, creator, joinRules.EventId, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	redacted := roomState(t, s, room, creator, types.EventTypeJoinRules, "").Content.(*types.JoinRulesEventContent)
+	if redacted.JoinRule != types.JoinRuleRestricted || len(redacted.Allow) != 1 {
+		t.Error("expected the join rule and allow conditions to survive redaction in room version 8, got ", redacted)
+	}
+}
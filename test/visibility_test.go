@@ -0,0 +1,188 @@
+// Copyright 2015  Ericsson AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	ct "github.com/matrix-org/bullettime/core/types"
+	"github.com/matrix-org/bullettime/matrix/types"
+)
+
+func setHistoryVisibility(t *testing.T, s services, room ct.RoomId, user ct.UserId, visibility types.HistoryVisibility) {
+	content := &types.HistoryVisibilityEventContent{HistoryVisibility: visibility}
+	if _, err := s.room.SetState(room, user, content, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setMembership(t *testing.T, s services, room ct.RoomId, caller, user ct.UserId, membership types.Membership) {
+	content := &types.MembershipEventContent{Membership: membership}
+	if _, err := s.room.SetState(room, caller, content, user.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkHistory(t *testing.T, s services, room ct.RoomId, user ct.UserId, expected ...string) {
+	bodies, _ := roomHistory(t, s, room, user)
+	if len(bodies) != len(expected) {
+		t.Fatal("expected history of ", user, " to be ", expected, " got ", bodies)
+	}
+	for i := range bodies {
+		if bodies[i] != expected[i] {
+			t.Fatal("expected history of ", user, " to be ", expected, " got ", bodies)
+		}
+	}
+}
+
+func TestHistoryVisibility(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	early := ct.NewUserId("early", "matrix.org")
+	late := ct.NewUserId("late", "matrix.org")
+	invited := ct.NewUserId("invited", "matrix.org")
+	for _, user := range []ct.UserId{creator, early, late, invited} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendMessages(t, s, room, creator, "shared")
+	setMembership(t, s, room, creator, early, types.MembershipInvited)
+	setMembership(t, s, room, early, early, types.MembershipMember)
+	checkHistory(t, s, room, early, "shared")
+
+	setHistoryVisibility(t, s, room, creator, types.HistoryVisibilityJoined)
+	sendMessages(t, s, room, creator, "joined")
+	setMembership(t, s, room, early, early, types.MembershipLeaving)
+	sendMessages(t, s, room, creator, "after leave")
+	checkHistory(t, s, room, early, "joined", "shared")
+
+	setMembership(t, s, room, creator, late, types.MembershipInvited)
+	setMembership(t, s, room, late, late, types.MembershipMember)
+	checkHistory(t, s, room, late, "shared")
+
+	setHistoryVisibility(t, s, room, creator, types.HistoryVisibilityInvited)
+	setMembership(t, s, room, creator, invited, types.MembershipInvited)
+	sendMessages(t, s, room, creator, "invited")
+	setMembership(t, s, room, invited, invited, types.MembershipMember)
+	checkHistory(t, s, room, invited, "invited", "shared")
+	checkHistory(t, s, room, late, "invited", "shared")
+
+	state, err := s.room.State(room, creator, types.EventTypeHistoryVisibility, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, err := s.event.Event(early, "", state.EventId); err == nil {
+		t.Error("expected event sent after leaving to be hidden, got ", event)
+	}
+	sync, err := s.sync.RoomSync(late, "", room, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range sync.Messages.Events {
+		if message, ok := event.(*types.Message); ok && message.EventType == messageEventType {
+			if message.Content.(*types.GenericContent).Content["body"] == "joined" {
+				t.Error("expected initial sync to hide events sent before joining")
+			}
+		}
+	}
+}
+
+func TestWorldReadableHistory(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	outsider := ct.NewUserId("outsider", "matrix.org")
+	for _, user := range []ct.UserId{creator, outsider} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &types.RoomDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "private")
+	if _, err := s.room.State(room, outsider, types.EventTypeJoinRules, ""); err == nil {
+		t.Fatal("expected M_FORBIDDEN when reading state of a room that isn't world readable")
+	}
+	setHistoryVisibility(t, s, room, creator, types.HistoryVisibilityWorldReadable)
+	sendMessages(t, s, room, creator, "public")
+	checkHistory(t, s, room, outsider, "public")
+	if _, err := s.room.State(room, outsider, types.EventTypeJoinRules, ""); err != nil {
+		t.Error("expected state of world readable room to be readable, got ", err)
+	}
+}
+
+func TestMessagesAuthorisation(t *testing.T) {
+	s := setup()
+	creator := ct.NewUserId("creator", "matrix.org")
+	outsider := ct.NewUserId("outsider", "matrix.org")
+	banned := ct.NewUserId("banned", "matrix.org")
+	for _, user := range []ct.UserId{creator, outsider, banned} {
+		if err := s.user.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := types.RoomDescription{Visibility: types.VisibilityPublic}
+	room, _, err := s.room.CreateRoom("matrix.org", creator, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, s, room, creator, "m1")
+
+	to := types.NewStreamToken(0, 0, 0)
+	if _, err := s.event.Messages(outsider, "", room, nil, &to, 10, nil); err == nil {
+		t.Fatal("expected M_FORBIDDEN when reading messages of a room that was never joined")
+	} else if err.Code() != "M_FORBIDDEN" {
+		t.Error("expected M_FORBIDDEN error code but got ", err.Code())
+	}
+	if _, err := s.sync.RoomSync(outsider, "", room, 10); err == nil {
+		t.Fatal("expected M_FORBIDDEN when syncing a room that was never joined")
+	} else if err.Code() != "M_FORBIDDEN" {
+		t.Error("expected M_FORBIDDEN error code but got ", err.Code())
+	}
+
+	setMembership(t, s, room, banned, banned, types.MembershipMember)
+	sendMessages(t, s, room, creator, "m2")
+	setMembership(t, s, room, creator, banned, types.MembershipBanned)
+	sendMessages(t, s, room, creator, "m3")
+	checkHistory(t, s, room, banned, "m2", "m1")
+
+	from := types.NewStreamToken(0, 0, 0)
+	future := types.NewStreamToken(1000, 0, 0)
+	messages, err := s.event.Messages(banned, "", room, &from, &future, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range messages.Events {
+		if message, ok := event.(*types.Message); ok && message.EventType == messageEventType {
+			if message.Content.(*types.GenericContent).Content["body"] == "m3" {
+				t.Error("expected pagination to stop at the ban")
+			}
+		}
+	}
+	sync, err := s.sync.RoomSync(banned, "", room, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync.Messages.End.MessageIndex != messages.End.MessageIndex {
+		t.Error("expected initial sync to end at the ban, ended at ", sync.Messages.End, " but messages ended at ", messages.End)
+	}
+}